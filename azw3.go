@@ -1,23 +1,80 @@
 package feeds
 
 import (
-	"github.com/leotaku/mobi"
+	"fmt"
+	"image"
+	"log"
 	"os"
+
+	"github.com/leotaku/mobi"
+	"github.com/leotaku/mobi/records"
+	"golang.org/x/text/language"
 )
 
+func init() {
+	RegisterConverter(format{typ: OutputTypeAZW3, dependency: OutputTypeHTML, version: 2, mimeType: "application/vnd.amazon.ebook", book: azw3Book})
+}
+
 func ToAZW3(content []byte, title, author, outPath string) error {
+	return azw3Book([]chapter{{Title: title, Content: content}}, title, author, ebookMeta{Language: EbookLanguage}, DefaultConvertOptions, outPath)
+}
+
+// azw3Book writes an AZW3 file with one chapter for each of chapters, which get indexed in its table of contents.
+func azw3Book(chapters []chapter, title, author string, meta ebookMeta, opts ConvertOptions, outPath string) error {
 	b := mobi.Book{
-		Title: title,
-		Chapters: []mobi.Chapter{
-			{
-				Title:  title,
-				Chunks: mobi.Chunks(string(content)),
-			},
-		},
+		Title:         title,
+		Publisher:     meta.Publisher,
+		Subject:       meta.mobiSubject(),
+		PublishedDate: meta.Published,
+		UniqueID:      meta.mobiUniqueID(),
+		Chapters:      make([]mobi.Chapter, 0, len(chapters)),
+		Images:        make([]image.Image, 0),
 	}
+	if meta.Language != "" {
+		b.Language = language.Make(meta.Language)
+	}
+	// NOTE(marius): mobi.Book doesn't have a field for the description, the AZW3 files go without it
 	if author != "" {
 		b.Authors = []string{author}
 	}
+	if stylesheet := opts.stylesheet(); stylesheet != "" {
+		b.CSSFlows = []string{stylesheet}
+	}
+
+	if cover, thumb, ok := ebookCover(outPath); ok {
+		im, err := decodeImage(cover, opts)
+		if err != nil {
+			log.Printf("Unable to embed cover: %s", err)
+		}
+		b.CoverImage = im
+		if im, err = decodeImage(thumb, opts); err == nil {
+			b.ThumbImage = im
+		}
+	}
+
+	embedded := make(map[string]int)
+	for _, ch := range chapters {
+		content := ch.Content
+		for _, img := range ebookImages(content, outPath) {
+			index, ok := embedded[img.Src]
+			if !ok {
+				im, err := decodeImage(img.Path, opts)
+				if err != nil {
+					log.Printf("Unable to embed image %s: %s", img.Src, err)
+					continue
+				}
+				b.Images = append(b.Images, im)
+				index = len(b.Images)
+				embedded[img.Src] = index
+			}
+			src := fmt.Sprintf(`src="kindle:embed:%s?mime=image/jpeg"`, records.To32(index))
+			content = replaceSrc(content, img.Src, src)
+		}
+		b.Chapters = append(b.Chapters, mobi.Chapter{
+			Title:  ch.Title,
+			Chunks: mobi.Chunks(string(content)),
+		})
+	}
 
 	f, err := os.Create(outPath)
 	if err != nil {
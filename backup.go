@@ -0,0 +1,309 @@
+package feeds
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	backupVersion      = 1
+	backupManifestName = "manifest.json"
+	backupFilesDir     = "files"
+	// backupExternalDir holds the files of contents saved by older versions outside the storage root
+	backupExternalDir = "external"
+)
+
+// BackupManifest describes the contents of a backup archive.
+type BackupManifest struct {
+	Version       int          `json:"version"`
+	Created       time.Time    `json:"created"`
+	BasePath      string       `json:"basePath"`
+	SchemaVersion int          `json:"schemaVersion"`
+	Files         []BackupFile `json:"files"`
+}
+
+// BackupFile is a file from the storage saved in a backup archive.
+type BackupFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Backup writes to w a gzip compressed tar archive containing a consistent snapshot of the SQLite database,
+// the files from the storage, under their relative names, and a manifest listing them with their checksums.
+// The contents paths in the snapshot are rewritten to be relative to the storage root,
+// so the archive can be restored in a different location.
+func Backup(c *sql.DB, basePath string, s Storage, w io.Writer) (*BackupManifest, error) {
+	if isPostgres(c) {
+		return nil, errors.New("backups are supported only for SQLite databases, use pg_dump for PostgreSQL")
+	}
+	tmp, err := os.MkdirTemp("", "feeds-backup-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	root, err := filepath.Abs(basePath)
+	if err != nil {
+		return nil, err
+	}
+	m := BackupManifest{Version: backupVersion, Created: time.Now().UTC(), BasePath: root}
+	if m.SchemaVersion, err = schemaVersion(c); err != nil {
+		return nil, err
+	}
+
+	snapshot := filepath.Join(tmp, DBFilePath)
+	if _, err = c.Exec(`VACUUM INTO ?;`, snapshot); err != nil {
+		return nil, fmt.Errorf("unable to snapshot database: %w", err)
+	}
+	external, err := prepareSnapshot(snapshot, root)
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	if err = addFileToArchive(tw, DBFilePath, snapshot); err != nil {
+		return nil, err
+	}
+	for _, dir := range storageDirs {
+		err = s.Walk(dir, func(info BlobInfo) error {
+			f, err := s.Open(info.Name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			bf, err := addToArchive(tw, info.Name, info.Size, info.ModTime, f)
+			if err != nil {
+				return fmt.Errorf("unable to archive %s: %w", info.Name, err)
+			}
+			m.Files = append(m.Files, *bf)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for name, filePath := range external {
+		f, err := os.Open(filePath)
+		if err != nil {
+			log.Printf("Unable to archive %s: %s", filePath, err)
+			continue
+		}
+		fi, err := f.Stat()
+		if err == nil {
+			var bf *BackupFile
+			if bf, err = addToArchive(tw, name, fi.Size(), fi.ModTime(), f); err == nil {
+				m.Files = append(m.Files, *bf)
+			}
+		}
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to archive %s: %w", filePath, err)
+		}
+	}
+
+	// NOTE(marius): the manifest is the last entry, as we only know the checksums after writing the files
+	raw, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	hdr := &tar.Header{Name: backupManifestName, Mode: 0644, Size: int64(len(raw)), ModTime: m.Created}
+	if err = tw.WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+	if _, err = tw.Write(raw); err != nil {
+		return nil, err
+	}
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+	return &m, gz.Close()
+}
+
+// prepareSnapshot rewrites the contents paths in the database snapshot to be relative to the root of the storage.
+// The files which are outside it are moved to the external directory, it returns their new names
+// mapped to their current paths.
+func prepareSnapshot(dbPath, root string) (map[string]string, error) {
+	c, err := openDb(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if err = relativizeContentPaths(c, root); err != nil {
+		return nil, err
+	}
+	rows, err := c.Query(`SELECT id, path FROM contents WHERE path LIKE '/%';`)
+	if err != nil {
+		return nil, err
+	}
+	external := make(map[string]string)
+	ids := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var p string
+		if err = rows.Scan(&id, &p); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		name := path.Join(backupExternalDir, fmt.Sprintf("%d-%s", id, sanitizeFileName(path.Base(p))))
+		external[name] = p
+		ids[id] = name
+	}
+	rows.Close()
+
+	for id, name := range ids {
+		if _, err = c.Exec(`UPDATE contents SET path = ? WHERE id = ?;`, name, id); err != nil {
+			return nil, err
+		}
+	}
+	return external, nil
+}
+
+func addFileToArchive(tw *tar.Writer, name, filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = addToArchive(tw, name, fi.Size(), fi.ModTime(), f)
+	return err
+}
+
+func addToArchive(tw *tar.Writer, name string, size int64, mod time.Time, r io.Reader) (*BackupFile, error) {
+	arcName := name
+	if name != DBFilePath {
+		arcName = path.Join(backupFilesDir, name)
+	}
+	hdr := &tar.Header{Name: arcName, Mode: 0644, Size: size, ModTime: mod}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	if _, err := io.CopyN(tw, io.TeeReader(r, h), size); err != nil {
+		return nil, err
+	}
+	return &BackupFile{Name: name, Size: size, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// Restore extracts a backup archive created by Backup: the database is saved in basePath and the files
+// are saved to the s Storage. The database is put in place only after all the files in the manifest
+// have been restored and their checksums verified.
+func Restore(r io.Reader, basePath string, s Storage) (*BackupManifest, error) {
+	dbPath := filepath.Join(basePath, DBFilePath)
+	if _, err := os.Stat(dbPath); err == nil {
+		return nil, fmt.Errorf("database %s already exists", dbPath)
+	}
+	if err := os.MkdirAll(basePath, 0755); err != nil {
+		return nil, err
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	tmpDB := dbPath + ".restore"
+	defer os.Remove(tmpDB)
+
+	var m *BackupManifest
+	restored := make(map[string]string)
+	hasDB := false
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		switch {
+		case hdr.Name == backupManifestName:
+			m = new(BackupManifest)
+			if err = json.NewDecoder(tr).Decode(m); err != nil {
+				return nil, fmt.Errorf("invalid manifest: %w", err)
+			}
+		case hdr.Name == DBFilePath:
+			if err = restoreDB(tmpDB, tr); err != nil {
+				return nil, err
+			}
+			hasDB = true
+		case strings.HasPrefix(hdr.Name, backupFilesDir+"/"):
+			name := path.Clean(strings.TrimPrefix(hdr.Name, backupFilesDir+"/"))
+			if path.IsAbs(name) || strings.HasPrefix(name, "..") {
+				return nil, fmt.Errorf("invalid file name %s in archive", hdr.Name)
+			}
+			if isTempBlob(name) {
+				// NOTE(marius): the partial files the older backups archived while the blobs were being written
+				log.Printf("Skipping temporary file %s", hdr.Name)
+				continue
+			}
+			h := sha256.New()
+			if err = s.Save(name, io.TeeReader(tr, h)); err != nil {
+				return nil, fmt.Errorf("unable to restore %s: %w", name, err)
+			}
+			restored[name] = hex.EncodeToString(h.Sum(nil))
+		default:
+			log.Printf("Skipping unknown archive entry %s", hdr.Name)
+		}
+	}
+
+	if m == nil {
+		return nil, errors.New("the archive doesn't contain a manifest")
+	}
+	if m.Version > backupVersion {
+		return nil, fmt.Errorf("unsupported backup version %d", m.Version)
+	}
+	if !hasDB {
+		return nil, errors.New("the archive doesn't contain a database")
+	}
+	for _, f := range m.Files {
+		if isTempBlob(f.Name) {
+			continue
+		}
+		sum, ok := restored[f.Name]
+		if !ok {
+			return m, fmt.Errorf("file %s is missing from the archive", f.Name)
+		}
+		if sum != f.SHA256 {
+			return m, fmt.Errorf("checksum mismatch for file %s", f.Name)
+		}
+	}
+	return m, os.Rename(tmpDB, dbPath)
+}
+
+func restoreDB(dbPath string, r io.Reader) error {
+	f, err := os.OpenFile(dbPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to restore database: %w", err)
+	}
+	return f.Close()
+}
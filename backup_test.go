@@ -0,0 +1,61 @@
+package feeds
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBackupSkipsTemporaryFiles(t *testing.T) {
+	dir := t.TempDir()
+	c := testDB(t, dir)
+	s, err := OpenStorage(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := saveContentBlob(s, []byte("<html><body><p>Text</p></body></html>"), "html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// NOTE(marius): the partial file of a blob being saved by a fetch running at the same time
+	temp := filepath.Join(dir, filepath.FromSlash(filepath.Dir(blob)), ".partial.html.123")
+	if err = os.WriteFile(temp, []byte("<html><bo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.Buffer{}
+	m, err := Backup(c, dir, s, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(m.Files))
+	for _, f := range m.Files {
+		names = append(names, f.Name)
+	}
+	if len(names) != 1 || names[0] != blob {
+		t.Errorf("Backup() archived %v, want [%s]", names, blob)
+	}
+
+	restored := filepath.Join(t.TempDir(), "restored")
+	rs, err := OpenStorage(restored, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Restore(&buf, restored, rs); err != nil {
+		t.Fatal(err)
+	}
+	if !blobExists(rs, blob) {
+		t.Errorf("Restore() didn't restore %s", blob)
+	}
+	err = filepath.Walk(restored, func(p string, info os.FileInfo, err error) error {
+		if err == nil && strings.HasPrefix(info.Name(), ".partial") {
+			t.Errorf("Restore() restored the temporary file %s", p)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
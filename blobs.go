@@ -0,0 +1,113 @@
+package feeds
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	BlobsDir = "blobs"
+
+	CompressionZstd = "zstd"
+	CompressionGzip = "gzip"
+	CompressionNone = "none"
+)
+
+// BlobCompression is the compression used for newly saved raw and readable HTML contents.
+var BlobCompression = CompressionZstd
+
+var compressionExt = map[string]string{
+	CompressionZstd: ".zst",
+	CompressionGzip: ".gz",
+}
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// contentAddressed returns if the contents of type typ are saved under the hash of their data,
+// which allows items with identical pages to share the same file.
+func contentAddressed(typ string) bool {
+	return typ == OutputTypeRAW || typ == OutputTypeHTML
+}
+
+// contentBlobName returns the content addressed storage name for data, which gets saved
+// in files of extension ext, compressed with compression.
+func contentBlobName(data []byte, ext, compression string) string {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	return path.Join(BlobsDir, hash[:2], fmt.Sprintf("%s.%s%s", hash, ext, compressionExt[compression]))
+}
+
+// saveContentBlob compresses and saves data under its content addressed name, unless a file with
+// the same content already exists in the storage.
+func saveContentBlob(s Storage, data []byte, ext string) (string, error) {
+	return saveCompressedBlob(s, data, ext, BlobCompression)
+}
+
+// saveCompressedBlob saves data under its content addressed name like saveContentBlob, compressed with compression.
+func saveCompressedBlob(s Storage, data []byte, ext, compression string) (string, error) {
+	name := contentBlobName(data, ext, compression)
+	if blobExists(s, name) {
+		return name, nil
+	}
+	compressed, err := compress(data, compression)
+	if err != nil {
+		return "", err
+	}
+	if err = s.Save(name, bytes.NewReader(compressed)); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func compress(data []byte, typ string) ([]byte, error) {
+	switch typ {
+	case CompressionZstd:
+		return zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)/3)), nil
+	case CompressionGzip:
+		buf := bytes.Buffer{}
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return data, nil
+}
+
+func decompress(data []byte, name string) ([]byte, error) {
+	switch {
+	case strings.HasSuffix(name, compressionExt[CompressionZstd]):
+		return zstdDecoder.DecodeAll(data, nil)
+	case strings.HasSuffix(name, compressionExt[CompressionGzip]):
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+	return data, nil
+}
+
+// LoadContent returns the uncompressed data of the content c.
+func LoadContent(s Storage, c Content) ([]byte, error) {
+	data, err := loadBlob(s, c.Path)
+	if err != nil {
+		return nil, err
+	}
+	return decompress(data, c.Path)
+}
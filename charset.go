@@ -0,0 +1,104 @@
+package feeds
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// sniffedCharsets are the multibyte charsets tried for the pages which declare no charset and aren't UTF-8,
+// mostly the ones of the translated novels.
+var sniffedCharsets = []string{"shift_jis", "euc-jp", "gbk", "big5", "euc-kr"}
+
+// frequentRunes are the most frequent characters of the Chinese, in both scripts, and of the Korean texts,
+// which tell the right decoding apart from the ones producing random CJK characters.
+var frequentRunes = func() map[rune]bool {
+	m := make(map[rune]bool)
+	for _, r := range "的一是不了在人有我他这個个们們中来來上大为為和国國地到以说說时時要就出会會可也你对對生能而子那得于於着著下自之年过過发發后後作里裡用道行所然家种種事成方多经經么麼去法学學如都同现現当當没沒动動面起看定天分还還进進好小部其些主样樣理心她本前开開把但因只从從想实實日军軍者意无無力它与與长長" +
+		"이다의는에가을를하고지서한기사로리들그수것나도있어아대시자라보게해면정만전요내" {
+		m[r] = true
+	}
+	return m
+}()
+
+// metaCharsetRe matches the charset declarations of the meta elements, which no longer apply after transcoding.
+var metaCharsetRe = regexp.MustCompile(`(?i)(<meta\s[^>]*charset\s*=\s*["']?)([\w:.-]+)`)
+
+// ToUTF8 returns the HTML content transcoded to UTF-8, together with the name of the charset it was detected in,
+// from the BOM, from the Content-Type header, from the meta elements or by sniffing the bytes, in this order.
+func ToUTF8(content []byte, contentType string) ([]byte, string, error) {
+	enc, name, certain := charset.DetermineEncoding(content, contentType)
+	if !certain && name == "windows-1252" && !hasMetaCharset(content) {
+		// NOTE(marius): windows-1252 is only the default of the HTML standard for the pages without a charset
+		enc, name = sniffCharset(content)
+	}
+	if name == "utf-8" {
+		if !utf8.Valid(content) {
+			content = []byte(strings.ToValidUTF8(string(content), "\uFFFD"))
+		}
+		return content, name, nil
+	}
+	data, err := enc.NewDecoder().Bytes(content)
+	if err != nil {
+		return content, name, err
+	}
+	data = metaCharsetRe.ReplaceAll(data, []byte("${1}utf-8"))
+	return data, name, nil
+}
+
+func hasMetaCharset(content []byte) bool {
+	if len(content) > 1024 {
+		content = content[:1024]
+	}
+	return metaCharsetRe.Match(content)
+}
+
+// sniffCharset returns the multibyte charset content decodes in without errors and with the most frequent
+// CJK characters, falling back to windows-1252.
+func sniffCharset(content []byte) (encoding.Encoding, string) {
+	if utf8.Valid(content) {
+		return encoding.Nop, "utf-8"
+	}
+	best, bestName, bestScore := encoding.Encoding(nil), "", 0
+	for _, name := range sniffedCharsets {
+		enc, err := htmlindex.Get(name)
+		if err != nil {
+			continue
+		}
+		data, err := enc.NewDecoder().Bytes(content)
+		if err != nil {
+			continue
+		}
+		frequent, other := 0, 0
+		for _, r := range string(data) {
+			if r == utf8.RuneError {
+				frequent = 0
+				break
+			}
+			switch {
+			case r >= 'ぁ' && r <= 'ヿ', frequentRunes[r]:
+				// NOTE(marius): the kana, without the half width ones the Chinese texts decode to as Shift_JIS
+				frequent++
+			case unicode.In(r, unicode.Han, unicode.Hangul):
+				other++
+			}
+		}
+		// NOTE(marius): the western texts decode to random, rarely used, characters
+		if frequent == 0 || frequent*4 < frequent+other {
+			continue
+		}
+		if score := 2*frequent + other; score > bestScore {
+			best, bestName, bestScore = enc, name, score
+		}
+	}
+	if best == nil {
+		enc, _ := htmlindex.Get("windows-1252")
+		return enc, "windows-1252"
+	}
+	return best, bestName
+}
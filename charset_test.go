@@ -0,0 +1,55 @@
+package feeds
+
+import (
+	"testing"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+func TestToUTF8(t *testing.T) {
+	encode := func(name, text string) string {
+		enc, err := htmlindex.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := enc.NewEncoder().String(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	tests := []struct {
+		name        string
+		content     string
+		contentType string
+		want        string
+		charset     string
+	}{
+		{"ascii", "<p>plain ascii</p>", "", "<p>plain ascii</p>", "utf-8"},
+		{"invalid utf-8", "<p>caf\xe9 \xe2\x80\x9c</p>", "text/html; charset=utf-8", "<p>caf� “</p>", "utf-8"},
+		{"header", encode("windows-1252", "<p>It’s “café”</p>"), "text/html; charset=ISO-8859-1", "<p>It’s “café”</p>", "windows-1252"},
+		{
+			"meta", encode("windows-1252", `<meta charset="windows-1252"><p>It’s “café”</p>`), "",
+			`<meta charset="utf-8"><p>It’s “café”</p>`, "windows-1252",
+		},
+		{"western without charset", encode("windows-1252", "<p>It’s “café”</p>"), "", "<p>It’s “café”</p>", "windows-1252"},
+		{"shift_jis", encode("shift_jis", "<p>第一章　異世界に転生した俺は、チートスキルで無双する</p>"), "", "<p>第一章　異世界に転生した俺は、チートスキルで無双する</p>", "shift_jis"},
+		{"gbk", encode("gbk", "<p>我们在中国的时候，他说这个地方很好，大家都想去看看。</p>"), "", "<p>我们在中国的时候，他说这个地方很好，大家都想去看看。</p>", "gbk"},
+		{"big5", encode("big5", "<p>我們在中國的時候，他說這個地方很好，大家都想去看看。</p>"), "", "<p>我們在中國的時候，他說這個地方很好，大家都想去看看。</p>", "big5"},
+		{"euc-kr", encode("euc-kr", "<p>우리는 한국에서 살고 있습니다. 그들은 이것이 좋다고 말했다.</p>"), "", "<p>우리는 한국에서 살고 있습니다. 그들은 이것이 좋다고 말했다.</p>", "euc-kr"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, cs, err := ToUTF8([]byte(tt.content), tt.contentType)
+			if err != nil {
+				t.Fatalf("ToUTF8() error = %v", err)
+			}
+			if cs != tt.charset {
+				t.Errorf("ToUTF8() charset = %s, want %s", cs, tt.charset)
+			}
+			if string(got) != tt.want {
+				t.Errorf("ToUTF8() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package feeds
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+	"golang.org/x/net/html"
+)
+
+// The types of the cleanup rules.
+const (
+	// CleanupRemove removes the elements matched by the CSS selector in the value of the rule.
+	CleanupRemove = "remove"
+	// CleanupLeading removes the leading paragraphs whose text matches the regular expression in the value of the rule.
+	CleanupLeading = "leading"
+	// CleanupTrailing removes the trailing paragraphs whose text matches the regular expression in the value of the rule.
+	CleanupTrailing = "trailing"
+	// CleanupCutBefore removes the first paragraph whose text matches the regular expression in the value
+	// of the rule, together with everything before it.
+	CleanupCutBefore = "cut_before"
+	// CleanupCutAfter removes the last paragraph whose text matches the regular expression in the value
+	// of the rule, together with everything after it.
+	CleanupCutAfter = "cut_after"
+)
+
+// CleanupTypes are the valid types of cleanup rules, in the order they are applied.
+var CleanupTypes = []string{CleanupRemove, CleanupCutBefore, CleanupCutAfter, CleanupLeading, CleanupTrailing}
+
+// cleanupParagraphs selects the elements considered paragraphs by the leading, trailing and cut rules.
+const cleanupParagraphs = "p, h1, h2, h3, h4, h5, h6, hr, blockquote, pre, ul, ol, table, div:not(:has(p, div))"
+
+// CleanupRule removes the boilerplate readability leaves in the readable HTML of the items, like the chapter
+// navigation links, the sharing buttons or the author notes. A rule with a zero FeedID applies to all feeds.
+type CleanupRule struct {
+	ID     int
+	FeedID int
+	Type   string
+	Value  string
+}
+
+type CleanupRules []CleanupRule
+
+// Validate returns an error for the first rule with an invalid type, selector or regular expression.
+func (rules CleanupRules) Validate() error {
+	for _, r := range rules {
+		switch r.Type {
+		case CleanupRemove:
+			if err := validSelector(r.Value); err != nil {
+				return fmt.Errorf("invalid %s selector %q: %w", r.Type, r.Value, err)
+			}
+		case CleanupLeading, CleanupTrailing, CleanupCutBefore, CleanupCutAfter:
+			if _, err := regexp.Compile(r.Value); err != nil {
+				return fmt.Errorf("invalid %s expression %q: %w", r.Type, r.Value, err)
+			}
+		default:
+			return fmt.Errorf("invalid cleanup rule type %s, valid ones are %v", r.Type, CleanupTypes)
+		}
+	}
+	return nil
+}
+
+// validSelector returns the error of compiling the CSS selector, which goquery ignores by matching nothing.
+func validSelector(sel string) error {
+	_, err := cascadia.Compile(sel)
+	return err
+}
+
+func (rules CleanupRules) values(typ string) []string {
+	values := make([]string, 0)
+	for _, r := range rules {
+		if r.Type == typ {
+			values = append(values, r.Value)
+		}
+	}
+	return values
+}
+
+func (rules CleanupRules) expressions(typ string) []*regexp.Regexp {
+	exprs := make([]*regexp.Regexp, 0)
+	for _, v := range rules.values(typ) {
+		if re, err := regexp.Compile(v); err == nil {
+			exprs = append(exprs, re)
+		}
+	}
+	return exprs
+}
+
+// Apply returns the readable HTML content without the parts matched by the rules.
+func (rules CleanupRules) Apply(content []byte) ([]byte, error) {
+	if len(rules) == 0 {
+		return content, nil
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	body := doc.Find("body")
+
+	for _, sel := range rules.values(CleanupRemove) {
+		if validSelector(sel) == nil {
+			body.Find(sel).Remove()
+		}
+	}
+	for _, re := range rules.expressions(CleanupCutBefore) {
+		paragraphs := cleanupParagraphList(body)
+		for _, p := range paragraphs {
+			if re.MatchString(paragraphText(p)) {
+				cutSiblings(p, body.Get(0), true)
+				break
+			}
+		}
+	}
+	for _, re := range rules.expressions(CleanupCutAfter) {
+		paragraphs := cleanupParagraphList(body)
+		for i := len(paragraphs) - 1; i >= 0; i-- {
+			if re.MatchString(paragraphText(paragraphs[i])) {
+				cutSiblings(paragraphs[i], body.Get(0), false)
+				break
+			}
+		}
+	}
+	if leading := rules.expressions(CleanupLeading); len(leading) > 0 {
+		for _, p := range cleanupParagraphList(body) {
+			if !matchesAny(leading, paragraphText(p)) {
+				break
+			}
+			p.Parent.RemoveChild(p)
+		}
+	}
+	if trailing := rules.expressions(CleanupTrailing); len(trailing) > 0 {
+		paragraphs := cleanupParagraphList(body)
+		for i := len(paragraphs) - 1; i >= 0; i-- {
+			if !matchesAny(trailing, paragraphText(paragraphs[i])) {
+				break
+			}
+			paragraphs[i].Parent.RemoveChild(paragraphs[i])
+		}
+	}
+
+	out, err := body.Html()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(out), nil
+}
+
+// cleanupParagraphList returns the outermost paragraphs of the body, in document order.
+func cleanupParagraphList(body *goquery.Selection) []*html.Node {
+	all := body.Find(cleanupParagraphs)
+	paragraphs := make([]*html.Node, 0, all.Length())
+	all.Each(func(_ int, sel *goquery.Selection) {
+		if sel.ParentsFiltered(cleanupParagraphs).Length() == 0 {
+			paragraphs = append(paragraphs, sel.Get(0))
+		}
+	})
+	return paragraphs
+}
+
+func paragraphText(n *html.Node) string {
+	return strings.TrimSpace(whitespaceRe.ReplaceAllString(textContent(n), " "))
+}
+
+func matchesAny(exprs []*regexp.Regexp, s string) bool {
+	for _, re := range exprs {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// cutSiblings removes n together with all the nodes before it, or after it, up to root.
+func cutSiblings(n, root *html.Node, before bool) {
+	for cur := n; cur != nil && cur != root; cur = cur.Parent {
+		for {
+			sibling := cur.NextSibling
+			if before {
+				sibling = cur.PrevSibling
+			}
+			if sibling == nil {
+				break
+			}
+			cur.Parent.RemoveChild(sibling)
+		}
+	}
+	if n.Parent != nil {
+		n.Parent.RemoveChild(n)
+	}
+}
+
+// LoadCleanupRules loads the cleanup rules of the feed together with the ones applying to all feeds.
+func LoadCleanupRules(c *sql.DB, feedID int) (CleanupRules, error) {
+	sel := `SELECT id, feed_id, type, value FROM cleanup_rules WHERE feed_id = ? OR feed_id IS NULL ORDER BY id;`
+	s, err := c.Query(sel, feedID)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	rules := make(CleanupRules, 0)
+	for s.Next() {
+		r := CleanupRule{}
+		var fID sql.NullInt32
+		if err = s.Scan(&r.ID, &fID, &r.Type, &r.Value); err != nil {
+			return nil, err
+		}
+		r.FeedID = int(fID.Int32)
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// SaveCleanupRules replaces the cleanup rules of the feed with rules.
+func SaveCleanupRules(c *sql.DB, feedID int, rules CleanupRules) error {
+	if err := rules.Validate(); err != nil {
+		return err
+	}
+	tx, err := c.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`DELETE FROM cleanup_rules WHERE feed_id = ?;`, feedID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, r := range rules {
+		if r.FeedID != feedID {
+			continue
+		}
+		if _, err = tx.Exec(`INSERT INTO cleanup_rules (feed_id, type, value) VALUES (?, ?, ?);`, feedID, r.Type, r.Value); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// PreviewCleanup returns the readable HTML of the item, extracted with the selectors, before and after applying the rules.
+func PreviewCleanup(s Storage, it Item, sel ExtractSelectors, rules CleanupRules) ([]byte, []byte, error) {
+	raw, err := getItemContentForType(s, it, OutputTypeRAW)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, before, err := ReadableContent(raw, sel)
+	if err != nil {
+		return nil, nil, err
+	}
+	after, err := rules.Apply(before)
+	if err != nil {
+		return nil, nil, err
+	}
+	return before, after, nil
+}
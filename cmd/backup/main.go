@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/dustin/go-humanize"
+	"github.com/mariusor/feeds"
+)
+
+var CLI struct {
+	Path    string `default:".cache" help:"Base storage path containing the SQLite database"`
+	Storage string `env:"FEEDS_STORAGE" help:"Storage for the downloaded and generated files, a s3:// URL selects an S3 compatible bucket instead of the base storage path"`
+	Output  string `short:"o" help:"Path of the archive to create, defaults to feeds-<date>.tar.gz in the current directory"`
+	Verbose bool   `short:"v" help:"Output debugging messages"`
+}
+
+func main() {
+	kong.Parse(&CLI,
+		kong.Name("backup"),
+		kong.Description("Command to save the database and the contents files to a single archive"),
+		kong.UsageOnError(),
+		kong.ConfigureHelp(kong.HelpOptions{
+			Compact: true,
+			Summary: true,
+		}))
+
+	basePath := path.Clean(CLI.Path)
+	if _, err := os.Stat(path.Join(basePath, feeds.DBFilePath)); err != nil {
+		log.Fatalf("Unable to find SQLite database: %s", err)
+	}
+
+	c, err := feeds.DB(basePath, "")
+	if err != nil {
+		log.Fatalf("Failed to open database: %s", err)
+	}
+	defer c.Close()
+
+	s, err := feeds.OpenStorage(basePath, CLI.Storage)
+	if err != nil {
+		log.Fatalf("Failed to open storage: %s", err)
+	}
+
+	out := CLI.Output
+	if out == "" {
+		out = fmt.Sprintf("feeds-%s.tar.gz", time.Now().UTC().Format("20060102-150405"))
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		log.Fatalf("Failed to create archive: %s", err)
+	}
+
+	m, err := feeds.Backup(c, basePath, s, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out)
+		log.Fatalf("Failed to create backup: %s", err)
+	}
+	size := int64(0)
+	for _, bf := range m.Files {
+		size += bf.Size
+	}
+	log.Printf("Saved database and %d files (%s) to %s", len(m.Files), humanize.Bytes(uint64(size)), out)
+}
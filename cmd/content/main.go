@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"path"
+	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/mariusor/feeds"
@@ -12,8 +13,14 @@ import (
 )
 
 var CLI struct {
-	Path    string `default:".cache" help:"Base storage path"`
-	Verbose bool   `short:"v" help:"Output debugging messages"`
+	Path        string        `default:".cache" help:"Base storage path"`
+	DB          string        `name:"db" env:"FEEDS_DB" help:"Database connection string, a postgres:// URL selects PostgreSQL instead of the SQLite file in the base storage path"`
+	Storage     string        `env:"FEEDS_STORAGE" help:"Storage for the downloaded and generated files, a s3:// URL selects an S3 compatible bucket instead of the base storage path"`
+	Compression string        `default:"zstd" enum:"zstd,gzip,none" help:"Compression used for saving the raw and readable HTML files"`
+	Workers     int           `default:"8" help:"Number of the articles fetched at the same time"`
+	PerHost     int           `default:"2" help:"Number of the articles fetched at the same time from one site"`
+	Timeout     time.Duration `default:"1m" help:"Longest time fetching an article can take"`
+	Verbose     bool          `short:"v" help:"Output debugging messages"`
 }
 
 func main() {
@@ -30,18 +37,37 @@ func main() {
 		readability.Logger = log.New(os.Stdout, "[readability] ", log.LstdFlags)
 	}
 
+	feeds.BlobCompression = CLI.Compression
+	feeds.FetchWorkers = CLI.Workers
+	feeds.FetchPerHost = CLI.PerHost
+	feeds.FetchTimeout = CLI.Timeout
+
 	basePath := path.Clean(CLI.Path)
 	if _, err := os.Stat(basePath); os.IsNotExist(err) {
 		os.Mkdir(basePath, 0755)
 	}
 
-	c, err := feeds.DB(basePath)
+	c, err := feeds.DB(basePath, CLI.DB)
 	if err != nil {
 		log.Fatalf("Failed to open database: %s", err)
 	}
 	defer c.Close()
 
-	if _, err := feeds.FetchItemsCmd(context.Background(), c, basePath); err != nil {
+	s, err := feeds.OpenStorage(basePath, CLI.Storage)
+	if err != nil {
+		log.Fatalf("Failed to open storage: %s", err)
+	}
+
+	ctx, stop := feeds.NotifyContext(context.Background())
+	defer stop()
+
+	if n, err := feeds.UpdateContentSizes(c, s); err != nil {
+		log.Printf("Failed to update content sizes: %s", err)
+	} else if n > 0 {
+		log.Printf("Updated the size of %d contents", n)
+	}
+
+	if _, err := feeds.FetchItemsCmd(ctx, c, s); err != nil {
 		log.Fatalf("Failed to fetch items: %s", err)
 	}
 }
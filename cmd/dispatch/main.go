@@ -5,14 +5,18 @@ import (
 	"log"
 	"os"
 	"path"
+	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/mariusor/feeds"
 )
 
 var CLI struct {
-	Path    string `default:".cache" help:"Base storage path"`
-	Verbose bool   `short:"v" help:"Output debugging messages"`
+	Path    string        `default:".cache" help:"Base storage path"`
+	DB      string        `name:"db" env:"FEEDS_DB" help:"Database connection string, a postgres:// URL selects PostgreSQL instead of the SQLite file in the base storage path"`
+	Storage string        `env:"FEEDS_STORAGE" help:"Storage for the downloaded and generated files, a s3:// URL selects an S3 compatible bucket instead of the base storage path"`
+	Timeout time.Duration `default:"2m" help:"Longest time sending an ebook to a destination can take"`
+	Verbose bool          `short:"v" help:"Output debugging messages"`
 }
 
 func main() {
@@ -25,18 +29,28 @@ func main() {
 			Summary: true,
 		}))
 
+	feeds.DispatchTimeout = CLI.Timeout
+
 	basePath := path.Clean(CLI.Path)
 	if _, err := os.Stat(basePath); os.IsNotExist(err) {
 		os.Mkdir(basePath, 0755)
 	}
 
-	c, err := feeds.DB(basePath)
+	c, err := feeds.DB(basePath, CLI.DB)
 	if err != nil {
 		log.Fatalf("Failed to open database: %s", err)
 	}
 	defer c.Close()
 
-	if err := feeds.DispatchContentCmd(context.Background(), c); err != nil {
+	s, err := feeds.OpenStorage(basePath, CLI.Storage)
+	if err != nil {
+		log.Fatalf("Failed to open storage: %s", err)
+	}
+
+	ctx, stop := feeds.NotifyContext(context.Background())
+	defer stop()
+
+	if err := feeds.DispatchContentCmd(ctx, c, s); err != nil {
 		log.Fatalf("Failed to fetch items: %s", err)
 		os.Exit(1)
 	}
@@ -5,14 +5,31 @@ import (
 	"log"
 	"os"
 	"path"
+	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/mariusor/feeds"
 )
 
 var CLI struct {
-	Path    string `default:".cache" help:"Base storage path"`
-	Verbose bool   `short:"v" help:"Output debugging messages"`
+	Path        string        `default:".cache" help:"Base storage path"`
+	DB          string        `name:"db" env:"FEEDS_DB" help:"Database connection string, a postgres:// URL selects PostgreSQL instead of the SQLite file in the base storage path"`
+	Storage     string        `env:"FEEDS_STORAGE" help:"Storage for the downloaded and generated files, a s3:// URL selects an S3 compatible bucket instead of the base storage path"`
+	Compression string        `default:"zstd" enum:"zstd,gzip,none" help:"Compression used for saving the raw and readable HTML files"`
+	Images      bool          `default:"true" negatable:"" help:"Download the images of the articles and embed them in the ebooks"`
+	ImageWidth  int           `help:"Scale down the images embedded in the ebooks to this width"`
+	Grayscale   bool          `help:"Convert the images embedded in the ebooks to grayscale"`
+	Covers      bool          `default:"true" negatable:"" help:"Attach generated cover images to the ebooks"`
+	Typography  bool          `help:"Normalise the quotes, dashes, scene breaks and paragraphs of the articles for the e-readers"`
+	Hyphenate   bool          `help:"Add soft hyphens to the long words of the EPUB, AZW3 and MOBI files, requires --typography"`
+	Stylesheet  string        `type:"existingfile" help:"CSS file added to the EPUB and AZW3 files of the feeds without their own stylesheet"`
+	PageSize    string        `name:"pdf-page-size" default:"remarkable2" enum:"remarkable2,a5,letter" help:"Page size of the PDF files"`
+	Margin      float64       `name:"pdf-margin" default:"10" help:"Margin of the pages of the PDF files in millimeters"`
+	FontSize    float64       `name:"pdf-font-size" default:"12" help:"Size of the text of the PDF files in points"`
+	Font        string        `name:"pdf-font" type:"existingfile" help:"TrueType font file to embed in the PDF files instead of the default one"`
+	Workers     int           `help:"Number of the articles converted at the same time, defaults to the number of CPUs"`
+	Timeout     time.Duration `default:"5m" help:"Longest time converting an article to all the ebook types can take"`
+	Verbose     bool          `short:"v" help:"Output debugging messages"`
 }
 
 func main() {
@@ -25,18 +42,53 @@ func main() {
 			Summary: true,
 		}))
 
+	feeds.BlobCompression = CLI.Compression
+	feeds.DownloadImages = CLI.Images
+	if CLI.Workers > 0 {
+		feeds.ConvertWorkers = CLI.Workers
+	}
+	feeds.ConvertTimeout = CLI.Timeout
+	feeds.DefaultConvertOptions = feeds.ConvertOptions{
+		Compression: CLI.Compression,
+		Images:      CLI.Images,
+		ImageWidth:  CLI.ImageWidth,
+		Grayscale:   CLI.Grayscale,
+		Cover:       CLI.Covers,
+		Font:        CLI.Font,
+		FontSize:    CLI.FontSize,
+		PageSize:    CLI.PageSize,
+		Margin:      CLI.Margin,
+		Typography:  CLI.Typography,
+		Hyphenate:   CLI.Hyphenate,
+	}
+	if CLI.Stylesheet != "" {
+		css, err := os.ReadFile(CLI.Stylesheet)
+		if err != nil {
+			log.Fatalf("Failed to read stylesheet: %s", err)
+		}
+		feeds.DefaultConvertOptions.Stylesheet = string(css)
+	}
+
 	basePath := path.Clean(CLI.Path)
 	if _, err := os.Stat(basePath); os.IsNotExist(err) {
 		os.Mkdir(basePath, 0755)
 	}
 
-	c, err := feeds.DB(basePath)
+	c, err := feeds.DB(basePath, CLI.DB)
 	if err != nil {
 		log.Fatalf("Failed to open database: %s", err)
 	}
 	defer c.Close()
 
-	if err := feeds.GenerateContentCmd(context.Background(), c, basePath); err != nil {
+	s, err := feeds.OpenStorage(basePath, CLI.Storage)
+	if err != nil {
+		log.Fatalf("Failed to open storage: %s", err)
+	}
+
+	ctx, stop := feeds.NotifyContext(context.Background())
+	defer stop()
+
+	if err := feeds.GenerateContentCmd(ctx, c, s); err != nil {
 		log.Fatalf("Failed to generate content: %s", err)
 		os.Exit(1)
 	}
@@ -5,14 +5,17 @@ import (
 	"log"
 	"os"
 	"path"
+	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/mariusor/feeds"
 )
 
 var CLI struct {
-	Path    string `default:".cache" help:"Base storage path"`
-	Verbose bool   `short:"v" help:"Output debugging messages"`
+	Path    string        `default:".cache" help:"Base storage path"`
+	DB      string        `name:"db" env:"FEEDS_DB" help:"Database connection string, a postgres:// URL selects PostgreSQL instead of the SQLite file in the base storage path"`
+	Timeout time.Duration `default:"1m" help:"Longest time fetching a feed can take"`
+	Verbose bool          `short:"v" help:"Output debugging messages"`
 }
 
 func main() {
@@ -25,18 +28,23 @@ func main() {
 			Summary: true,
 		}))
 
+	feeds.FetchTimeout = CLI.Timeout
+
 	basePath := path.Clean(CLI.Path)
 	if _, err := os.Stat(basePath); os.IsNotExist(err) {
 		os.Mkdir(basePath, 0755)
 	}
 
-	c, err := feeds.DB(basePath)
+	c, err := feeds.DB(basePath, CLI.DB)
 	if err != nil {
 		log.Fatalf("Failed to open database: %s", err)
 	}
 	defer c.Close()
 
-	if _, err := feeds.FetchFeedsCmd(context.Background(), c); err != nil {
+	ctx, stop := feeds.NotifyContext(context.Background())
+	defer stop()
+
+	if _, err := feeds.FetchFeedsCmd(ctx, c); err != nil {
 		log.Fatalf("Failed to load feeds: %s", err)
 		os.Exit(1)
 	}
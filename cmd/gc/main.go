@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path"
+
+	"github.com/alecthomas/kong"
+	"github.com/mariusor/feeds"
+)
+
+var CLI struct {
+	Path    string `default:".cache" help:"Base storage path"`
+	DB      string `name:"db" env:"FEEDS_DB" help:"Database connection string, a postgres:// URL selects PostgreSQL instead of the SQLite file in the base storage path"`
+	Storage string `env:"FEEDS_STORAGE" help:"Storage for the downloaded and generated files, a s3:// URL selects an S3 compatible bucket instead of the base storage path"`
+	DryRun  bool   `help:"Only report what would be removed"`
+	Verbose bool   `short:"v" help:"Output debugging messages"`
+}
+
+func main() {
+	kong.Parse(&CLI,
+		kong.Name("gc"),
+		kong.Description("Command to remove expired and orphaned contents"),
+		kong.UsageOnError(),
+		kong.ConfigureHelp(kong.HelpOptions{
+			Compact: true,
+			Summary: true,
+		}))
+
+	basePath := path.Clean(CLI.Path)
+	if _, err := os.Stat(basePath); os.IsNotExist(err) {
+		os.Mkdir(basePath, 0755)
+	}
+
+	c, err := feeds.DB(basePath, CLI.DB)
+	if err != nil {
+		log.Fatalf("Failed to open database: %s", err)
+	}
+	defer c.Close()
+
+	s, err := feeds.OpenStorage(basePath, CLI.Storage)
+	if err != nil {
+		log.Fatalf("Failed to open storage: %s", err)
+	}
+
+	ctx, stop := feeds.NotifyContext(context.Background())
+	defer stop()
+
+	if err := feeds.GCCmd(ctx, c, s, CLI.DryRun); err != nil {
+		log.Fatalf("Failed to collect garbage: %s", err)
+	}
+}
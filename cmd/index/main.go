@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/kong"
+	"github.com/mariusor/feeds"
+)
+
+var CLI struct {
+	Path    string `default:".cache" help:"Base storage path"`
+	DB      string `name:"db" env:"FEEDS_DB" help:"Database connection string, a postgres:// URL selects PostgreSQL instead of the SQLite file in the base storage path"`
+	Storage string `env:"FEEDS_STORAGE" help:"Storage for the downloaded and generated files, a s3:// URL selects an S3 compatible bucket instead of the base storage path"`
+	Rebuild bool   `help:"Index all the items again, not only the ones missing from the index"`
+	Verbose bool   `short:"v" help:"Output debugging messages"`
+	Feed    string `arg:"" optional:"" help:"Title or id of the feed, by default the items of all feeds are indexed"`
+}
+
+func main() {
+	kong.Parse(&CLI,
+		kong.Name("index"),
+		kong.Description("Command to add the text of the fetched items to the search index and compute their reading statistics"),
+		kong.UsageOnError(),
+		kong.ConfigureHelp(kong.HelpOptions{
+			Compact: true,
+			Summary: true,
+		}))
+
+	basePath := path.Clean(CLI.Path)
+	if _, err := os.Stat(basePath); os.IsNotExist(err) {
+		os.Mkdir(basePath, 0755)
+	}
+
+	c, err := feeds.DB(basePath, CLI.DB)
+	if err != nil {
+		log.Fatalf("Failed to open database: %s", err)
+	}
+	defer c.Close()
+
+	s, err := feeds.OpenStorage(basePath, CLI.Storage)
+	if err != nil {
+		log.Fatalf("Failed to open storage: %s", err)
+	}
+
+	feedID := 0
+	if CLI.Feed != "" {
+		all, err := feeds.GetFeeds(c)
+		if err != nil {
+			log.Fatalf("Failed to load feeds: %s", err)
+		}
+		id, _ := strconv.Atoi(CLI.Feed)
+		for _, f := range all {
+			if f.ID == id || strings.EqualFold(f.Title, CLI.Feed) {
+				feedID = f.ID
+			}
+		}
+		if feedID == 0 {
+			log.Fatalf("Unable to find feed %q", CLI.Feed)
+		}
+	}
+
+	ctx, stop := feeds.NotifyContext(context.Background())
+	defer stop()
+
+	if err = feeds.IndexCmd(ctx, c, s, feedID, CLI.Rebuild); err != nil {
+		log.Fatalf("Failed to index items: %s", err)
+	}
+}
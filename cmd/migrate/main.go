@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path"
+
+	"github.com/alecthomas/kong"
+	"github.com/mariusor/feeds"
+)
+
+var CLI struct {
+	Path    string `default:".cache" help:"Base storage path containing the SQLite database to migrate"`
+	To      string `required:"" help:"PostgreSQL connection string of the database to migrate to"`
+	Verbose bool   `short:"v" help:"Output debugging messages"`
+}
+
+func main() {
+	kong.Parse(&CLI,
+		kong.Name("migrate"),
+		kong.Description("Command to migrate the SQLite database to PostgreSQL"),
+		kong.UsageOnError(),
+		kong.ConfigureHelp(kong.HelpOptions{
+			Compact: true,
+			Summary: true,
+		}))
+
+	basePath := path.Clean(CLI.Path)
+	if _, err := os.Stat(path.Join(basePath, feeds.DBFilePath)); err != nil {
+		log.Fatalf("Unable to find SQLite database: %s", err)
+	}
+
+	src, err := feeds.DB(basePath, "")
+	if err != nil {
+		log.Fatalf("Failed to open database: %s", err)
+	}
+	defer src.Close()
+
+	dst, err := feeds.DB(basePath, CLI.To)
+	if err != nil {
+		log.Fatalf("Failed to open PostgreSQL database: %s", err)
+	}
+	defer dst.Close()
+
+	ctx, stop := feeds.NotifyContext(context.Background())
+	defer stop()
+
+	counts, err := feeds.MigrateDB(ctx, src, dst)
+	for table, cnt := range counts {
+		log.Printf("Migrated %d rows from %s", cnt, table)
+	}
+	if err != nil {
+		log.Fatalf("Failed to migrate database: %s", err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/kong"
+	"github.com/mariusor/feeds"
+)
+
+var CLI struct {
+	Path     string `default:".cache" help:"Base storage path"`
+	DB       string `name:"db" env:"FEEDS_DB" help:"Database connection string, a postgres:// URL selects PostgreSQL instead of the SQLite file in the base storage path"`
+	Storage  string `env:"FEEDS_STORAGE" help:"Storage for the downloaded and generated files, a s3:// URL selects an S3 compatible bucket instead of the base storage path"`
+	Force    bool   `help:"Regenerate all the contents, not only the stale ones"`
+	Dispatch bool   `help:"Send the regenerated contents again to the destinations they were sent to"`
+	Verbose  bool   `short:"v" help:"Output debugging messages"`
+	Feed     string `arg:"" optional:"" help:"Title or id of the feed, by default all feeds are reprocessed"`
+}
+
+func main() {
+	kong.Parse(&CLI,
+		kong.Name("reprocess"),
+		kong.Description("Command to regenerate the contents made stale by converter or extraction rule changes"),
+		kong.UsageOnError(),
+		kong.ConfigureHelp(kong.HelpOptions{
+			Compact: true,
+			Summary: true,
+		}))
+
+	basePath := path.Clean(CLI.Path)
+	if _, err := os.Stat(basePath); os.IsNotExist(err) {
+		os.Mkdir(basePath, 0755)
+	}
+
+	c, err := feeds.DB(basePath, CLI.DB)
+	if err != nil {
+		log.Fatalf("Failed to open database: %s", err)
+	}
+	defer c.Close()
+
+	s, err := feeds.OpenStorage(basePath, CLI.Storage)
+	if err != nil {
+		log.Fatalf("Failed to open storage: %s", err)
+	}
+
+	feedID := 0
+	if CLI.Feed != "" {
+		all, err := feeds.GetFeeds(c)
+		if err != nil {
+			log.Fatalf("Failed to load feeds: %s", err)
+		}
+		id, _ := strconv.Atoi(CLI.Feed)
+		for _, f := range all {
+			if f.ID == id || strings.EqualFold(f.Title, CLI.Feed) {
+				feedID = f.ID
+			}
+		}
+		if feedID == 0 {
+			log.Fatalf("Unable to find feed %q", CLI.Feed)
+		}
+	}
+
+	ctx, stop := feeds.NotifyContext(context.Background())
+	defer stop()
+
+	if err = feeds.ReprocessCmd(ctx, c, s, feedID, CLI.Force, CLI.Dispatch); err != nil {
+		log.Fatalf("Failed to reprocess contents: %s", err)
+	}
+}
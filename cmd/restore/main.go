@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path"
+
+	"github.com/alecthomas/kong"
+	"github.com/mariusor/feeds"
+)
+
+var CLI struct {
+	Path    string `default:".cache" help:"Base storage path to restore the database to"`
+	Storage string `env:"FEEDS_STORAGE" help:"Storage for the downloaded and generated files, a s3:// URL selects an S3 compatible bucket instead of the base storage path"`
+	Verbose bool   `short:"v" help:"Output debugging messages"`
+	Archive string `arg:"" type:"existingfile" help:"Backup archive to restore"`
+}
+
+func main() {
+	kong.Parse(&CLI,
+		kong.Name("restore"),
+		kong.Description("Command to restore the database and the contents files from a backup archive"),
+		kong.UsageOnError(),
+		kong.ConfigureHelp(kong.HelpOptions{
+			Compact: true,
+			Summary: true,
+		}))
+
+	basePath := path.Clean(CLI.Path)
+	if _, err := os.Stat(basePath); os.IsNotExist(err) {
+		os.Mkdir(basePath, 0755)
+	}
+
+	s, err := feeds.OpenStorage(basePath, CLI.Storage)
+	if err != nil {
+		log.Fatalf("Failed to open storage: %s", err)
+	}
+
+	f, err := os.Open(CLI.Archive)
+	if err != nil {
+		log.Fatalf("Failed to open archive: %s", err)
+	}
+	defer f.Close()
+
+	m, err := feeds.Restore(f, basePath, s)
+	if err != nil {
+		log.Fatalf("Failed to restore backup: %s", err)
+	}
+
+	// NOTE(marius): opening the database brings its schema up to date
+	c, err := feeds.DB(basePath, "")
+	if err != nil {
+		log.Fatalf("Failed to open restored database: %s", err)
+	}
+	defer c.Close()
+
+	log.Printf("Restored database and %d files from %s, created %s at %s", len(m.Files), CLI.Archive, m.Created.Format("2006-01-02 15:04"), m.BasePath)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/kong"
+	"github.com/mariusor/feeds"
+)
+
+var CLI struct {
+	Path         string   `default:".cache" help:"Base storage path"`
+	DB           string   `name:"db" env:"FEEDS_DB" help:"Database connection string, a postgres:// URL selects PostgreSQL instead of the SQLite file in the base storage path"`
+	Storage      string   `env:"FEEDS_STORAGE" help:"Storage for the downloaded and generated files, a s3:// URL selects an S3 compatible bucket instead of the base storage path"`
+	From         int      `help:"Feed index of the first chapter"`
+	To           int      `help:"Feed index of the last chapter, by default up to the latest one"`
+	Undispatched bool     `help:"Only include the chapters which haven't been dispatched yet"`
+	Per          int      `help:"Split the chapters in volumes of this size"`
+	PerWords     int      `help:"Split the chapters in volumes of about this many words"`
+	ByArc        bool     `help:"Split the chapters in volumes for each arc, as derived from their titles"`
+	Type         []string `default:"epub" enum:"epub,mobi,azw3,pdf,md,txt,fb2" help:"Ebook types to generate"`
+	Overwrite    bool     `help:"Regenerate the volumes which already exist"`
+	Verbose      bool     `short:"v" help:"Output debugging messages"`
+	Feed         string   `arg:"" help:"Title or id of the feed"`
+}
+
+func main() {
+	kong.Parse(&CLI,
+		kong.Name("volume"),
+		kong.Description("Command to compile the chapters of a feed into volumes"),
+		kong.UsageOnError(),
+		kong.ConfigureHelp(kong.HelpOptions{
+			Compact: true,
+			Summary: true,
+		}))
+
+	basePath := path.Clean(CLI.Path)
+	if _, err := os.Stat(basePath); os.IsNotExist(err) {
+		os.Mkdir(basePath, 0755)
+	}
+
+	c, err := feeds.DB(basePath, CLI.DB)
+	if err != nil {
+		log.Fatalf("Failed to open database: %s", err)
+	}
+	defer c.Close()
+
+	s, err := feeds.OpenStorage(basePath, CLI.Storage)
+	if err != nil {
+		log.Fatalf("Failed to open storage: %s", err)
+	}
+
+	all, err := feeds.GetFeeds(c)
+	if err != nil {
+		log.Fatalf("Failed to load feeds: %s", err)
+	}
+	var feed *feeds.Feed
+	id, _ := strconv.Atoi(CLI.Feed)
+	for i, f := range all {
+		if f.ID == id || strings.EqualFold(f.Title, CLI.Feed) {
+			feed = &all[i]
+			break
+		}
+	}
+	if feed == nil {
+		log.Fatalf("Unable to find feed %q", CLI.Feed)
+	}
+
+	sel := feeds.VolumeSelection{
+		First:        CLI.From,
+		Last:         CLI.To,
+		Undispatched: CLI.Undispatched,
+		PerVolume:    CLI.Per,
+		PerWords:     CLI.PerWords,
+		ByArc:        CLI.ByArc,
+	}
+	ctx, stop := feeds.NotifyContext(context.Background())
+	defer stop()
+
+	if _, err := feeds.VolumeCmd(ctx, c, s, *feed, sel, CLI.Overwrite, CLI.Type...); err != nil {
+		log.Fatalf("Failed to generate volumes: %s", err)
+	}
+}
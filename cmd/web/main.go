@@ -2,11 +2,13 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"embed"
 	"encoding/binary"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -14,15 +16,18 @@ import (
 	"math"
 	"math/rand"
 	"net/http"
+	"net/mail"
 	"net/url"
 	"os"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/dghubble/sessions"
+	"github.com/dustin/go-humanize"
 	"github.com/mariusor/feeds"
 	"github.com/motemen/go-pocket/auth"
 )
@@ -30,6 +35,11 @@ import (
 var (
 	sessionName  = "_s"
 	sessionStore sessions.Store
+	blobStore    feeds.Storage
+
+	// serverCtx is done when the server shuts down, stopping the background jobs which wait in background.
+	serverCtx  = context.Background()
+	background sync.WaitGroup
 
 	//go:embed templates
 	templateFS embed.FS
@@ -107,10 +117,17 @@ func genRoutes(db *sql.DB) *http.ServeMux {
 		log.Printf("unable to load feeds: %s", err)
 	}
 
-	feedsListing := index{Feeds: allFeeds, s: ss}
+	stats, err := feeds.LoadFeedsReadingStats(db)
+	if err != nil {
+		log.Printf("unable to load reading statistics: %s", err)
+	}
+
+	feedsListing := index{Feeds: allFeeds, Stats: stats, s: ss}
 
 	r.HandleFunc("/", feedsListing.Handler)
 	r.HandleFunc("/add", AddHandler(db))
+	r.HandleFunc("/search", searchHandler(db, allFeeds))
+	r.HandleFunc("/"+feeds.ImagesDir+"/", imageHandler)
 	for _, f := range allFeeds {
 		items, err := feeds.GetItemsByFeedAndType(db, f, feeds.OutputTypeHTML)
 		if err != nil {
@@ -119,17 +136,23 @@ func genRoutes(db *sql.DB) *http.ServeMux {
 		a := articleListing{
 			Feed:  f,
 			Items: items,
+			Stats: stats[f.ID],
 		}
 		feedPath := "/" + feeds.Slug(f.Title)
 		r.HandleFunc(feedPath+"/", a.Handler)
+		r.HandleFunc(feedPath+"/cover.jpg", coverHandler(db, f))
+		r.HandleFunc(feedPath+"/cover", coverUploadHandler(db, f))
+		r.HandleFunc(feedPath+"/cleanup", cleanupHandler(db, f, items))
+		r.HandleFunc(feedPath+"/quality", qualityHandler(db, f, items))
+		r.HandleFunc(feedPath+"/reprocess", reprocessHandler(db, f))
 		for _, it := range items {
-			article := article{Feed: f, Item: it}
-			for _, typ := range feeds.ValidEbookTypes {
+			for _, typ := range feeds.EbookTypes() {
+				article := article{Feed: f, Item: it, Type: typ}
 				handlerFn := notFoundHandler(fmt.Errorf("%q not found", it.Title))
 				if cont, ok := it.Content[typ]; ok && fileExists(cont.Path) {
 					handlerFn = article.Handler
 				}
-				r.HandleFunc(fmt.Sprintf("%s.%s", path.Join(feedPath, it.PathSlug()), typ), handlerFn)
+				r.HandleFunc(fmt.Sprintf("%s.%s", path.Join(feedPath, it.PathSlug()), feeds.FileExt(typ)), handlerFn)
 			}
 		}
 	}
@@ -139,6 +162,8 @@ func genRoutes(db *sql.DB) *http.ServeMux {
 		switch service {
 		case "myk":
 			r.HandleFunc(path.Join("/register", service), myKindleTarget(db, ss, feedsListing.Feeds).Handler)
+		case "email":
+			r.HandleFunc(path.Join("/register", service), emailTarget(db, ss, feedsListing.Feeds).Handler)
 		case "pocket":
 			var handlerFn http.HandlerFunc
 			curPath := path.Join("/register", service)
@@ -170,6 +195,22 @@ func myKindleTarget(c *sql.DB, ss sessions.Store, f []feeds.Feed) target {
 	return t
 }
 
+var defaultEmailService = feeds.ServiceEmail{
+	SendCredentials: feeds.DefaultMyKindleSender,
+}
+
+func emailTarget(c *sql.DB, ss sessions.Store, f []feeds.Feed) target {
+	t := target{
+		r:           R("email", ss),
+		Feeds:       f,
+		Service:     make(map[string]feeds.DestinationService),
+		Destination: make(map[string]feeds.DestinationTarget),
+		db:          c,
+	}
+	t.Service["email"] = &defaultEmailService
+	return t
+}
+
 func genericTarget(c *sql.DB, ss sessions.Store, f []feeds.Feed) target {
 	t := target{
 		r:           R("subscriptions", ss),
@@ -180,6 +221,7 @@ func genericTarget(c *sql.DB, ss sessions.Store, f []feeds.Feed) target {
 	}
 	t.Service["pocket"] = &defaultPocketService
 	t.Service["myk"] = &defaultKindleService
+	t.Service["email"] = &defaultEmailService
 	return t
 }
 
@@ -240,6 +282,23 @@ func (t target) HandleKindle(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		kindle.To = email
+		kindle.ContentType = ""
+		if typ := r.FormValue("myk_type"); typ != "" {
+			if !validContentType(service, typ) {
+				errorTpl.Execute(w, fmt.Errorf("invalid content type %s, valid ones are %v", typ, service.ValidContentTypes()))
+				return
+			}
+			kindle.ContentType = typ
+		}
+		kindle.Options = nil
+		if opts := kindleOptions(r); len(opts) > 0 {
+			data, err := json.Marshal(opts)
+			if err != nil {
+				errorTpl.Execute(w, err)
+				return
+			}
+			kindle.Options = data
+		}
 		if _, err := feeds.SaveDestination(t.db, kindle); err != nil {
 			errorTpl.Execute(w, err)
 			return
@@ -252,6 +311,73 @@ func (t target) HandleKindle(w http.ResponseWriter, r *http.Request) {
 	t.r.Write(w, r, s, t)
 }
 
+// kindleOptions returns the conversion options overridden in the Kindle registration form.
+func kindleOptions(r *http.Request) map[string]interface{} {
+	opts := make(map[string]interface{})
+	if width, err := strconv.Atoi(r.FormValue("myk_image_width")); err == nil && width > 0 {
+		opts["image_width"] = width
+	}
+	if r.FormValue("myk_grayscale") != "" {
+		opts["grayscale"] = true
+	}
+	if r.FormValue("myk_typography") != "" {
+		opts["typography"] = true
+		opts["hyphenate"] = r.FormValue("myk_hyphenate") != ""
+	}
+	return opts
+}
+
+func (t target) HandleEmail(w http.ResponseWriter, r *http.Request) {
+	s := t.r.SessionInit(r)
+	var service *feeds.ServiceEmail
+	if ss, ok := t.Service["email"]; ok {
+		if sss, ok := ss.(*feeds.ServiceEmail); ok {
+			service = sss
+		}
+	}
+	if service == nil {
+		errorTpl.Execute(w, fmt.Errorf("invalid service"))
+		return
+	}
+	dest := getEmailSession(s, service)
+	if r.Method == http.MethodPost {
+		addr, err := mail.ParseAddress(r.FormValue("email_account"))
+		if err != nil {
+			errorTpl.Execute(w, fmt.Errorf("please use a valid email address"))
+			return
+		}
+		dest.To = addr.Address
+		dest.ContentType = ""
+		if typ := r.FormValue("email_type"); typ != "" {
+			if !validContentType(service, typ) {
+				errorTpl.Execute(w, fmt.Errorf("invalid content type %s, valid ones are %v", typ, service.ValidContentTypes()))
+				return
+			}
+			dest.ContentType = typ
+		}
+		if _, err := feeds.SaveDestination(t.db, dest); err != nil {
+			errorTpl.Execute(w, err)
+			return
+		}
+		s.Values["email"] = dest
+		t.r.Redirect(w, r, s, "/subscriptions")
+		return
+	}
+	s.Values["email"] = dest
+	t.Service["email"] = service
+	t.Destination["email"] = dest
+	t.r.Write(w, r, s, t)
+}
+
+func validContentType(service feeds.DestinationService, typ string) bool {
+	for _, valid := range service.ValidContentTypes() {
+		if valid == typ {
+			return true
+		}
+	}
+	return false
+}
+
 func (t target) HandlePocketTarget(w http.ResponseWriter, r *http.Request) {
 	s := t.r.SessionInit(r)
 	var service *feeds.ServicePocket
@@ -342,6 +468,10 @@ func (t target) HandleSubscriptions(w http.ResponseWriter, r *http.Request) {
 		t.Destination["myk"], ok = d.(feeds.MyKindleDestination)
 		haveDestination = haveDestination || ok
 	}
+	if d, ok := s.Values["email"]; ok {
+		t.Destination["email"], ok = d.(feeds.EmailDestination)
+		haveDestination = haveDestination || ok
+	}
 	if !haveDestination {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
@@ -357,6 +487,14 @@ func (t target) HandleSubscriptions(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 		}
+		volumes := make(map[int]int)
+		languages := make(map[int][]string)
+		for _, id := range feedIds {
+			if size, err := strconv.Atoi(r.Form.Get(fmt.Sprintf("volume-%d", id))); err == nil && size >= 0 {
+				volumes[id] = size
+			}
+			languages[id] = feeds.ParseLanguages(r.Form.Get(fmt.Sprintf("languages-%d", id)))
+		}
 		ff := make([]feeds.Feed, 0)
 		for _, feed := range t.Feeds {
 			remove := true
@@ -385,6 +523,14 @@ func (t target) HandleSubscriptions(w http.ResponseWriter, r *http.Request) {
 					errorTpl.Execute(w, err)
 					return
 				}
+				if err = feeds.SaveSubscriptionVolumes(t.db, *dest, volumes); err != nil {
+					errorTpl.Execute(w, err)
+					return
+				}
+				if err = feeds.SaveSubscriptionLanguages(t.db, *dest, languages); err != nil {
+					errorTpl.Execute(w, err)
+					return
+				}
 			}
 		}
 
@@ -402,6 +548,39 @@ func (t target) HandleSubscriptions(w http.ResponseWriter, r *http.Request) {
 					errorTpl.Execute(w, err)
 					return
 				}
+				if err = feeds.SaveSubscriptionVolumes(t.db, *dest, volumes); err != nil {
+					errorTpl.Execute(w, err)
+					return
+				}
+				if err = feeds.SaveSubscriptionLanguages(t.db, *dest, languages); err != nil {
+					errorTpl.Execute(w, err)
+					return
+				}
+			}
+		}
+
+		if d, ok := t.Destination["email"]; ok {
+			if dest, err = feeds.LoadDestination(t.db, d); err == nil {
+				// TODO(marius): error on empty dest
+				serv := feeds.ServiceEmail{}
+				json.Unmarshal(dest.Credentials, &serv)
+				t.Service["email"] = &serv
+				if err = feeds.RemoveSubscriptions(t.db, *dest, removeIds...); err != nil {
+					errorTpl.Execute(w, err)
+					return
+				}
+				if err = feeds.SaveSubscriptions(t.db, *dest, ff...); err != nil {
+					errorTpl.Execute(w, err)
+					return
+				}
+				if err = feeds.SaveSubscriptionVolumes(t.db, *dest, volumes); err != nil {
+					errorTpl.Execute(w, err)
+					return
+				}
+				if err = feeds.SaveSubscriptionLanguages(t.db, *dest, languages); err != nil {
+					errorTpl.Execute(w, err)
+					return
+				}
 			}
 		}
 		t.r.Redirect(w, r, s, reqURL(r))
@@ -439,6 +618,10 @@ func (t target) Handler(w http.ResponseWriter, r *http.Request) {
 		t.HandleKindle(w, r)
 		return
 	}
+	if which == "email" {
+		t.HandleEmail(w, r)
+		return
+	}
 }
 
 func getSessionKey() []byte {
@@ -451,6 +634,8 @@ func getSessionKey() []byte {
 
 var CLI struct {
 	Path    string `default:".cache" help:"Base storage path"`
+	DB      string `name:"db" env:"FEEDS_DB" help:"Database connection string, a postgres:// URL selects PostgreSQL instead of the SQLite file in the base storage path"`
+	Storage string `env:"FEEDS_STORAGE" help:"Storage for the downloaded and generated files, a s3:// URL selects an S3 compatible bucket instead of the base storage path"`
 	Listen  string `default:"localhost:3000" help:"The HTTP address to listen on"`
 	Verbose bool   `short:"v" help:"Output debugging messages"`
 }
@@ -470,12 +655,16 @@ func main() {
 		os.Mkdir(basePath, 0755)
 	}
 
-	c, err := feeds.DB(basePath)
+	c, err := feeds.DB(basePath, CLI.DB)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer c.Close()
 
+	if blobStore, err = feeds.OpenStorage(basePath, CLI.Storage); err != nil {
+		log.Fatal(err)
+	}
+
 	keys := [][]byte{getSessionKey()}
 
 	sessionStore = sessions.NewCookieStore(keys...)
@@ -496,16 +685,39 @@ func main() {
 		}
 	}()
 
-	log.Fatal(http.ListenAndServe(CLI.Listen, r))
+	ctx, stop := feeds.NotifyContext(context.Background())
+	defer stop()
+	serverCtx = ctx
+
+	srv := http.Server{Addr: CLI.Listen, Handler: r}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		close(quit)
+		log.Printf("Shutting down")
+		sctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(sctx); err != nil {
+			log.Printf("Unable to shut down cleanly: %s", err)
+		}
+		background.Wait()
+	}()
+	if err = srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-stopped
 }
 
 type index struct {
 	s     sessions.Store
 	Feeds []feeds.Feed
+	Stats map[int]feeds.FeedReadingStats
 }
 
 type feedListing struct {
 	Feeds        []feeds.Feed
+	Stats        map[int]feeds.FeedReadingStats
 	Destinations []feeds.DestinationTarget
 	Targets      map[string]feeds.DestinationService
 }
@@ -518,6 +730,7 @@ func (i index) Handler(w http.ResponseWriter, r *http.Request) {
 
 	l := feedListing{
 		Feeds:        i.Feeds,
+		Stats:        i.Stats,
 		Destinations: make([]feeds.DestinationTarget, 0),
 		Targets:      feeds.ValidTargets,
 	}
@@ -531,6 +744,9 @@ func (i index) Handler(w http.ResponseWriter, r *http.Request) {
 	if kindle.To != "" {
 		l.Destinations = append(l.Destinations, kindle)
 	}
+	if email := getEmailSession(s, nil); email.To != "" {
+		l.Destinations = append(l.Destinations, email)
+	}
 	rr.Write(w, r, s, l)
 }
 
@@ -538,14 +754,25 @@ var tplFuncs = func(r *http.Request) template.FuncMap {
 	return template.FuncMap{
 		"fmtDuration": fmtDuration,
 		"fmtTime":     fmtTime,
+		"fmtNumber": func(n int) string {
+			return humanize.Comma(int64(n))
+		},
+		"readingTime": feeds.FormatReadingTime,
 		"sluggify": func(s string) template.HTMLAttr {
 			return template.HTMLAttr(feeds.Slug(s))
 		},
-		"request":             func() http.Request { return *r },
-		"hasHtml":             has("html"),
-		"validType":           validEbookType,
-		"serviceEnabled":      serviceEnabled,
-		"subscriptionEnabled": subscriptionEnabled,
+		"request":               func() http.Request { return *r },
+		"hasHtml":               has("html"),
+		"validType":             validEbookType,
+		"fileExt":               feeds.FileExt,
+		"serviceEnabled":        serviceEnabled,
+		"subscriptionEnabled":   subscriptionEnabled,
+		"volumeSize":            volumeSize,
+		"subscriptionLanguages": subscriptionLanguages,
+		"snippet": func(s string) template.HTML {
+			// NOTE(marius): the search snippets are escaped, except for their mark elements
+			return template.HTML(s)
+		},
 	}
 }
 
@@ -557,6 +784,24 @@ func subscriptionEnabled(feedId int, subscriptions []feeds.Subscription) bool {
 	}
 	return false
 }
+func volumeSize(feedId int, subscriptions []feeds.Subscription) int {
+	for _, sub := range subscriptions {
+		if sub.Feed.ID == feedId {
+			return sub.VolumeSize
+		}
+	}
+	return 0
+}
+
+func subscriptionLanguages(feedId int, subscriptions []feeds.Subscription) string {
+	for _, sub := range subscriptions {
+		if sub.Feed.ID == feedId {
+			return strings.Join(sub.Languages, ", ")
+		}
+	}
+	return ""
+}
+
 func serviceEnabled(dest []feeds.DestinationTarget, typ string) bool {
 	for _, d := range dest {
 		if d.Type() == typ {
@@ -567,7 +812,7 @@ func serviceEnabled(dest []feeds.DestinationTarget, typ string) bool {
 }
 
 func validEbookType(typ string) bool {
-	for _, tt := range feeds.ValidEbookTypes {
+	for _, tt := range feeds.EbookTypes() {
 		if tt == feeds.OutputTypeHTML {
 			continue
 		}
@@ -585,8 +830,8 @@ func has(typ string) func(i feeds.Item) bool {
 	}
 }
 
-func fileExists(file string) bool {
-	_, err := os.Stat(file)
+func fileExists(name string) bool {
+	_, err := blobStore.Stat(name)
 	return err == nil
 }
 
@@ -610,21 +855,309 @@ func (a articleListing) Handler(w http.ResponseWriter, r *http.Request) {
 type articleListing struct {
 	Feed  feeds.Feed
 	Items []feeds.Item
+	Stats feeds.FeedReadingStats
 }
 
 func (a article) Handler(w http.ResponseWriter, r *http.Request) {
-	ext := strings.TrimLeft(path.Ext(r.URL.Path), ".")
-	cont, ok := a.Item.Content[ext]
+	cont, ok := a.Item.Content[a.Type]
 	if !ok {
-		notFoundHandler(fmt.Errorf("%s was not found", path.Base(r.URL.Path)))
+		notFoundHandler(fmt.Errorf("%s was not found", path.Base(r.URL.Path)))(w, r)
+		return
+	}
+	info, err := blobStore.Stat(cont.Path)
+	if err != nil {
+		notFoundHandler(fmt.Errorf("%s was not found", path.Base(r.URL.Path)))(w, r)
+		return
+	}
+	data, err := feeds.LoadContent(blobStore, cont)
+	if err != nil {
+		errorTpl.Execute(w, err)
+		return
+	}
+	if conv, ok := feeds.ConverterFor(a.Type); ok {
+		w.Header().Set("Content-Type", conv.MimeType())
+	}
+	http.ServeContent(w, r, path.Base(r.URL.Path), info.ModTime, bytes.NewReader(data))
+}
+
+func imageHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+	f, err := blobStore.Open(name)
+	if err != nil {
+		notFoundHandler(fmt.Errorf("%s was not found", path.Base(r.URL.Path)))(w, r)
 		return
 	}
-	http.ServeFile(w, r, cont.Path)
+	defer f.Close()
+	info, err := blobStore.Stat(name)
+	if err != nil {
+		errorTpl.Execute(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(w, r, path.Base(name), info.ModTime, f)
+}
+
+// maxCoverSize is the maximum size of the uploaded base images of the covers
+const maxCoverSize = 10 << 20
+
+func coverHandler(c *sql.DB, f feeds.Feed) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, err := feeds.FeedCover(r.Context(), c, blobStore, f)
+		if err != nil {
+			errorTpl.Execute(w, err)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		http.ServeContent(w, r, "cover.jpg", time.Now(), bytes.NewReader(data))
+	}
+}
+
+func coverUploadHandler(c *sql.DB, f feeds.Feed) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxCoverSize)
+		file, _, err := r.FormFile("cover")
+		if err != nil {
+			errorTpl.Execute(w, fmt.Errorf("invalid cover image: %w", err))
+			return
+		}
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		if err != nil {
+			errorTpl.Execute(w, err)
+			return
+		}
+		if err = feeds.SaveFeedCover(c, blobStore, f, data); err != nil {
+			errorTpl.Execute(w, err)
+			return
+		}
+		http.Redirect(w, r, "/"+feeds.Slug(f.Title)+"/", http.StatusSeeOther)
+	}
+}
+
+// qualityHandler accepts the items rejected by the quality checks, or resets them for being fetched again.
+func qualityHandler(c *sql.DB, f feeds.Feed, items []feeds.Item) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.Atoi(r.PostFormValue("item"))
+		if err != nil {
+			errorTpl.Execute(w, fmt.Errorf("invalid item: %w", err))
+			return
+		}
+		var it *feeds.Item
+		for i := range items {
+			if items[i].ID == id {
+				it = &items[i]
+			}
+		}
+		if it == nil {
+			notFoundHandler(fmt.Errorf("feed %q does not contain item %d", f.Title, id))(w, r)
+			return
+		}
+		switch r.PostFormValue("action") {
+		case "accept":
+			err = feeds.AcceptItem(c, it.ID)
+			it.Quality, it.QualityReason = feeds.QualityAccepted, ""
+		case "refetch":
+			err = feeds.RefetchItem(c, *it)
+			it.Quality, it.QualityReason = "", ""
+		default:
+			err = fmt.Errorf("invalid action %q", r.PostFormValue("action"))
+		}
+		if err != nil {
+			errorTpl.Execute(w, err)
+			return
+		}
+		http.Redirect(w, r, "/"+feeds.Slug(f.Title)+"/", http.StatusSeeOther)
+	}
+}
+
+// reprocessHandler starts regenerating the stale contents of the feed, which can take a while, in the background.
+func reprocessHandler(c *sql.DB, f feeds.Feed) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		force := r.PostFormValue("force") != ""
+		redispatch := r.PostFormValue("dispatch") != ""
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			if err := feeds.ReprocessCmd(serverCtx, c, blobStore, f.ID, force, redispatch); err != nil {
+				log.Printf("Unable to reprocess feed %s: %s", f.Title, err)
+			}
+		}()
+		http.Redirect(w, r, "/"+feeds.Slug(f.Title)+"/", http.StatusSeeOther)
+	}
+}
+
+type cleanupPreview struct {
+	Feed       feeds.Feed
+	Item       feeds.Item
+	Items      []feeds.Item
+	Selectors  feeds.ExtractSelectors
+	Stylesheet string
+	Types      []string
+	Rules      map[string]string
+	Global     feeds.CleanupRules
+	Before     string
+	After      string
+	Error      error
+}
+
+// cleanupRulesFromForm parses the rules of feed f from the form fields named after the rule types,
+// which contain one rule value per line.
+func cleanupRulesFromForm(r *http.Request, f feeds.Feed) feeds.CleanupRules {
+	rules := make(feeds.CleanupRules, 0)
+	for _, typ := range feeds.CleanupTypes {
+		for _, v := range strings.Split(r.PostFormValue(typ), "\n") {
+			if v = strings.TrimSpace(v); v != "" {
+				rules = append(rules, feeds.CleanupRule{FeedID: f.ID, Type: typ, Value: v})
+			}
+		}
+	}
+	return rules
+}
+
+func cleanupHandler(c *sql.DB, f feeds.Feed, items []feeds.Item) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		p := cleanupPreview{Feed: f, Types: feeds.CleanupTypes, Rules: make(map[string]string)}
+		for _, it := range items {
+			if _, ok := it.Content[feeds.OutputTypeRAW]; ok {
+				p.Items = append(p.Items, it)
+			}
+		}
+
+		if p.Selectors, err = feeds.LoadFeedSelectors(c, f.ID); err != nil {
+			errorTpl.Execute(w, err)
+			return
+		}
+		if p.Stylesheet, err = feeds.LoadFeedStylesheet(c, f.ID); err != nil {
+			errorTpl.Execute(w, err)
+			return
+		}
+		all, err := feeds.LoadCleanupRules(c, f.ID)
+		if err != nil {
+			errorTpl.Execute(w, err)
+			return
+		}
+		rules := make(feeds.CleanupRules, 0)
+		for _, rule := range all {
+			if rule.FeedID == 0 {
+				p.Global = append(p.Global, rule)
+			} else {
+				rules = append(rules, rule)
+			}
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			rules = cleanupRulesFromForm(r, f)
+			p.Selectors = feeds.ExtractSelectors{
+				Title:   strings.TrimSpace(r.PostFormValue("title_selector")),
+				Content: strings.TrimSpace(r.PostFormValue("content_selector")),
+			}
+			p.Stylesheet = strings.TrimSpace(r.PostFormValue("stylesheet"))
+			if r.PostFormValue("action") == "save" {
+				if err = feeds.SaveFeedSelectors(c, f.ID, p.Selectors); err != nil {
+					errorTpl.Execute(w, err)
+					return
+				}
+				if err = feeds.SaveFeedStylesheet(c, f.ID, p.Stylesheet); err != nil {
+					errorTpl.Execute(w, err)
+					return
+				}
+				if err = feeds.SaveCleanupRules(c, f.ID, rules); err != nil {
+					errorTpl.Execute(w, err)
+					return
+				}
+				http.Redirect(w, r, "/"+feeds.Slug(f.Title)+"/cleanup", http.StatusSeeOther)
+				return
+			}
+			if p.Error = p.Selectors.Validate(); p.Error == nil {
+				p.Error = rules.Validate()
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		for _, rule := range rules {
+			p.Rules[rule.Type] += rule.Value + "\n"
+		}
+
+		if len(p.Items) == 0 {
+			p.Error = fmt.Errorf("feed %q has no fetched items to preview", f.Title)
+		} else if p.Error == nil {
+			// NOTE(marius): the preview defaults to the latest item of the feed
+			p.Item = p.Items[len(p.Items)-1]
+			if idx, err := strconv.Atoi(r.FormValue("item")); err == nil {
+				for _, it := range p.Items {
+					if it.FeedIndex == idx {
+						p.Item = it
+					}
+				}
+			}
+			before, after, err := feeds.PreviewCleanup(blobStore, p.Item, p.Selectors, append(p.Global, rules...))
+			if err != nil {
+				p.Error = err
+			}
+			p.Before, p.After = string(before), string(after)
+		}
+
+		t, err := tpl("cleanup.html", r)
+		if err != nil {
+			errorTpl.Execute(w, err)
+			return
+		}
+		t.Execute(w, p)
+	}
+}
+
+type searchListing struct {
+	Query   string
+	Feed    feeds.Feed
+	Feeds   []feeds.Feed
+	Results []feeds.SearchResult
+	Error   error
+}
+
+// searchHandler searches the text of the items of all feeds, or of the one selected.
+func searchHandler(c *sql.DB, all []feeds.Feed) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l := searchListing{Query: strings.TrimSpace(r.FormValue("q")), Feeds: all}
+		if id, err := strconv.Atoi(r.FormValue("feed")); err == nil {
+			for _, f := range all {
+				if f.ID == id {
+					l.Feed = f
+				}
+			}
+		}
+		if l.Query != "" {
+			l.Results, l.Error = feeds.Search(c, feeds.SearchQuery{Text: l.Query, FeedID: l.Feed.ID})
+		}
+
+		t, err := tpl("search.html", r)
+		if err != nil {
+			errorTpl.Execute(w, err)
+			return
+		}
+		t.Execute(w, l)
+	}
 }
 
 type article struct {
 	Feed feeds.Feed
 	Item feeds.Item
+	Type string
 }
 
 type targets struct {
@@ -768,6 +1301,7 @@ func fmtDuration(d time.Duration) template.HTML {
 func initSession(ss sessions.Store, r *http.Request) *sessions.Session {
 	gob.Register(feeds.PocketDestination{})
 	gob.Register(feeds.MyKindleDestination{})
+	gob.Register(feeds.EmailDestination{})
 	s, err := ss.Get(r, sessionName)
 	if err != nil {
 		s = sessions.NewSession(ss, sessionName)
@@ -794,6 +1328,15 @@ func getKindleSession(s *sessions.Session, d feeds.DestinationService) feeds.MyK
 	return feeds.MyKindleDestination{}
 }
 
+func getEmailSession(s *sessions.Session, d feeds.DestinationService) feeds.EmailDestination {
+	if email, ok := s.Values["email"]; ok {
+		if e, ok := email.(feeds.EmailDestination); ok {
+			return e
+		}
+	}
+	return feeds.EmailDestination{}
+}
+
 type AddStatus struct {
 	Status string
 	URL    string
@@ -812,7 +1355,7 @@ func AddHandler(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
 				errorTpl.Execute(w, fmt.Errorf("invalid URL %w", err))
 				return
 			}
-			doc, err := feeds.GetFeedInfo(*u)
+			doc, err := feeds.GetFeedInfo(r.Context(), *u)
 			if err != nil {
 				errorTpl.Execute(w, fmt.Errorf("invalid RSS %w", err))
 				return
@@ -6,20 +6,18 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"os"
 	"sync"
 	"time"
 
-	"golang.org/x/sync/errgroup"
+	"github.com/dustin/go-humanize"
 )
 
 const (
 	halfDay                = time.Hour * 12
-	chunkSize              = 10
 	defaultSleepAfterBatch = 200 * time.Millisecond
 )
 
-func FetchItemsCmd(ctx context.Context, c *sql.DB, basePath string) (bool, error) {
+func FetchItemsCmd(ctx context.Context, c *sql.DB, s Storage) (bool, error) {
 	all, err := GetNonFetchedItems(c)
 	if err != nil {
 		return false, err
@@ -32,36 +30,35 @@ func FetchItemsCmd(ctx context.Context, c *sql.DB, basePath string) (bool, error
 	maxFailureCount := 3
 	failures := make(map[int]int)
 	m := sync.Mutex{}
-	g, _ := errgroup.WithContext(ctx)
-	for i := 0; i < len(all); i += chunkSize {
-		for j := i; j < i+chunkSize && j < len(all); j++ {
-			it := all[j]
-			if failures[it.Feed.ID] > maxFailureCount {
-				log.Printf("Skipping %s, too many failures when loading", it.URL)
-				continue
-			}
-			g.Go(func() error {
-				defer func() {
-					m.Unlock()
-					time.Sleep(defaultSleepAfterBatch)
-				}()
-
-				m.Lock()
-				status, err = LoadItem(&it, c, basePath)
-				if err != nil {
-					log.Printf("Error[%5d] %s %s", it.FeedIndex, it.URL.String(), err.Error())
-					failures[it.Feed.ID]++
-				}
-				log.Printf("Loaded[%5d] %s [%t]", it.FeedIndex, it.URL.String(), status)
-
-				return nil
-			})
+	hosts := newHostLimiter(FetchPerHost, FetchDelay)
+	err = runPool(ctx, "Fetched", len(all), FetchWorkers, func(ctx context.Context, i int) error {
+		it := all[i]
+		m.Lock()
+		failed := failures[it.Feed.ID]
+		m.Unlock()
+		if failed > maxFailureCount {
+			log.Printf("Skipping %s, too many failures when loading", it.URL)
+			return nil
 		}
-		if err := g.Wait(); err != nil {
-			return status, err
+		release, err := hosts.acquire(ctx, it.URL.Hostname())
+		if err != nil {
+			// NOTE(marius): the context was done while waiting for the host
+			return nil
 		}
-	}
-	return status, nil
+		defer release()
+
+		loaded, err := LoadItem(context.WithoutCancel(ctx), &it, c, s)
+		m.Lock()
+		if err != nil {
+			log.Printf("Error[%5d] %s %s", it.FeedIndex, it.URL.String(), err.Error())
+			failures[it.Feed.ID]++
+		}
+		status = status || loaded
+		m.Unlock()
+		log.Printf("Loaded[%5d] %s [%t]", it.FeedIndex, it.URL.String(), loaded)
+		return nil
+	})
+	return status, err
 }
 
 func FetchFeedsCmd(ctx context.Context, c *sql.DB) (bool, error) {
@@ -74,50 +71,51 @@ func FetchFeedsCmd(ctx context.Context, c *sql.DB) (bool, error) {
 	}
 
 	hasNewItems := false
-	g, _ := errgroup.WithContext(ctx)
-	for i := 0; i < len(all); i += chunkSize {
-		for j := i; j < i+chunkSize && j < len(all); j++ {
-			f := all[j]
-			if f.URL == nil {
-				continue
-			}
-
-			g.Go(func() error {
-				if f.URL.Scheme == "" {
-					log.Printf("Feed %s has an invalid URL, skipping...", f.Title)
-					return nil
-				}
-				log.Printf("Feed %s\n", f.URL.String())
-				if f.Frequency == 0 {
-					f.Frequency = halfDay
-				}
-				var last time.Duration = 0
-				if !f.Updated.IsZero() {
-					last = time.Now().UTC().Sub(f.Updated)
-					log.Printf("Last checked %s ago", last.Round(10*time.Second).String())
-				}
-				if last > 0 && last <= f.Frequency {
-					log.Printf(" ...newer than %s, skipping.\n", f.Frequency.String())
-					return nil
-				}
-
-				hasItems := false
-				if hasItems, err = CheckFeed(f, c); err != nil {
-					log.Printf("Error: %s", err)
-				}
-				hasNewItems = hasNewItems || hasItems
-				return nil
-			})
+	m := sync.Mutex{}
+	hosts := newHostLimiter(FetchPerHost, FetchDelay)
+	err = runPool(ctx, "Checked", len(all), FetchWorkers, func(ctx context.Context, i int) error {
+		f := all[i]
+		if f.URL == nil {
+			return nil
 		}
-		if err := g.Wait(); err != nil {
-			return hasNewItems, err
+		if f.URL.Scheme == "" {
+			log.Printf("Feed %s has an invalid URL, skipping...", f.Title)
+			return nil
 		}
-	}
-	return hasNewItems, nil
+		log.Printf("Feed %s\n", f.URL.String())
+		if f.Frequency == 0 {
+			f.Frequency = halfDay
+		}
+		var last time.Duration = 0
+		if !f.Updated.IsZero() {
+			last = time.Now().UTC().Sub(f.Updated)
+			log.Printf("Last checked %s ago", last.Round(10*time.Second).String())
+		}
+		if last > 0 && last <= f.Frequency {
+			log.Printf(" ...newer than %s, skipping.\n", f.Frequency.String())
+			return nil
+		}
+		release, err := hosts.acquire(ctx, f.URL.Hostname())
+		if err != nil {
+			// NOTE(marius): the context was done while waiting for the host
+			return nil
+		}
+		defer release()
+
+		hasItems, err := CheckFeed(context.WithoutCancel(ctx), f, c)
+		if err != nil {
+			log.Printf("Error: %s", err)
+		}
+		m.Lock()
+		hasNewItems = hasNewItems || hasItems
+		m.Unlock()
+		return nil
+	})
+	return hasNewItems, err
 }
 
-func GenerateContentCmd(ctx context.Context, c *sql.DB, basePath string) error {
-	all, err := GetContentsForEbook(c, ValidEbookTypes[:]...)
+func GenerateContentCmd(ctx context.Context, c *sql.DB, s Storage) error {
+	all, err := GetContentsForEbook(c, EbookTypes()...)
 	if err != nil {
 		return err
 	}
@@ -126,62 +124,80 @@ func GenerateContentCmd(ctx context.Context, c *sql.DB, basePath string) error {
 		return nil
 	}
 
-	m := sync.Mutex{}
-	g, _ := errgroup.WithContext(ctx)
-	for i := 0; i < len(all); i += chunkSize {
-		for j := i; j < i+chunkSize && j < len(all); j++ {
-			item := &all[j]
-			g.Go(func() error {
-				defer m.Unlock()
-
-				m.Lock()
-				gen, err := generateContent(item, basePath, true)
-				if err != nil {
-					MarkItemsAsFailed(c, *item)
-					return nil
-				}
-
-				if gen {
-					if err = InsertContent(c, *item); err != nil {
-						log.Printf("Unable to update paths in db: %s", err.Error())
-						return nil
-					}
-					log.Printf("Updated content items [%d] %s: %v", item.ID, item.Title, item.Content)
-				}
-				return nil
-			})
+	err = runPool(ctx, "Generated", len(all), ConvertWorkers, func(ctx context.Context, i int) error {
+		item := &all[i]
+		ctx, cancel := context.WithTimeout(ctx, ConvertTimeout)
+		defer cancel()
+		gen, err := generateContent(ctx, c, item, s, true)
+		if qe := (QualityError{}); errors.As(err, &qe) {
+			// NOTE(marius): the rejected items wait for the users to accept or to refetch them
+			log.Printf("Rejected [%d] %s: %s", item.ID, item.Title, qe.Check.Reason)
+			return nil
 		}
-		if err := g.Wait(); err != nil {
-			return err
+		if errors.Is(err, context.Canceled) {
+			// NOTE(marius): the types which weren't generated before stopping are picked up by the next run
+			log.Printf("Stopped generating [%d] %s", item.ID, item.Title)
+		} else if err != nil {
+			MarkItemsAsFailed(c, *item)
+			return nil
 		}
+
+		if gen {
+			if err = InsertContent(c, *item); err != nil {
+				log.Printf("Unable to update paths in db: %s", err.Error())
+				return nil
+			}
+			log.Printf("Updated content items [%d] %s: %v", item.ID, item.Title, item.Content)
+		}
+		return nil
+	})
+	if err := updateFeedsLanguage(c); err != nil {
+		log.Printf("Unable to update the languages of the feeds: %s", err)
 	}
-	return nil
+	return err
 }
 
-func fileExists(file string) bool {
-	_, err := os.Stat(file)
-	return err == nil
-}
+// generateContent generates the readable HTML and the ebook types of the item which are missing, the conversions
+// stopping when ctx is done.
+func generateContent(ctx context.Context, c *sql.DB, item *Item, s Storage, overwrite bool) (bool, error) {
+	// NOTE(marius): the downloads of the images finish within their own timeouts once started
+	dlCtx := context.WithoutCancel(ctx)
+	if err := loadFeedImages(dlCtx, c, s, &item.Feed); err != nil {
+		log.Printf("Unable to load feed images: %s", err.Error())
+	}
+	opts := feedConvertOptions(c, item.Feed.ID)
 
-func generateContent(item *Item, basePath string, overwrite bool) (bool, error) {
 	generated := false
-	if gen, err := GenerateContent(OutputTypeHTML, basePath, item, overwrite); err != nil {
+	if gen, err := generateItemContent(OutputTypeHTML, s, item, opts, overwrite); err != nil {
 		log.Printf("Unable to generate path: %s", err.Error())
-		if errors.Is(err, FileSizeError) {
+		generated = generated || gen
+	} else if gen {
+		if err = checkItemQuality(c, s, *item); err != nil {
 			return gen, err
 		}
-		generated = generated || gen
+		if err = fetchImages(dlCtx, c, s, item); err != nil {
+			log.Printf("Unable to save images: %s", err.Error())
+		}
+		if err = updateItemText(c, s, item); err != nil {
+			log.Printf("Unable to index the text: %s", err.Error())
+		}
+		generated = true
 	}
 
 	errs := make([]error, 0)
-	for _, typ := range ValidEbookTypes {
+	for _, typ := range EbookTypes() {
 		if c, ok := item.Content[typ]; ok {
-			if fileExists(c.Path) {
+			if c.Flags&FlagsDisabled == FlagsDisabled || blobExists(s, c.Path) {
+				// NOTE(marius): disabled contents have been removed by the retention policies
 				continue
 			}
 			delete(item.Content, typ)
 		}
-		gen, err := GenerateContent(typ, basePath, item, overwrite)
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		gen, err := generateItemContent(typ, s, item, opts, overwrite)
 		if err != nil {
 			log.Printf("Unable to generate path: %s", err.Error())
 			errs = append(errs, err)
@@ -191,7 +207,53 @@ func generateContent(item *Item, basePath string, overwrite bool) (bool, error)
 	return generated, errors.Join(errs...)
 }
 
-func DispatchContentCmd(ctx context.Context, c *sql.DB) error {
+// ReprocessCmd regenerates from their raw content the contents of the items of the feed, or of all feeds for
+// a zero feedID, which were generated by an older version of their converter or with other options, or all
+// of them when force is set. With redispatch they are sent again to the destinations they were sent to.
+func ReprocessCmd(ctx context.Context, c *sql.DB, s Storage, feedID int, force, redispatch bool) error {
+	all, err := loadReprocessItems(c, feedID)
+	if err != nil {
+		return err
+	}
+	if len(all) == 0 {
+		log.Printf("No content found for reprocessing")
+		return nil
+	}
+	count, err := reprocessItems(ctx, c, s, all, force, redispatch)
+	log.Printf("Reprocessed %d of %d items", count, len(all))
+	if err != nil {
+		return err
+	}
+	if redispatch && count > 0 {
+		return DispatchContentCmd(ctx, c, s)
+	}
+	return nil
+}
+
+// IndexCmd adds to the search index the items of the feed, or of all feeds for a zero feedID, which aren't
+// in it yet, or all of them when rebuild is set.
+func IndexCmd(ctx context.Context, c *sql.DB, s Storage, feedID int, rebuild bool) error {
+	all, err := loadIndexItems(c, feedID, rebuild)
+	if err != nil {
+		return err
+	}
+	if len(all) == 0 {
+		log.Printf("No content found for indexing")
+		return nil
+	}
+	count, err := indexItems(ctx, c, s, all)
+	log.Printf("Indexed %d of %d items", count, len(all))
+	if err := updateFeedsLanguage(c); err != nil {
+		log.Printf("Unable to update the languages of the feeds: %s", err)
+	}
+	return err
+}
+
+func DispatchContentCmd(ctx context.Context, c *sql.DB, s Storage) error {
+	if err := DispatchVolumes(ctx, c, s); err != nil {
+		log.Printf("Unable to dispatch volumes: %s", err.Error())
+	}
+
 	all, err := GetNonDispatchedItemContentsForDestination(c)
 	if err != nil {
 		return err
@@ -204,47 +266,47 @@ func DispatchContentCmd(ctx context.Context, c *sql.DB) error {
 	maxFailureCount := 3
 	failures := make(map[int]int)
 	m := sync.Mutex{}
-
-	g, _ := errgroup.WithContext(ctx)
-	for i := 0; i < len(all); i += chunkSize {
-		for j := i; j < i+chunkSize && j < len(all); j++ {
-			disp := all[j]
-			if failures[disp.Destination.ID] > maxFailureCount {
-				log.Printf("Skipping destination %s[%d], too many failures when dispatching", disp.Destination.Type, disp.Destination.ID)
-				continue
-			}
-			g.Go(func() error {
-				defer func() {
-					m.Unlock()
-					time.Sleep(defaultSleepAfterBatch)
-				}()
-				m.Lock()
-				if err := dispatch(c, disp); err != nil {
-					log.Printf("Error: %s", err.Error())
-					failures[disp.Destination.ID]++
-					return err
-				}
-				return nil
-			})
+	return runPool(ctx, "Dispatched", len(all), DispatchWorkers, func(ctx context.Context, i int) error {
+		disp := all[i]
+		m.Lock()
+		failed := failures[disp.Destination.ID]
+		m.Unlock()
+		if failed > maxFailureCount {
+			log.Printf("Skipping destination %s[%d], too many failures when dispatching", disp.Destination.Type, disp.Destination.ID)
+			return nil
 		}
-		if err := g.Wait(); err != nil {
-			return err
+		defer time.Sleep(defaultSleepAfterBatch)
+		if err := dispatch(context.WithoutCancel(ctx), c, s, disp); err != nil {
+			log.Printf("Error: %s", err.Error())
+			m.Lock()
+			failures[disp.Destination.ID]++
+			m.Unlock()
 		}
-	}
-	return nil
+		return nil
+	})
 }
 
-func dispatch(c *sql.DB, disp DispatchItem) error {
+func dispatch(ctx context.Context, c *sql.DB, s Storage, disp DispatchItem) error {
 	var err error
 	var status bool
 
-	switch disp.Destination.Type {
-	case "myk":
-		status, err = DispatchToKindle(disp)
-	case "pocket":
-		status, err = DispatchToPocket(disp)
-	default:
-		return fmt.Errorf("unknown dispatch type %s", disp.Destination.Type)
+	opts, override, err := destinationOptions(disp.Destination)
+	if err != nil {
+		return err
+	}
+	if override {
+		if opts.Stylesheet == "" {
+			if opts.FeedStylesheet, err = LoadFeedStylesheet(c, disp.Item.Feed.ID); err != nil {
+				return err
+			}
+		}
+		if err = generateDestinationContent(ctx, c, s, &disp, opts); err != nil {
+			return fmt.Errorf("unable to generate content for destination %s[%d]: %w", disp.Destination.Type, disp.Destination.ID, err)
+		}
+	}
+
+	if status, err = dispatchToTarget(ctx, s, disp); errors.Is(err, errUnknownTarget) {
+		return err
 	}
 	disp.LastStatus = status
 	if err != nil {
@@ -253,3 +315,58 @@ func dispatch(c *sql.DB, disp DispatchItem) error {
 	SaveTarget(c, disp)
 	return err
 }
+
+var errUnknownTarget = errors.New("unknown dispatch type")
+
+// dispatchToTarget sends the content of disp to its destination, using the target of the destination type.
+func dispatchToTarget(ctx context.Context, s Storage, disp DispatchItem) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, DispatchTimeout)
+	defer cancel()
+
+	switch disp.Destination.Type {
+	case "myk":
+		return DispatchToKindle(ctx, s, disp)
+	case "pocket":
+		return DispatchToPocket(ctx, disp)
+	case "email":
+		return DispatchToEmail(ctx, s, disp)
+	}
+	return false, fmt.Errorf("%w %s", errUnknownTarget, disp.Destination.Type)
+}
+
+// VolumeCmd compiles the items of feed f matched by sel into volumes of each of the types.
+func VolumeCmd(ctx context.Context, c *sql.DB, s Storage, f Feed, sel VolumeSelection, overwrite bool, types ...string) ([]Volume, error) {
+	items, err := LoadVolumeItems(c, f, sel)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		log.Printf("No items found for %s", f.Title)
+		return nil, nil
+	}
+	volumes := SplitVolumes(f, items, sel)
+	for i := range volumes {
+		v := &volumes[i]
+		for _, typ := range types {
+			if err = GenerateVolume(ctx, c, s, v, typ, overwrite); err != nil {
+				return volumes, fmt.Errorf("unable to generate %s volume %s: %w", typ, v.Title, err)
+			}
+			log.Printf("Generated %s [%d chapters]: %s", v.Title, len(v.Items), v.Content[typ].Path)
+		}
+	}
+	return volumes, nil
+}
+
+func GCCmd(ctx context.Context, c *sql.DB, s Storage, dryRun bool) error {
+	report, err := CollectGarbage(c, s, dryRun)
+	if err != nil {
+		return err
+	}
+	prefix := ""
+	if dryRun {
+		prefix = "[dry-run] "
+	}
+	log.Printf("%sRemoved %d contents with missing files, expired %d contents", prefix, report.MissingContents, report.ExpiredContents)
+	log.Printf("%sRemoved %d orphan files, reclaimed %s", prefix, report.OrphanFiles, humanize.Bytes(uint64(report.Reclaimed)))
+	return nil
+}
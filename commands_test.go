@@ -0,0 +1,93 @@
+package feeds
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDispatchContentCmdContinuesAfterFailures(t *testing.T) {
+	dir := t.TempDir()
+	c := testDB(t, dir)
+	s, err := OpenStorage(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	queries := []string{
+		`INSERT INTO feeds (title, author, url, flags) VALUES ('Feed', 'Author', 'https://example.com/feed', 0);`,
+		`INSERT INTO items (url, feed_id, title, author, feed_index, last_loaded) VALUES ('https://example.com/1', 1, 'Chapter 1', 'Author', 1, '` + now + `');`,
+		`INSERT INTO items (url, feed_id, title, author, feed_index, last_loaded) VALUES ('https://example.com/2', 1, 'Chapter 2', 'Author', 2, '` + now + `');`,
+		// NOTE(marius): the blobs of the contents are missing, so sending them fails before reaching the SMTP server
+		`INSERT INTO contents (item_id, path, type, created, flags) VALUES (1, 'blobs/1.epub', 'epub', '` + now + `', 0);`,
+		`INSERT INTO contents (item_id, path, type, created, flags) VALUES (2, 'blobs/2.epub', 'epub', '` + now + `', 0);`,
+		`INSERT INTO destinations (type, credentials, flags, created) VALUES ('email', '{"to":"one@example.com"}', 0, '` + now + `');`,
+		`INSERT INTO destinations (type, credentials, flags, created) VALUES ('email', '{"to":"two@example.com"}', 0, '` + now + `');`,
+		`INSERT INTO subscriptions (feed_id, destination_id, volume_size) VALUES (1, 1, 0);`,
+		`INSERT INTO subscriptions (feed_id, destination_id, volume_size) VALUES (1, 2, 0);`,
+	}
+	for _, q := range queries {
+		if _, err = c.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = DispatchContentCmd(context.Background(), c, s); err != nil {
+		t.Errorf("DispatchContentCmd() error = %v, want none", err)
+	}
+	var tried, failed int
+	if err = c.QueryRow(`SELECT COUNT(*), COUNT(CASE WHEN last_status = ? THEN 1 END) FROM dispatched;`, false).Scan(&tried, &failed); err != nil {
+		t.Fatal(err)
+	}
+	if tried != 4 || failed != 4 {
+		t.Errorf("DispatchContentCmd() tried %d and failed %d dispatches, want 4 and 4", tried, failed)
+	}
+}
+
+func TestGenerateContentStopsWithContext(t *testing.T) {
+	dir := t.TempDir()
+	c := testDB(t, dir)
+	s, err := OpenStorage(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	html, err := saveContentBlob(s, []byte("<html><body><p>Story text.</p><p>More story text.</p></body></html>"), OutputTypeHTML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		wantErr error
+	}{
+		{"in time", context.Background(), nil},
+		{"timed out", expired, context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			it := Item{
+				ID:      1,
+				Title:   "Chapter 1",
+				Author:  "Author",
+				Feed:    Feed{ID: 1, Title: tt.name},
+				Content: map[string]Content{OutputTypeHTML: {Type: OutputTypeHTML, Path: html}},
+			}
+			_, err := generateContent(tt.ctx, c, &it, s, true)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("generateContent() error = %v, want %v", err, tt.wantErr)
+			}
+			for _, typ := range EbookTypes() {
+				if typ == OutputTypeHTML {
+					continue
+				}
+				if _, ok := it.Content[typ]; ok == (tt.wantErr != nil) {
+					t.Errorf("generateContent() generated %s %t, want %t", typ, ok, tt.wantErr == nil)
+				}
+			}
+		})
+	}
+}
@@ -1,11 +1,16 @@
 package feeds
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
-	"io"
+	"io/fs"
+	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -14,177 +19,210 @@ const (
 	HtmlDir   = "articles"
 	OutputDir = "output"
 
-	OutputTypeRAW  = "raw"
-	OutputTypeHTML = "html"
-	OutputTypeEPUB = "epub"
-	OutputTypeMOBI = "mobi"
-	OutputTypeAZW3 = "azw3"
+	OutputTypeRAW      = "raw"
+	OutputTypeHTML     = "html"
+	OutputTypeEPUB     = "epub"
+	OutputTypeMOBI     = "mobi"
+	OutputTypeAZW3     = "azw3"
+	OutputTypeKEPUB    = "kepub"
+	OutputTypePDF      = "pdf"
+	OutputTypeMarkdown = "md"
+	OutputTypeText     = "txt"
+	OutputTypeFB2      = "fb2"
 )
 
-var ValidEbookTypes = [...]string{
-	OutputTypeHTML,
-	OutputTypeEPUB,
-	OutputTypeMOBI,
-	OutputTypeAZW3,
+// FileExt returns the extension of the files of type typ.
+func FileExt(typ string) string {
+	if conv, ok := converters[typ]; ok {
+		return conv.Ext()
+	}
+	return typ
 }
 
 type convertFn func(content []byte, title string, author string, outPath string) error
 
-type itemTypeFn func(*Item, string) convertFn
-
-type typeDependency map[string]string
-
-type functionMapper map[string]convertFn
-
-var typesDependencies = typeDependency{
-	OutputTypeMOBI: OutputTypeHTML,
-	OutputTypeEPUB: OutputTypeHTML,
-	OutputTypeAZW3: OutputTypeHTML,
-	OutputTypeHTML: OutputTypeRAW,
+// chapter is a section of an ebook compiled from multiple items.
+type chapter struct {
+	Title   string
+	Content []byte
 }
 
-var typesFunctions = functionMapper{
-	OutputTypeMOBI: ToMobi,
-	OutputTypeEPUB: ToEPub,
-	OutputTypeAZW3: ToAZW3,
-	OutputTypeHTML: ToReadableHtml,
+type bookFn func(chapters []chapter, title string, author string, meta ebookMeta, opts ConvertOptions, outPath string) error
+
+func getItemContentForType(s Storage, it Item, typ string) ([]byte, error) {
+	c, ok := it.Content[typ]
+	if !ok {
+		return nil, fmt.Errorf("invalid content of type %s for item %v", typ, it)
+	}
+	return LoadContent(s, c)
 }
 
-var mappings = map[string]itemTypeFn{
-	OutputTypeMOBI: ebook,
-	OutputTypeEPUB: ebook,
-	OutputTypeAZW3: ebook,
-	OutputTypeHTML: html,
+func GenerateContent(typ string, s Storage, item *Item, overwrite bool) (bool, error) {
+	return generateItemContent(typ, s, item, DefaultConvertOptions, overwrite)
 }
 
-func validEbookType(typ string) bool {
-	for _, t := range ValidEbookTypes {
-		if t == typ {
-			return true
-		}
+func generateItemContent(typ string, s Storage, item *Item, opts ConvertOptions, overwrite bool) (bool, error) {
+	conv, ok := converters[typ]
+	if !ok {
+		return false, fmt.Errorf("invalid ebook type %s, valid ones are %v", typ, EbookTypes())
+	}
+	if c, ok := item.Content[typ]; ok && c.Path != "" {
+		return false, nil
 	}
-	return false
-}
 
-func readFile(name string) ([]byte, error) {
-	f, err := os.Open(name)
+	name := blobName(OutputDir, item.Feed.Title, typ, item.Path(conv.Ext()))
+	fi, err := s.Stat(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	if ((err != nil && errors.Is(err, fs.ErrNotExist)) || fi.ModTime.Sub(time.Now()).Truncate(time.Second) == 0) && !overwrite {
+		return false, nil
+	}
+	buf, err := getItemContentForType(s, *item, conv.Dependency())
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-	defer f.Close()
 
-	var size int
-	if info, err := f.Stat(); err == nil {
-		size64 := info.Size()
-		if int64(int(size64)) == size64 {
-			size = int(size64)
-		}
+	// NOTE(marius): the converters can only write to local files, so we generate the content
+	// in a temporary directory and move it to the storage afterwards.
+	tmpDir, err := os.MkdirTemp("", "feeds-")
+	if err != nil {
+		return false, err
 	}
-	size++ // one byte for final read at EOF
+	defer os.RemoveAll(tmpDir)
 
-	// If a file claims a small size, read at least 512 bytes.
-	// In particular, files in Linux's /proc claim size 0 but
-	// then do not work right if read in small pieces,
-	// so an initial read of 1 byte would not work correctly.
-	if size < 512 {
-		size = 512
+	outPath := filepath.Join(tmpDir, path.Base(name))
+	if err = convertItem(s, *item, conv, buf, opts, outPath); err != nil {
+		return false, err
 	}
-
-	data := make([]byte, 0, size)
-	for {
-		if len(data) >= cap(data) {
-			d := append(data[:cap(data)], 0)
-			data = d[:len(data)]
-		}
-		n, err := f.Read(data[len(data):cap(data)])
-		data = data[:len(data)+n]
+	// NOTE(marius): the invalid files are saved with the reason, so they can be inspected, but not dispatched
+	invalid := ""
+	if err = validateContent(typ, outPath); err != nil {
+		log.Printf("Invalid content [%d] %s: %s", item.ID, item.Title, err)
+		invalid = err.Error()
+	}
+	info, err := os.Stat(outPath)
+	if err != nil {
+		return false, err
+	}
+	if contentAddressed(typ) {
+		data, err := os.ReadFile(outPath)
 		if err != nil {
-			if err == io.EOF {
-				err = nil
-			}
-			return data, err
+			return false, err
 		}
-	}
-}
-
-var FileSizeError = fmt.Errorf("file size is smaller than 20%% of average of existing ones")
-
-func ebook(item *Item, typ string) convertFn {
-	fn := typesFunctions[typ]
-	return func(content []byte, title string, author string, outPath string) error {
-		if err := fn(content, title, author, outPath); err != nil {
-			return err
+		compression := opts.Compression
+		if compression == "" {
+			compression = BlobCompression
+		}
+		if name, err = saveCompressedBlob(s, data, typ, compression); err != nil {
+			return false, err
 		}
-		item.Content[typ] = Content{Path: outPath, Type: typ}
-		return nil
+	} else if err = saveFileBlob(s, name, outPath); err != nil {
+		return false, err
+	}
+	item.Content[typ] = Content{
+		Path:    name,
+		Type:    typ,
+		Size:    info.Size(),
+		Version: conv.Version(),
+		Hash:    contentHash(typ, opts),
+		Options: encodeOptions(opts),
+		Invalid: invalid,
 	}
+
+	return true, nil
 }
 
-func html(item *Item, typ string) convertFn {
-	fn := typesFunctions[typ]
-	return func(content []byte, title string, author string, outPath string) error {
-		if err := fn(content, title, author, outPath); err != nil {
+// convertItem writes at outPath the content of the item generated by conv from buf, the content of its dependency.
+func convertItem(s Storage, item Item, conv Converter, buf []byte, opts ConvertOptions, outPath string) error {
+	meta := itemMeta(item)
+	if conv.Dependency() == OutputTypeHTML {
+		dir := filepath.Dir(outPath)
+		var err error
+		if buf, err = embedImages(s, buf, dir, opts); err != nil {
 			return err
 		}
-		if avgSize := feedItemsAverageSize(outPath); len(content)*5 < avgSize {
-			return FileSizeError
+		if err := writeCover(s, item.Feed, itemCoverText(item), opts, dir); err != nil {
+			log.Printf("Unable to generate cover: %s", err)
+		}
+		if st := htmlStats(buf); st.Words > 0 {
+			meta.Description = st.String()
 		}
-		item.Content[typ] = Content{Path: outPath, Type: typ}
-		return nil
+		opts.Language = meta.Language
+		buf = prepareHTML(buf, conv.Type(), opts)
 	}
+	title, author := strings.TrimSpace(item.Title), strings.TrimSpace(item.Author)
+	return conv.Convert([]chapter{{Title: title, Content: buf}}, title, author, meta, opts, outPath)
 }
 
-func getItemContentForType(it Item, typ string) ([]byte, error) {
-	c, ok := it.Content[typ]
+// generateVariant writes in dir the content of type typ of the item generated with the opts options,
+// along with the contents it depends on, down to the content addressed ones which don't depend on them.
+func generateVariant(s Storage, item Item, typ string, opts ConvertOptions, dir string) (string, error) {
+	conv, ok := converters[typ]
 	if !ok {
-		return nil, fmt.Errorf("invalid content of type %s for item %v", typ, it)
+		return "", fmt.Errorf("invalid ebook type %s, valid ones are %v", typ, EbookTypes())
+	}
+	var (
+		buf []byte
+		err error
+	)
+	if dep := conv.Dependency(); contentAddressed(dep) {
+		buf, err = getItemContentForType(s, item, dep)
+	} else {
+		var depPath string
+		if depPath, err = generateVariant(s, item, dep, opts, dir); err == nil {
+			buf, err = os.ReadFile(depPath)
+		}
 	}
-	buf, err := readFile(c.Path)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	return buf, nil
+	outPath := filepath.Join(dir, item.Path(conv.Ext()))
+	return outPath, convertItem(s, item, conv, buf, opts, outPath)
 }
 
-func GenerateContent(typ, basePath string, item *Item, overwrite bool) (bool, error) {
-	if !validEbookType(typ) {
-		return false, fmt.Errorf("invalid ebook type %s, valid ones are %v", typ, ValidEbookTypes)
-	}
-	if c, ok := item.Content[typ]; ok && c.Path != "" {
-		return false, nil
-	}
-	var err error
+// destinationsDir is the directory of the contents generated with the conversion options of a destination.
+const destinationsDir = "destinations"
+
+// generateDestinationContent replaces the contents of the dispatched item with the ones generated with the
+// conversion options overridden by its destination. They are saved in the storage only for being dispatched,
+// so the gc command removes them as they aren't referenced by any content.
+func generateDestinationContent(ctx context.Context, c *sql.DB, s Storage, disp *DispatchItem, opts ConvertOptions) error {
+	it := &disp.Item
+	for typ, cont := range it.Content {
+		if _, ok := converters[typ]; !ok || contentAddressed(typ) {
+			continue
+		}
+		if _, ok := it.Content[OutputTypeHTML]; !ok {
+			if err := loadItemContent(c, it, OutputTypeHTML); err != nil {
+				return err
+			}
+			if err := loadFeedImages(ctx, c, s, &it.Feed); err != nil {
+				log.Printf("Unable to load feed images: %s", err)
+			}
+		}
+		tmpDir, err := os.MkdirTemp("", "feeds-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmpDir)
 
-	outPath := path.Join(basePath, OutputDir, strings.TrimSpace(item.Feed.Title), typ, item.Path(typ))
-	if !path.IsAbs(outPath) {
-		if outPath, err = filepath.Abs(outPath); err != nil {
-			return false, err
+		outPath, err := generateVariant(s, *it, typ, opts, tmpDir)
+		if err != nil {
+			return err
 		}
-	}
-	outDirPath := path.Dir(outPath)
-	if _, err := os.Stat(outDirPath); err != nil && os.IsNotExist(err) {
-		if err = os.MkdirAll(outDirPath, 0755); err != nil {
-			return false, err
+		if err = validateContent(typ, outPath); err != nil {
+			return err
 		}
+		info, err := os.Stat(outPath)
+		if err != nil {
+			return err
+		}
+		name := blobName(OutputDir, it.Feed.Title, destinationsDir, strconv.Itoa(disp.Destination.ID), path.Base(outPath))
+		if err = saveFileBlob(s, name, outPath); err != nil {
+			return err
+		}
+		it.Content[typ] = Content{ID: cont.ID, Path: name, Type: typ, Size: info.Size()}
 	}
-	fi, err := os.Stat(outPath)
-	if err != nil && !os.IsNotExist(err) {
-		return false, err
-	}
-	if ((err != nil && os.IsNotExist(err)) || fi.ModTime().Sub(time.Now()).Truncate(time.Second) == 0) && !overwrite {
-		return false, nil
-	}
-	buf, err := getItemContentForType(*item, typesDependencies[typ])
-	if err != nil {
-		return false, err
-	}
-	fn := mappings[typ](item, typ)
-	if err = fn(buf, strings.TrimSpace(item.Title), strings.TrimSpace(item.Author), outPath); err != nil {
-		return false, err
-	}
-	if _, err := os.Stat(outPath); err != nil {
-		return false, err
-	}
-
-	return true, nil
+	return nil
 }
@@ -0,0 +1,234 @@
+package feeds
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Converter generates a content type of the items from the content of the type it depends on.
+type Converter interface {
+	// Type is the name of the content type generated by the converter.
+	Type() string
+	// Dependency is the content type the converter generates its content from.
+	Dependency() string
+	// Ext is the extension of the generated files.
+	Ext() string
+	// MimeType is the MIME type of the generated files.
+	MimeType() string
+	// Chapters returns if the converter can compile multiple chapters in a single file.
+	Chapters() bool
+	// Version is increased when the output of the converter changes, so the existing contents get reprocessed.
+	Version() int
+	// Convert writes the file at outPath from the chapters, the converters which don't support
+	// multiple chapters receive a single one.
+	Convert(chapters []chapter, title, author string, meta ebookMeta, opts ConvertOptions, outPath string) error
+}
+
+// ConvertOptions are the settings of the conversions, each converter uses the ones applying to its content type.
+// The destinations can override them in the "options" object of their credentials.
+type ConvertOptions struct {
+	// Compression is used for saving the content addressed types, it defaults to BlobCompression.
+	Compression string `json:"compression,omitempty"`
+	// Images enables embedding the downloaded images in the generated files.
+	Images bool `json:"images"`
+	// ImageWidth when not zero is the width the embedded images are scaled down to.
+	ImageWidth int `json:"image_width,omitempty"`
+	// Grayscale enables converting the embedded images to grayscale.
+	Grayscale bool `json:"grayscale,omitempty"`
+	// Cover enables attaching the generated covers.
+	Cover bool `json:"cover"`
+	// Font when not empty is the TrueType font file embedded in the PDF files instead of the Go fonts.
+	Font string `json:"font,omitempty"`
+	// FontSize is the size of the body text of the PDF files in points.
+	FontSize float64 `json:"font_size,omitempty"`
+	// PageSize is the name of the page size of the PDF files from PDFPageSizes.
+	PageSize string `json:"page_size,omitempty"`
+	// Margin is the margin of the pages of the PDF files in millimeters.
+	Margin float64 `json:"margin,omitempty"`
+	// Typography enables the typography pass on the HTML the ebooks are converted from.
+	Typography bool `json:"typography,omitempty"`
+	// Hyphenate enables adding soft hyphens to the long words of the EPUB, AZW3 and MOBI files,
+	// as part of the typography pass.
+	Hyphenate bool `json:"hyphenate,omitempty"`
+	// Stylesheet when not empty is the CSS added to the EPUB and AZW3 files of the feeds without their own one.
+	Stylesheet string `json:"stylesheet,omitempty"`
+	// FeedStylesheet is the CSS of the feed, which is used instead of Stylesheet.
+	FeedStylesheet string `json:"-"`
+	// Selectors are the CSS selectors of the feed used for extracting the readable HTML instead of Readability.
+	Selectors ExtractSelectors `json:"-"`
+	// Cleanup are the rules of the feed applied to the readable HTML.
+	Cleanup CleanupRules `json:"-"`
+	// Language is the language of the item or the volume being converted, which the typography pass uses the quotes of.
+	Language string `json:"-"`
+}
+
+// stylesheet returns the CSS added to the EPUB and AZW3 files.
+func (o ConvertOptions) stylesheet() string {
+	if o.FeedStylesheet != "" {
+		return o.FeedStylesheet
+	}
+	return o.Stylesheet
+}
+
+// stylesheetTypes are the content types the stylesheets are added to.
+var stylesheetTypes = map[string]bool{OutputTypeEPUB: true, OutputTypeAZW3: true}
+
+// DefaultConvertOptions are the options used for generating the contents of the items and the volumes.
+var DefaultConvertOptions = ConvertOptions{
+	Images:   true,
+	Cover:    true,
+	FontSize: 12,
+	PageSize: "remarkable2",
+	Margin:   10,
+}
+
+var (
+	converters     = make(map[string]Converter)
+	converterTypes = make([]string, 0)
+)
+
+// RegisterConverter makes the content type generated by conv available for generation, serving and dispatching.
+func RegisterConverter(conv Converter) {
+	if _, ok := converters[conv.Type()]; !ok {
+		converterTypes = append(converterTypes, conv.Type())
+	}
+	converters[conv.Type()] = conv
+	// NOTE(marius): the types are kept sorted by the length of their dependency chain, so the contents
+	// get generated after the ones they depend on
+	sort.SliceStable(converterTypes, func(i, j int) bool {
+		return converterDepth(converterTypes[i]) < converterDepth(converterTypes[j])
+	})
+}
+
+func converterDepth(typ string) int {
+	depth := 0
+	for conv, ok := converters[typ]; ok && depth < len(converters); conv, ok = converters[typ] {
+		typ = conv.Dependency()
+		depth++
+	}
+	return depth
+}
+
+// ConverterFor returns the converter registered for the content type typ.
+func ConverterFor(typ string) (Converter, bool) {
+	conv, ok := converters[typ]
+	return conv, ok
+}
+
+// EbookTypes returns the registered content types, each one after the type it depends on.
+func EbookTypes() []string {
+	return append([]string(nil), converterTypes...)
+}
+
+// registeredTypes returns the types which have a registered converter.
+func registeredTypes(types ...string) []string {
+	valid := make([]string, 0, len(types))
+	for _, typ := range types {
+		if _, ok := converters[typ]; ok {
+			valid = append(valid, typ)
+		}
+	}
+	return valid
+}
+
+// destinationOptions returns the conversion options of the destination d, and if it sets any of them.
+func destinationOptions(d Destination) (ConvertOptions, bool, error) {
+	opts := DefaultConvertOptions
+	creds := struct {
+		Options json.RawMessage `json:"options"`
+	}{}
+	if err := json.Unmarshal(d.Credentials, &creds); err != nil || len(creds.Options) == 0 || string(creds.Options) == "null" {
+		return opts, false, nil
+	}
+	// NOTE(marius): the defaults depend on the flags of the command doing the dispatch, so only the fields
+	// set by the destination tell if it overrides them
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(creds.Options, &fields); err != nil {
+		return opts, false, fmt.Errorf("invalid options for destination %s[%d]: %w", d.Type, d.ID, err)
+	}
+	if err := json.Unmarshal(creds.Options, &opts); err != nil {
+		return opts, false, fmt.Errorf("invalid options for destination %s[%d]: %w", d.Type, d.ID, err)
+	}
+	return opts, len(fields) > 0, nil
+}
+
+// format is the Converter for the content types generated by the functions of this package.
+type format struct {
+	typ        string
+	dependency string
+	ext        string
+	mimeType   string
+	// version when not zero is the version of the converter, which defaults to 1
+	version int
+	// book compiles the chapters of the ebook types supporting them
+	book bookFn
+	// convert generates the types which don't support chapters
+	convert convertFn
+}
+
+func (f format) Type() string {
+	return f.typ
+}
+
+func (f format) Dependency() string {
+	return f.dependency
+}
+
+func (f format) Ext() string {
+	if f.ext == "" {
+		return f.typ
+	}
+	return f.ext
+}
+
+func (f format) MimeType() string {
+	return f.mimeType
+}
+
+func (f format) Chapters() bool {
+	return f.book != nil
+}
+
+func (f format) Version() int {
+	if f.version == 0 {
+		return 1
+	}
+	return f.version
+}
+
+func (f format) Convert(chapters []chapter, title, author string, meta ebookMeta, opts ConvertOptions, outPath string) error {
+	if f.book != nil {
+		return f.book(chapters, title, author, meta, opts, outPath)
+	}
+	if len(chapters) != 1 {
+		return fmt.Errorf("%s files can't contain %d chapters", f.typ, len(chapters))
+	}
+	return f.convert(chapters[0].Content, title, author, outPath)
+}
+
+// contentHash returns the hash of the options of the feed the content of type typ is generated with: the extraction
+// selectors and the cleanup rules for the readable HTML, the stylesheet for the types using it. The options of the
+// commands are left out, as they aren't known to the other commands checking the contents.
+func contentHash(typ string, opts ConvertOptions) string {
+	var data []byte
+	switch {
+	case typ == OutputTypeHTML:
+		rules := make([]string, 0, len(opts.Cleanup))
+		for _, r := range opts.Cleanup {
+			rules = append(rules, r.Type+" "+r.Value)
+		}
+		data, _ = json.Marshal(struct {
+			Selectors ExtractSelectors
+			Cleanup   []string
+		}{opts.Selectors, rules})
+	case stylesheetTypes[typ]:
+		data, _ = json.Marshal(struct{ Stylesheet string }{opts.FeedStylesheet})
+	default:
+		data, _ = json.Marshal(struct{}{})
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
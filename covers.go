@@ -0,0 +1,348 @@
+package feeds
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	CoverWidth  = 1200
+	CoverHeight = 1800
+
+	coverMargin     = 90
+	coverThumbWidth = 330
+
+	// coverFileName and coverThumbFileName are the files the converters look for, next to the ebook they
+	// generate, to attach as its cover.
+	coverFileName      = "cover.jpg"
+	coverThumbFileName = "cover-thumb.jpg"
+)
+
+var (
+	boldFont, _    = opentype.Parse(gobold.TTF)
+	regularFont, _ = opentype.Parse(goregular.TTF)
+)
+
+// coverText holds the texts rendered on a cover.
+type coverText struct {
+	Feed   string
+	Author string
+	Title  string
+	Index  string
+}
+
+func itemCoverText(it Item) coverText {
+	author := it.Feed.Author
+	if author == "" {
+		author = it.Author
+	}
+	return coverText{
+		Feed:   strings.TrimSpace(it.Feed.Title),
+		Author: strings.TrimSpace(author),
+		Title:  strings.TrimSpace(it.Title),
+		Index:  fmt.Sprintf("#%d", it.FeedIndex),
+	}
+}
+
+func volumeCoverText(v Volume) coverText {
+	author := v.Feed.Author
+	if author == "" && len(v.Items) > 0 {
+		author = v.Items[0].Author
+	}
+	title := strings.TrimSpace(strings.TrimPrefix(v.Title, v.Feed.Title))
+	return coverText{
+		Feed:   strings.TrimSpace(v.Feed.Title),
+		Author: strings.TrimSpace(author),
+		Title:  strings.Trim(title, " -"),
+		Index:  fmt.Sprintf("#%d-%d", v.First, v.Last),
+	}
+}
+
+// coverColors are dark enough for the white text to be readable over them.
+var coverColors = []color.RGBA{
+	{R: 0x1f, G: 0x3a, B: 0x5f, A: 0xff},
+	{R: 0x5c, G: 0x1f, B: 0x2e, A: 0xff},
+	{R: 0x1e, G: 0x4d, B: 0x3a, A: 0xff},
+	{R: 0x4a, G: 0x2c, B: 0x5e, A: 0xff},
+	{R: 0x6b, G: 0x3a, B: 0x16, A: 0xff},
+	{R: 0x15, G: 0x4c, B: 0x55, A: 0xff},
+	{R: 0x3d, G: 0x3d, B: 0x3d, A: 0xff},
+	{R: 0x58, G: 0x4a, B: 0x12, A: 0xff},
+}
+
+// coverColor returns the background color of the covers of a feed without a base image, derived from its title
+// so all the ebooks of the same feed look alike.
+func coverColor(feed string) color.RGBA {
+	h := fnv.New32a()
+	h.Write([]byte(feed))
+	return coverColors[h.Sum32()%uint32(len(coverColors))]
+}
+
+// renderCover draws a cover containing the texts of t over the base image, which is scaled to fill it,
+// or over a background colored after the feed, with the icon of the feed in the middle.
+func renderCover(t coverText, base, icon image.Image) (image.Image, error) {
+	if boldFont == nil || regularFont == nil {
+		return nil, errors.New("unable to load cover fonts")
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, CoverWidth, CoverHeight))
+	if base != nil {
+		fillImage(dst, base)
+		// NOTE(marius): darken the base image, so the white text is readable over it
+		shade := image.NewUniform(color.RGBA{A: 0x90})
+		draw.Draw(dst, dst.Bounds(), shade, image.Point{}, draw.Over)
+	} else {
+		bg := coverColor(t.Feed)
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+		band := image.Rect(0, CoverHeight*2/3, CoverWidth, CoverHeight)
+		draw.Draw(dst, band, image.NewUniform(color.RGBA{A: 0x50}), image.Point{}, draw.Over)
+	}
+
+	y := coverMargin
+	y = drawText(dst, boldFont, 84, t.Feed, y, 3)
+	y += coverMargin / 2
+	draw.Draw(dst, image.Rect(coverMargin, y, CoverWidth-coverMargin, y+6), image.White, image.Point{}, draw.Src)
+	y += coverMargin
+
+	if icon != nil && base == nil {
+		const size = 360
+		box := image.Rect((CoverWidth-size)/2, y, (CoverWidth+size)/2, y+size)
+		draw.CatmullRom.Scale(dst, fitRect(box, icon.Bounds()), icon, icon.Bounds(), draw.Over, nil)
+		y += size + coverMargin/2
+	}
+	if t.Index != "" {
+		drawText(dst, boldFont, 180, t.Index, y, 1)
+	}
+
+	y = CoverHeight*2/3 + coverMargin
+	drawText(dst, regularFont, 72, t.Title, y, 4)
+	if t.Author != "" {
+		drawText(dst, regularFont, 52, t.Author, CoverHeight-coverMargin-52, 1)
+	}
+	return dst, nil
+}
+
+// fillImage scales src to cover the whole of dst, cropping what doesn't fit its aspect ratio.
+func fillImage(dst draw.Image, src image.Image) {
+	sb, db := src.Bounds(), dst.Bounds()
+	crop := sb
+	if sb.Dx()*db.Dy() > sb.Dy()*db.Dx() {
+		w := sb.Dy() * db.Dx() / db.Dy()
+		crop.Min.X += (sb.Dx() - w) / 2
+		crop.Max.X = crop.Min.X + w
+	} else {
+		h := sb.Dx() * db.Dy() / db.Dx()
+		crop.Min.Y += (sb.Dy() - h) / 2
+		crop.Max.Y = crop.Min.Y + h
+	}
+	draw.CatmullRom.Scale(dst, db, src, crop, draw.Src, nil)
+}
+
+// fitRect returns the largest rectangle centered in box with the aspect ratio of r.
+func fitRect(box, r image.Rectangle) image.Rectangle {
+	w, h := box.Dx(), box.Dy()
+	if r.Dx()*h > r.Dy()*w {
+		h = r.Dy() * w / r.Dx()
+	} else {
+		w = r.Dx() * h / r.Dy()
+	}
+	x, y := box.Min.X+(box.Dx()-w)/2, box.Min.Y+(box.Dy()-h)/2
+	return image.Rect(x, y, x+w, y+h)
+}
+
+// drawText draws text centered horizontally, wrapped to at most maxLines lines, with the top of the first one at y.
+// It returns the position below the last line.
+func drawText(dst draw.Image, f *opentype.Font, size float64, text string, y, maxLines int) int {
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		log.Printf("Unable to load font face: %s", err)
+		return y
+	}
+	defer face.Close()
+
+	lineHeight := face.Metrics().Height.Ceil()
+	ascent := face.Metrics().Ascent.Ceil()
+	d := font.Drawer{Dst: dst, Src: image.White, Face: face}
+	for _, line := range wrapText(face, text, CoverWidth-2*coverMargin, maxLines) {
+		w := d.MeasureString(line).Ceil()
+		d.Dot = fixed.P((CoverWidth-w)/2, y+ascent)
+		d.DrawString(line)
+		y += lineHeight
+	}
+	return y
+}
+
+// wrapText splits text in lines narrower than width, the last of maxLines lines is shortened if needed.
+func wrapText(face font.Face, text string, width, maxLines int) []string {
+	lines := make([]string, 0)
+	line := ""
+	for _, word := range strings.Fields(text) {
+		next := strings.TrimSpace(line + " " + word)
+		if line != "" && font.MeasureString(face, next).Ceil() > width {
+			lines = append(lines, line)
+			line = word
+			continue
+		}
+		line = next
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	if len(lines) <= maxLines {
+		return lines
+	}
+	lines = lines[:maxLines]
+	last := []rune(lines[maxLines-1])
+	for len(last) > 0 && font.MeasureString(face, string(last)+"…").Ceil() > width {
+		last = last[:len(last)-1]
+	}
+	lines[maxLines-1] = strings.TrimSpace(string(last)) + "…"
+	return lines
+}
+
+// loadFeedImages loads the names of the base cover image and of the icon of the feed,
+// downloading the image of the RSS channel to the storage if it wasn't saved yet.
+func loadFeedImages(ctx context.Context, c *sql.DB, s Storage, f *Feed) error {
+	var imageURL, icon, cover sql.NullString
+	err := c.QueryRow(`SELECT image_url, icon, cover FROM feeds WHERE id = ?;`, f.ID).Scan(&imageURL, &icon, &cover)
+	if err != nil {
+		return err
+	}
+	f.ImageURL, f.Icon, f.Cover = imageURL.String, icon.String, cover.String
+	if f.Icon != "" || f.ImageURL == "" || !DownloadImages {
+		return nil
+	}
+	name, _, _, err := downloadImage(ctx, s, f.ImageURL)
+	if err != nil {
+		return fmt.Errorf("unable to download feed image %s: %w", f.ImageURL, err)
+	}
+	if _, err = c.Exec(`UPDATE feeds SET icon = ? WHERE id = ?;`, name, f.ID); err != nil {
+		return err
+	}
+	f.Icon = name
+	return nil
+}
+
+// SaveFeedCover saves to the storage the base image of the covers of the feed.
+func SaveFeedCover(c *sql.DB, s Storage, f Feed, data []byte) error {
+	mimeType := http.DetectContentType(data)
+	ext, ok := imageExt[mimeType]
+	if !ok {
+		return fmt.Errorf("unsupported image type %s", mimeType)
+	}
+	if _, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("invalid image: %w", err)
+	}
+	name := imageName(data, ext)
+	if !blobExists(s, name) {
+		if err := s.Save(name, bytes.NewReader(data)); err != nil {
+			return err
+		}
+	}
+	_, err := c.Exec(`UPDATE feeds SET cover = ? WHERE id = ?;`, name, f.ID)
+	return err
+}
+
+// FeedCover returns the JPEG encoded cover of the feed, as it appears on its ebooks, without an item title.
+func FeedCover(ctx context.Context, c *sql.DB, s Storage, f Feed) ([]byte, error) {
+	if err := loadFeedImages(ctx, c, s, &f); err != nil {
+		log.Printf("Unable to load images for feed %s: %s", f.Title, err)
+	}
+	img, err := feedCover(s, f, coverText{Feed: f.Title, Author: f.Author})
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.Buffer{}
+	if err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func feedCover(s Storage, f Feed, t coverText) (image.Image, error) {
+	var base, icon image.Image
+	if f.Cover != "" {
+		base = loadStorageImage(s, f.Cover)
+	}
+	if f.Icon != "" && base == nil {
+		icon = loadStorageImage(s, f.Icon)
+	}
+	return renderCover(t, base, icon)
+}
+
+func loadStorageImage(s Storage, name string) image.Image {
+	data, err := loadBlob(s, name)
+	if err != nil {
+		log.Printf("Unable to load image %s: %s", name, err)
+		return nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Unable to decode image %s: %s", name, err)
+		return nil
+	}
+	return img
+}
+
+// writeCover saves in dir the cover and its thumbnail, which the converters attach to the ebooks they generate there.
+func writeCover(s Storage, f Feed, t coverText, opts ConvertOptions, dir string) error {
+	if !opts.Cover {
+		return nil
+	}
+	img, err := feedCover(s, f, t)
+	if err != nil {
+		return err
+	}
+	img = processImage(img, opts)
+	if err = writeJPEG(filepath.Join(dir, coverFileName), img); err != nil {
+		return err
+	}
+	b := img.Bounds()
+	thumb := image.NewRGBA(image.Rect(0, 0, coverThumbWidth, b.Dy()*coverThumbWidth/b.Dx()))
+	draw.CatmullRom.Scale(thumb, thumb.Bounds(), img, b, draw.Src, nil)
+	return writeJPEG(filepath.Join(dir, coverThumbFileName), thumb)
+}
+
+func writeJPEG(p string, img image.Image) error {
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	if err = jpeg.Encode(f, img, &jpeg.Options{Quality: 85}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ebookCover returns the paths of the cover and of its thumbnail, if they were saved by writeCover
+// next to the ebook at outPath.
+func ebookCover(outPath string) (string, string, bool) {
+	dir := filepath.Dir(outPath)
+	cover, thumb := filepath.Join(dir, coverFileName), filepath.Join(dir, coverThumbFileName)
+	if _, err := os.Stat(cover); err != nil {
+		return "", "", false
+	}
+	if _, err := os.Stat(thumb); err != nil {
+		return "", "", false
+	}
+	return cover, thumb, true
+}
@@ -6,7 +6,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"log"
 	"net/http"
 	"net/url"
 	"os"
@@ -24,7 +25,31 @@ const (
 	FlagsNone = 0
 )
 
-func DB(basePath string) (*sql.DB, error) {
+// DB opens the storage database: a PostgreSQL one when dsn is a postgres:// URL,
+// or the SQLite file in basePath otherwise.
+func DB(basePath, dsn string) (*sql.DB, error) {
+	var (
+		db  *sql.DB
+		err error
+	)
+	if isPostgresDSN(dsn) {
+		db, err = openPostgres(dsn)
+	} else {
+		db, err = openSQLite(basePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = upgradeTables(db); err != nil {
+		return nil, err
+	}
+	if err = relativizeContentPaths(db, basePath); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func openSQLite(basePath string) (*sql.DB, error) {
 	dbPath := path.Join(basePath, DBFilePath)
 	bootstrap := false
 	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
@@ -43,6 +68,19 @@ func DB(basePath string) (*sql.DB, error) {
 	return db, nil
 }
 
+// relativizeContentPaths converts the absolute paths of the contents saved by older versions
+// to names relative to the basePath storage root.
+func relativizeContentPaths(c *sql.DB, basePath string) error {
+	root, err := filepath.Abs(basePath)
+	if err != nil {
+		return err
+	}
+	root = strings.TrimRight(filepath.ToSlash(root), "/") + "/"
+	upd := `UPDATE contents SET path = substr(path, ?) WHERE path LIKE ?;`
+	_, err = c.Exec(upd, len(root)+1, root+"%")
+	return err
+}
+
 func createTables(c *sql.DB) error {
 	feeds := `CREATE TABLE feeds (
 		id INTEGER PRIMARY KEY ASC AUTOINCREMENT,
@@ -159,8 +197,8 @@ func sanitizeFileName(name string) string {
 	return strings.ReplaceAll(name, "/", "-")
 }
 
-func LoadItem(it *Item, c *sql.DB, basePath string) (bool, error) {
-	contentIns := `INSERT INTO contents (item_id, path, type) VALUES(?, ?, ?);`
+func LoadItem(ctx context.Context, it *Item, c *sql.DB, s Storage) (bool, error) {
+	contentIns := `INSERT INTO contents (item_id, path, type, size, created, charset) VALUES(?, ?, ?, ?, ?, ?);`
 	ins, err := c.Prepare(contentIns)
 	if err != nil {
 		return false, err
@@ -175,12 +213,16 @@ func LoadItem(it *Item, c *sql.DB, basePath string) (bool, error) {
 	defer upd.Close()
 
 	link := it.URL.String()
-	if !path.IsAbs(basePath) {
-		basePath, _ = filepath.Abs(basePath)
-	}
 
 	if len(it.Content) == 0 {
-		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, link, nil)
+		sel, err := LoadFeedSelectors(c, it.Feed.ID)
+		if err != nil {
+			return false, err
+		}
+		ctx, cancel := context.WithTimeout(ctx, FetchTimeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
 		if err != nil {
 			return false, err
 		}
@@ -196,35 +238,28 @@ func LoadItem(it *Item, c *sql.DB, basePath string) (bool, error) {
 			return false, fmt.Errorf("invalid response received %s", res.Status)
 		}
 		it.Status = res.StatusCode
-		data, err := ioutil.ReadAll(res.Body)
+		data, err := io.ReadAll(res.Body)
 		if err != nil {
 			return false, err
 		}
-
-		// write received html to path
-		feedPath := path.Join(basePath, HtmlDir, sanitizeFileName(it.Feed.Title))
-		articlePath := path.Join(feedPath, it.Path("html"))
-		if _, err := os.Stat(feedPath); err != nil && os.IsNotExist(err) {
-			if err = os.MkdirAll(feedPath, 0755); err != nil {
-				return false, err
-			}
+		data, cs, err := ToUTF8(data, res.Header.Get("Content-Type"))
+		if err != nil {
+			return false, fmt.Errorf("unable to decode %s content: %w", cs, err)
 		}
 
-		if avgSize := feedItemsAverageSize(feedPath); len(data)*5 < avgSize {
-			MarkItemsAsFailed(c, *it)
-			return false, FileSizeError
+		// write received html to storage
+		articlePath, err := saveContentBlob(s, data, "html")
+		if err != nil {
+			return false, err
 		}
-
-		if err = ioutil.WriteFile(articlePath, data, 0644); err != nil {
+		if _, err = ins.Exec(it.ID, sql.NullString{String: articlePath, Valid: len(articlePath) > 0}, OutputTypeRAW, len(data), time.Now().UTC().Format(time.RFC3339), cs); err != nil {
 			return false, err
 		}
-		if _, err = ins.Exec(it.ID, sql.NullString{String: articlePath, Valid: len(articlePath) > 0}, "raw"); err != nil {
+		if err = updateFeedStats(c, it.Feed.ID, OutputTypeRAW, int64(len(data))); err != nil {
 			return false, err
 		}
-		doc, err := Readability(data)
-		if err == nil {
-			doc.Content()
-			it.Title = doc.Title
+		if title, _, err := ReadableContent(data, sel); err == nil {
+			it.Title = title
 		}
 	}
 
@@ -234,25 +269,110 @@ func LoadItem(it *Item, c *sql.DB, basePath string) (bool, error) {
 	return true, nil
 }
 
-func feedItemsAverageSize(path string) int {
-	var sum, cnt int64
+// ContentStats holds the number and total size of the contents of one type belonging to a feed.
+type ContentStats struct {
+	Count int
+	Size  int64
+}
 
-	filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return nil
-		}
-		sum += info.Size()
-		cnt++
-		return nil
-	})
-	if sum == 0 || cnt == 0 {
+// Average returns the average size of the contents, or -1 if there are none.
+func (s ContentStats) Average() int64 {
+	if s.Count == 0 || s.Size == 0 {
 		return -1
 	}
-	return int(sum / cnt)
+	return s.Size / int64(s.Count)
+}
+
+func LoadFeedStats(c *sql.DB, feedID int, typ string) (ContentStats, error) {
+	sel := `SELECT count, size FROM feed_stats WHERE feed_id = ? AND type = ?;`
+	stats := ContentStats{}
+	err := c.QueryRow(sel, feedID, typ).Scan(&stats.Count, &stats.Size)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return stats, err
+	}
+	return stats, nil
+}
+
+func updateFeedStats(c *sql.DB, feedID int, typ string, size int64) error {
+	upd := `INSERT INTO feed_stats (feed_id, type, count, size) VALUES (?, ?, 1, ?)
+ON CONFLICT (feed_id, type) DO UPDATE SET count = feed_stats.count + 1, size = feed_stats.size + excluded.size;`
+	_, err := c.Exec(upd, feedID, typ, size)
+	return err
+}
+
+// UpdateContentSizes fills the sizes of the contents saved before they were recorded, from their files in s,
+// and recomputes the feed statistics from them. It returns the number of updated contents.
+func UpdateContentSizes(c *sql.DB, s Storage) (int, error) {
+	sel := `SELECT id, path, type FROM contents WHERE size IS NULL AND path IS NOT NULL;`
+	rows, err := c.Query(sel)
+	if err != nil {
+		return 0, err
+	}
+	all := make([]Content, 0)
+	for rows.Next() {
+		cont := Content{}
+		if err = rows.Scan(&cont.ID, &cont.Path, &cont.Type); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		all = append(all, cont)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(all) == 0 {
+		return 0, nil
+	}
+
+	upd := `UPDATE contents SET size = ? WHERE id = ?;`
+	updated := 0
+	for _, cont := range all {
+		// NOTE(marius): the content addressed files are compressed, their size is the one of the decompressed data
+		if contentAddressed(cont.Type) {
+			data, err := LoadContent(s, cont)
+			if err != nil {
+				log.Printf("Unable to load content %d %s: %s", cont.ID, cont.Path, err)
+				continue
+			}
+			cont.Size = int64(len(data))
+		} else {
+			info, err := s.Stat(cont.Path)
+			if err != nil {
+				log.Printf("Unable to stat content %d %s: %s", cont.ID, cont.Path, err)
+				continue
+			}
+			cont.Size = info.Size
+		}
+		if _, err = c.Exec(upd, cont.Size, cont.ID); err != nil {
+			return updated, err
+		}
+		updated++
+	}
+	return updated, recomputeFeedStats(c)
+}
+
+// recomputeFeedStats replaces the feed statistics with the count and size of the contents of every feed.
+func recomputeFeedStats(c *sql.DB) error {
+	tx, err := c.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`DELETE FROM feed_stats;`); err != nil {
+		return err
+	}
+	ins := `INSERT INTO feed_stats (feed_id, type, count, size) SELECT items.feed_id, contents.type, COUNT(*), COALESCE(SUM(contents.size), 0)
+FROM contents INNER JOIN items ON items.id = contents.item_id GROUP BY items.feed_id, contents.type;`
+	if _, err = tx.Exec(ins); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func SaveFeeds(c *sql.DB, feeds ...Feed) error {
-	ins := `INSERT INTO feeds (title, frequency, author, url, flags) VALUES(?, ?, ?, ?, ?) ON CONFLICT(url) DO NOTHING;`
+	ins := `INSERT INTO feeds (title, frequency, author, url, flags, language) VALUES(?, ?, ?, ?, ?, ?) ON CONFLICT(url) DO NOTHING;`
 	s, err := c.Prepare(ins)
 	if err != nil {
 		return err
@@ -261,7 +381,8 @@ func SaveFeeds(c *sql.DB, feeds ...Feed) error {
 
 	multi := make([]error, 0)
 	for _, f := range feeds {
-		if _, err := s.Exec(f.Title, f.Frequency.Seconds(), f.Author, f.URL.String(), f.Flags); err != nil {
+		lang := sql.NullString{String: f.Language, Valid: f.Language != ""}
+		if _, err := s.Exec(f.Title, f.Frequency.Seconds(), f.Author, f.URL.String(), f.Flags, lang); err != nil {
 			multi = append(multi, fmt.Errorf("unable to save feed %s: %w", f.Title, err))
 		}
 	}
@@ -272,7 +393,7 @@ func SaveFeeds(c *sql.DB, feeds ...Feed) error {
 }
 
 func GetFeeds(c *sql.DB) ([]Feed, error) {
-	sel := `SELECT id, title, author, frequency, last_loaded, url, flags FROM feeds where flags != ?`
+	sel := `SELECT id, title, author, frequency, last_loaded, url, flags, image_url, icon, cover, language FROM feeds where flags != ?`
 	s, err := c.Query(sel, FlagsDisabled)
 	if err != nil {
 		return nil, err
@@ -282,18 +403,24 @@ func GetFeeds(c *sql.DB) ([]Feed, error) {
 	all := make([]Feed, 0)
 	for s.Next() {
 		var (
-			id, flags     int
-			freq          sql.NullInt32
-			title, auth   string
-			link, updated sql.NullString
+			id, flags                int
+			freq                     sql.NullInt32
+			title, auth              string
+			link, updated            sql.NullString
+			imageURL, icon, coverImg sql.NullString
+			lang                     sql.NullString
 		)
-		s.Scan(&id, &title, &auth, &freq, &updated, &link, &flags)
+		s.Scan(&id, &title, &auth, &freq, &updated, &link, &flags, &imageURL, &icon, &coverImg, &lang)
 		f := Feed{
 			ID:        id,
 			Title:     title,
 			Author:    auth,
 			Frequency: time.Duration(freq.Int32) * time.Second,
 			Flags:     flags,
+			ImageURL:  imageURL.String,
+			Icon:      icon.String,
+			Cover:     coverImg.String,
+			Language:  lang.String,
 		}
 		if updated.Valid {
 			f.Updated, _ = time.Parse(time.RFC3339Nano, updated.String)
@@ -404,20 +531,58 @@ type DispatchItem struct {
 
 var subscriptionBackPeriod = 7 * 24 * time.Hour
 
+// loadDestinations loads all the destinations.
+func loadDestinations(c *sql.DB) ([]Destination, error) {
+	s, err := c.Query(`SELECT id, type, credentials, flags FROM destinations ORDER BY id;`)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	all := make([]Destination, 0)
+	for s.Next() {
+		d := Destination{}
+		if err = s.Scan(&d.ID, &d.Type, &d.Credentials, &d.Flags); err != nil {
+			return nil, err
+		}
+		all = append(all, d)
+	}
+	return all, s.Err()
+}
+
 func GetNonDispatchedItemContentsForDestination(c *sql.DB) ([]DispatchItem, error) {
-	wheres := make([]string, 0)
-	params := make([]interface{}, 0)
-	for typ, t := range ValidTargets {
-		wheres = append(wheres, fmt.Sprintf("d.type = '%s' AND c.type IN ('%s')", typ, strings.Join(t.ValidContentTypes(), "', '")))
+	dests, err := loadDestinations(c)
+	if err != nil {
+		return nil, err
 	}
-	sel := fmt.Sprintf(`SELECT t.id, c.id, i.id, f.title, i.title, i.author, i.url, c.path, c.type, d.id, d.type, d.credentials, d.flags FROM items i
+	wheres := make([]string, 0)
+	params := []interface{}{FlagsDisabled}
+	for _, d := range dests {
+		typ := destinationType(d)
+		if typ == "" || d.Flags&FlagsDisabled == FlagsDisabled {
+			continue
+		}
+		wheres = append(wheres, "(d.id = ? AND c.type = ?)")
+		params = append(params, d.ID, typ)
+	}
+	if len(wheres) == 0 {
+		return make([]DispatchItem, 0), nil
+	}
+	// NOTE(marius): the window keeps one row for each item and destination, on both SQLite and PostgreSQL, which
+	// don't agree on selecting the columns outside of a GROUP BY
+	sel := fmt.Sprintf(`SELECT * FROM (SELECT t.id AS target_id, c.id AS content_id, i.id AS item_id, i.feed_index, i.guid, i.published_date,
+	i.language, f.id AS feed_id, f.title AS feed_title, f.author AS feed_author, f.language AS feed_language, i.title, i.author, i.url,
+	c.path, c.type, d.id AS destination_id, d.type AS destination_type, d.credentials, d.flags, s.languages,
+	ROW_NUMBER() OVER (PARTITION BY i.id, d.id ORDER BY t.id, c.id, s.id) AS n
+FROM items i
 INNER JOIN feeds f ON i.feed_id = f.id
-INNER JOIN subscriptions s ON f.id = s.feed_id
+INNER JOIN subscriptions s ON f.id = s.feed_id AND s.volume_size = 0
 INNER JOIN destinations d ON d.id = s.destination_id
-INNER JOIN contents c ON c.item_id = i.id AND (%s)
-LEFT JOIN dispatched t ON t.item_id = i.id AND t.destination_id = d.id  
-WHERE date(i.last_loaded) > date(c.created, '-%f hour') AND (t.id IS NULL OR (t.id IS NOT NULL AND t.last_status = 0))
-GROUP BY i.id, d.type, d.id ORDER BY i.id;`, strings.Join(wheres, " OR "), subscriptionBackPeriod.Hours())
+INNER JOIN contents c ON c.item_id = i.id AND c.flags != ? AND COALESCE(c.invalid, '') = '' AND (%s)
+LEFT JOIN dispatched t ON t.item_id = i.id AND t.destination_id = d.id
+WHERE %s > %s AND (t.id IS NULL OR (t.id IS NOT NULL AND t.last_status = ?))) AS pending
+WHERE n = 1 ORDER BY item_id, destination_id;`, strings.Join(wheres, " OR "), sqlDate(c, "i.last_loaded", 0), sqlDate(c, "c.created", subscriptionBackPeriod))
+	params = append(params, false)
 
 	s, err := c.Query(sel, params...)
 	if err != nil {
@@ -433,15 +598,27 @@ GROUP BY i.id, d.type, d.id ORDER BY i.id;`, strings.Join(wheres, " OR "), subsc
 			contType, contPath, itURL string
 			contID                    int
 			targetID                  sql.NullInt32
+			guid, published           sql.NullString
+			feedAuthor                sql.NullString
+			lang, feedLang, languages sql.NullString
+			n                         int
 		)
-		err := s.Scan(&targetID, &contID, &it.ID, &it.Feed.Title, &it.Title, &it.Author, &itURL, &contPath, &contType, &dest.ID, &dest.Type, &dest.Credentials, &dest.Flags)
+		err := s.Scan(&targetID, &contID, &it.ID, &it.FeedIndex, &guid, &published, &lang, &it.Feed.ID, &it.Feed.Title, &feedAuthor, &feedLang,
+			&it.Title, &it.Author, &itURL, &contPath, &contType, &dest.ID, &dest.Type, &dest.Credentials, &dest.Flags, &languages, &n)
 		if err != nil {
 			continue
 		}
 		if dest.Flags&FlagsDisabled == FlagsDisabled {
 			continue
 		}
+		it.Language, it.Feed.Language = lang.String, feedLang.String
+		if !languageMatches(it, ParseLanguages(languages.String)) {
+			continue
+		}
 		it.URL, _ = url.Parse(itURL)
+		it.GUID = guid.String
+		it.Published, _ = time.Parse(time.RFC3339Nano, published.String)
+		it.Feed.Author = feedAuthor.String
 		it.Content[contType] = Content{ID: contID, Path: contPath, Type: contType}
 		dd := DispatchItem{
 			Item:        it,
@@ -455,6 +632,17 @@ GROUP BY i.id, d.type, d.id ORDER BY i.id;`, strings.Join(wheres, " OR "), subsc
 	return all, nil
 }
 
+// loadItemContent loads the content of type typ of the item.
+func loadItemContent(c *sql.DB, it *Item, typ string) error {
+	cont := Content{Type: typ}
+	sel := `SELECT id, path, flags FROM contents WHERE item_id = ? AND type = ? AND path IS NOT NULL;`
+	if err := c.QueryRow(sel, it.ID, typ).Scan(&cont.ID, &cont.Path, &cont.Flags); err != nil {
+		return fmt.Errorf("unable to load %s content of item %d: %w", typ, it.ID, err)
+	}
+	it.Content[typ] = cont
+	return nil
+}
+
 func GetContentsForEbook(c *sql.DB, types ...string) ([]Item, error) {
 	joins := make([]string, 0)
 	cols := make([]string, 0)
@@ -466,12 +654,13 @@ func GetContentsForEbook(c *sql.DB, types ...string) ([]Item, error) {
 	wheres = append(wheres, "TRUE")
 
 	sel := `
-SELECT items.id, items.feed_index, feeds.title, items.title, items.author, raw.id, raw.type, raw.path, %s FROM items
+SELECT items.id, items.feed_index, feeds.id, feeds.title, feeds.author, feeds.url, feeds.language, items.title, items.author, items.guid, items.url,
+	items.published_date, items.language, raw.id, raw.type, raw.path, %s FROM items
 	INNER JOIN feeds ON feeds.id = items.feed_id
 	INNER JOIN contents AS raw ON items.id = raw.item_id AND raw.type = 'raw'
-%s WHERE %s`
+%s WHERE (%s) AND (items.quality IS NULL OR items.quality != ?)`
 	q := fmt.Sprintf(sel, strings.Join(cols, ", "), strings.Join(joins, ""), strings.Join(wheres, " OR "))
-	s1, err := c.Query(q)
+	s1, err := c.Query(q, QualityRejected)
 	if err != nil {
 		return nil, err
 	}
@@ -481,14 +670,17 @@ SELECT items.id, items.feed_index, feeds.title, items.title, items.author, raw.i
 	itemIds := make([]string, 0)
 	for s1.Next() {
 		var (
-			id, feedIndex            int
+			id, feedIndex, feedID    int
 			feedTitle, title, author string
+			feedAuthor, feedURL      sql.NullString
+			guid, itemURL, published sql.NullString
+			feedLang, lang           sql.NullString
 			rawId                    sql.NullInt32
 			it                       Item
 			ok                       bool
 			rawType, rawPath         sql.NullString
 		)
-		params := []interface{}{&id, &feedIndex, &feedTitle, &title, &author, &rawId, &rawType, &rawPath}
+		params := []interface{}{&id, &feedIndex, &feedID, &feedTitle, &feedAuthor, &feedURL, &feedLang, &title, &author, &guid, &itemURL, &published, &lang, &rawId, &rawType, &rawPath}
 		paths := make(map[string]sql.NullString)
 		for _, typ := range types {
 			params = append(params, interface{}(paths[typ]))
@@ -496,12 +688,19 @@ SELECT items.id, items.feed_index, feeds.title, items.title, items.author, raw.i
 		s1.Scan(params...)
 		if it, ok = all[id]; !ok || it.ID != id {
 			it = Item{
-				ID:     id,
-				Title:  title,
-				Author: author,
-				Feed:   Feed{Title: feedTitle},
+				ID:       id,
+				Title:    title,
+				Author:   author,
+				GUID:     guid.String,
+				Language: lang.String,
+				Feed:     Feed{ID: feedID, Title: feedTitle, Author: feedAuthor.String, Language: feedLang.String},
 			}
 			it.FeedIndex = feedIndex
+			it.URL, _ = url.Parse(itemURL.String)
+			it.Published, _ = time.Parse(time.RFC3339Nano, published.String)
+			if feedURL.Valid {
+				it.Feed.URL, _ = url.Parse(feedURL.String)
+			}
 			if rawId.Valid {
 				it.Content = make(map[string]Content)
 				it.Content["raw"] = Content{ID: int(rawId.Int32), Type: rawType.String, Path: rawPath.String}
@@ -516,7 +715,7 @@ SELECT items.id, items.feed_index, feeds.title, items.title, items.author, raw.i
 		all[it.ID] = it
 	}
 	contWhere := strings.Join(itemIds, ", ")
-	selCont := fmt.Sprintf(`SELECT id, item_id, path, type from contents where item_id in (%s) and type != 'raw';`, contWhere)
+	selCont := fmt.Sprintf(`SELECT id, item_id, path, type, flags from contents where item_id in (%s) and type != 'raw';`, contWhere)
 	s2, err := c.Query(selCont)
 	if err != nil {
 		return nil, err
@@ -525,11 +724,11 @@ SELECT items.id, items.feed_index, feeds.title, items.title, items.author, raw.i
 
 	for s2.Next() {
 		var (
-			id, itemId int
-			path, typ  string
-			ok         bool
+			id, itemId, flags int
+			path, typ         string
+			ok                bool
 		)
-		s2.Scan(&id, &itemId, &path, &typ)
+		s2.Scan(&id, &itemId, &path, &typ, &flags)
 		item, ok := all[itemId]
 		if !ok {
 			// TODO(marius) missing item, error
@@ -537,7 +736,7 @@ SELECT items.id, items.feed_index, feeds.title, items.title, items.author, raw.i
 		if item.Content == nil {
 			item.Content = make(map[string]Content)
 		}
-		item.Content[typ] = Content{ID: id, Path: path, Type: typ}
+		item.Content[typ] = Content{ID: id, Path: path, Type: typ, Flags: flags}
 		all[itemId] = item
 	}
 
@@ -549,7 +748,7 @@ SELECT items.id, items.feed_index, feeds.title, items.title, items.author, raw.i
 }
 
 func GetItemsByFeedAndType(c *sql.DB, f Feed, ext string) ([]Item, error) {
-	sel := `SELECT items.id, feeds.title, items.title, items.author, items.published_date, items.last_loaded, items.feed_index FROM items 
+	sel := `SELECT items.id, feeds.title, items.title, items.author, items.published_date, items.last_loaded, items.feed_index, items.quality, items.quality_reason, items.words, items.characters, items.language FROM items 
 INNER JOIN feeds ON feeds.id = items.feed_id 
 WHERE items.feed_id = ? ORDER BY items.feed_index ASC;`
 
@@ -565,22 +764,25 @@ WHERE items.feed_id = ? ORDER BY items.feed_index ASC;`
 		var (
 			id                       int
 			feedIndex                sql.NullInt32
-			updated, published       sql.NullTime
+			updated, published       sql.NullString
 			feedTitle, title, author string
+			quality, reason          sql.NullString
+			words, characters        sql.NullInt32
+			lang                     sql.NullString
 		)
-		s.Scan(&id, &feedTitle, &title, &author, &published, &updated, &feedIndex)
+		s.Scan(&id, &feedTitle, &title, &author, &published, &updated, &feedIndex, &quality, &reason, &words, &characters, &lang)
 		it := Item{
-			ID:     id,
-			Title:  title,
-			Author: author,
-			Feed:   Feed{Title: feedTitle},
-		}
-		if published.Valid {
-			it.Published = published.Time
-		}
-		if updated.Valid {
-			it.Updated = updated.Time
+			ID:            id,
+			Title:         title,
+			Author:        author,
+			Feed:          Feed{Title: feedTitle},
+			Quality:       quality.String,
+			QualityReason: reason.String,
+			Reading:       ReadingStats{Words: int(words.Int32), Characters: int(characters.Int32)},
+			Language:      lang.String,
 		}
+		it.Published, _ = time.Parse(time.RFC3339Nano, published.String)
+		it.Updated, _ = time.Parse(time.RFC3339Nano, updated.String)
 		if feedIndex.Valid {
 			it.FeedIndex = int(feedIndex.Int32)
 		}
@@ -589,7 +791,7 @@ WHERE items.feed_id = ? ORDER BY items.feed_index ASC;`
 	}
 
 	contWhere := strings.Join(itemIds, ", ")
-	selCont := fmt.Sprintf(`SELECT id, item_id, path, type from contents where item_id in (%s);`, contWhere)
+	selCont := fmt.Sprintf(`SELECT id, item_id, path, type, invalid from contents where item_id in (%s);`, contWhere)
 	s2, err := c.Query(selCont)
 	if err != nil {
 		return nil, err
@@ -600,9 +802,10 @@ WHERE items.feed_id = ? ORDER BY items.feed_index ASC;`
 		var (
 			inx, id, itemId int
 			path, typ       string
+			invalid         sql.NullString
 			item            Item
 		)
-		s2.Scan(&id, &itemId, &path, &typ)
+		s2.Scan(&id, &itemId, &path, &typ, &invalid)
 		for i, it := range all {
 			if it.ID == itemId {
 				item = it
@@ -612,7 +815,7 @@ WHERE items.feed_id = ? ORDER BY items.feed_index ASC;`
 		if item.Content == nil {
 			item.Content = make(map[string]Content)
 		}
-		item.Content[typ] = Content{ID: id, Path: path, Type: typ}
+		item.Content[typ] = Content{ID: id, Path: path, Type: typ, Invalid: invalid.String}
 		all[inx] = item
 	}
 	return all, nil
@@ -634,10 +837,11 @@ type Destination struct {
 	Flags       int
 }
 
-func loadMyKindleDestination(c *sql.DB, d MyKindleDestination) (*Destination, error) {
-	sel := `SELECT id, type, credentials, flags FROM destinations 
-WHERE type = ? AND json_extract(credentials, '$.to') = ?`
-	s, err := c.Query(sel, d.Type(), d.To)
+// loadEmailDestination loads the destination of type typ sending to the to email address.
+func loadEmailDestination(c *sql.DB, typ, to string) (*Destination, error) {
+	sel := fmt.Sprintf(`SELECT id, type, credentials, flags FROM destinations 
+WHERE type = ? AND %s = ?`, sqlJSONField(c, "credentials", "to"))
+	s, err := c.Query(sel, typ, to)
 	if err != nil {
 		return nil, err
 	}
@@ -654,8 +858,8 @@ WHERE type = ? AND json_extract(credentials, '$.to') = ?`
 }
 
 func loadPocketDestination(c *sql.DB, d PocketDestination) (*Destination, error) {
-	sel := `SELECT id, type, credentials, flags FROM destinations 
-WHERE type = ? AND json_extract(credentials, '$.username') = ?`
+	sel := fmt.Sprintf(`SELECT id, type, credentials, flags FROM destinations 
+WHERE type = ? AND %s = ?`, sqlJSONField(c, "credentials", "username"))
 	s, err := c.Query(sel, d.Type(), d.Username)
 	if err != nil {
 		return nil, err
@@ -677,26 +881,25 @@ func LoadDestination(c *sql.DB, d DestinationTarget) (*Destination, error) {
 	case PocketDestination:
 		return loadPocketDestination(c, dd)
 	case MyKindleDestination:
-		return loadMyKindleDestination(c, dd)
+		return loadEmailDestination(c, dd.Type(), dd.To)
+	case EmailDestination:
+		return loadEmailDestination(c, dd.Type(), dd.To)
 	}
 	return nil, fmt.Errorf("invalid destination")
 }
 
 func insertDestination(c *sql.DB, d Destination) (*Destination, error) {
-	sql := `INSERT INTO destinations (type, credentials, flags, created) VALUES(?, ?, ?, ?);`
-	r, err := c.Exec(sql, d.Type, d.Credentials, d.Flags, time.Now().UTC().Format(time.RFC3339))
+	sql := `INSERT INTO destinations (type, credentials, flags, created) VALUES(?, ?, ?, ?) RETURNING id;`
+	err := c.QueryRow(sql, d.Type, string(d.Credentials), d.Flags, time.Now().UTC().Format(time.RFC3339)).Scan(&d.ID)
 	if err != nil {
 		return nil, err
 	}
-	if id, err := r.LastInsertId(); err == nil {
-		d.ID = int(id)
-	}
 	return &d, nil
 }
 
 func updateDestination(c *sql.DB, d Destination) (*Destination, error) {
 	sql := `UPDATE destinations SET type = ?, credentials = ?, flags = ? WHERE id = ?`
-	if _, err := c.Exec(sql, d.Type, d.Credentials, d.Flags, d.ID); err != nil {
+	if _, err := c.Exec(sql, d.Type, string(d.Credentials), d.Flags, d.ID); err != nil {
 		return nil, err
 	}
 	return &d, nil
@@ -713,6 +916,9 @@ func SaveDestination(c *sql.DB, d DestinationTarget) (*Destination, error) {
 		return nil, err
 	}
 
+	if err = validDestinationType(Destination{Type: d.Type(), Credentials: creds}); err != nil {
+		return nil, err
+	}
 	if dd == nil {
 		dd = &Destination{
 			Type:        d.Type(),
@@ -726,15 +932,18 @@ func SaveDestination(c *sql.DB, d DestinationTarget) (*Destination, error) {
 }
 
 type Subscription struct {
-	ID          int
-	Flags       int
-	Created     time.Time
+	ID         int
+	Flags      int
+	Created    time.Time
+	VolumeSize int
+	// Languages limits the items dispatched to the ones in these languages, all of them being sent when empty.
+	Languages   []string
 	Destination Destination
 	Feed        Feed
 }
 
 func SaveSubscriptions(c *sql.DB, d Destination, feeds ...Feed) error {
-	ins := `INSERT INTO subscriptions (feed_id, destination_id) VALUES (?, ?, ?) ON CONFLICT DO NOTHING;`
+	ins := `INSERT INTO subscriptions (feed_id, destination_id, created) VALUES (?, ?, ?) ON CONFLICT DO NOTHING;`
 	s, err := c.Prepare(ins)
 	if err != nil {
 		return err
@@ -758,6 +967,33 @@ func SaveSubscriptions(c *sql.DB, d Destination, feeds ...Feed) error {
 	return nil
 }
 
+// SaveSubscriptionVolumes sets the number of chapters of the volumes the destination receives for each feed id,
+// a zero size means the items of the feed are dispatched one by one.
+func SaveSubscriptionVolumes(c *sql.DB, d Destination, sizes map[int]int) error {
+	upd := `UPDATE subscriptions SET volume_size = ? WHERE destination_id = ? AND feed_id = ?;`
+	multi := make([]error, 0)
+	for feedID, size := range sizes {
+		if _, err := c.Exec(upd, size, d.ID, feedID); err != nil {
+			multi = append(multi, fmt.Errorf("unable to save volume size for feed %d: %w", feedID, err))
+		}
+	}
+	return errors.Join(multi...)
+}
+
+// SaveSubscriptionLanguages sets the languages of the items the destination receives for each feed id,
+// an empty list meaning the items in all languages.
+func SaveSubscriptionLanguages(c *sql.DB, d Destination, languages map[int][]string) error {
+	upd := `UPDATE subscriptions SET languages = ? WHERE destination_id = ? AND feed_id = ?;`
+	multi := make([]error, 0)
+	for feedID, langs := range languages {
+		list := sql.NullString{String: strings.Join(langs, ","), Valid: len(langs) > 0}
+		if _, err := c.Exec(upd, list, d.ID, feedID); err != nil {
+			multi = append(multi, fmt.Errorf("unable to save languages for feed %d: %w", feedID, err))
+		}
+	}
+	return errors.Join(multi...)
+}
+
 func RemoveSubscriptions(db *sql.DB, dest Destination, ids ...int) error {
 	delFmt := `DELETE FROM subscriptions WHERE destination_id = ? AND feed_id IN (%s)`
 	tokens := make([]string, 0)
@@ -780,7 +1016,7 @@ func RemoveSubscriptions(db *sql.DB, dest Destination, ids ...int) error {
 }
 
 func LoadSubscriptions(db *sql.DB, d Destination) ([]Subscription, error) {
-	sel := `SELECT s.id, s.flags, f.id, f.flags, f.title, f.url, f.frequency, f.last_loaded, f.last_status
+	sel := `SELECT s.id, s.flags, s.volume_size, s.languages, f.id, f.flags, f.title, f.url, f.frequency, f.last_loaded, f.last_status
 FROM subscriptions s
 INNER JOIN feeds f ON f.id = s.feed_id
 WHERE s.destination_id = ? `
@@ -796,10 +1032,12 @@ WHERE s.destination_id = ? `
 			Destination: d,
 			Feed:        Feed{},
 		}
+		var languages sql.NullString
 		s.Scan(
-			&sub.ID, &sub.Flags,
+			&sub.ID, &sub.Flags, &sub.VolumeSize, &languages,
 			&sub.Feed.ID, &sub.Feed.Flags, &sub.Feed.Title, &sub.Feed.URL, &sub.Feed.Frequency, &sub.Feed.Updated, &sub.Feed.LastStatus,
 		)
+		sub.Languages = ParseLanguages(languages.String)
 		if sub.ID > 0 {
 			subs = append(subs, sub)
 		}
@@ -856,7 +1094,7 @@ func SaveTarget(c *sql.DB, tt DispatchItem) error {
 }
 
 func InsertContent(c *sql.DB, item Item) error {
-	insEbookContent := "INSERT INTO contents (item_id, path, type) VALUES (?, ?, ?) ON CONFLICT DO NOTHING;"
+	insEbookContent := "INSERT INTO contents (item_id, path, type, size, created, version, rules_hash, options, invalid) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING;"
 	s, err := c.Prepare(insEbookContent)
 	if err != nil {
 		return err
@@ -868,8 +1106,16 @@ func InsertContent(c *sql.DB, item Item) error {
 		if typ == OutputTypeRAW {
 			continue
 		}
-		if _, err = s.Exec(item.ID, cont.Path, typ); err != nil {
+		r, err := s.Exec(item.ID, cont.Path, typ, cont.Size, time.Now().UTC().Format(time.RFC3339), cont.Version, cont.Hash, cont.Options, cont.Invalid)
+		if err != nil {
 			multi = append(multi, fmt.Errorf("unable to save content path for type %s: %w", typ, err))
+			continue
+		}
+		if cnt, _ := r.RowsAffected(); cnt == 0 || cont.Size == 0 {
+			continue
+		}
+		if err = updateFeedStats(c, item.Feed.ID, typ, cont.Size); err != nil {
+			multi = append(multi, fmt.Errorf("unable to update statistics for type %s: %w", typ, err))
 		}
 	}
 	if len(multi) > 0 {
@@ -9,6 +9,8 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// openDb opens the SQLite database, the writers of the worker pools waiting for each other
+// instead of failing with "database is locked".
 func openDb(dbPath string) (*sql.DB, error) {
-	return sql.Open("sqlite3", dbPath)
+	return sql.Open("sqlite3", dbPath+"?_busy_timeout=10000")
 }
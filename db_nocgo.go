@@ -9,6 +9,8 @@ import (
 	_ "modernc.org/sqlite"
 )
 
+// openDb opens the SQLite database, the writers of the worker pools waiting for each other
+// instead of failing with "database is locked".
 func openDb(dbPath string) (*sql.DB, error) {
-	return sql.Open("sqlite", dbPath)
+	return sql.Open("sqlite", dbPath+"?_pragma=busy_timeout(10000)")
 }
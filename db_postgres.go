@@ -0,0 +1,330 @@
+package feeds
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const postgresDriverName = "feeds-postgres"
+
+func init() {
+	sql.Register(postgresDriverName, pgDriver{})
+}
+
+// pgDriver wraps the lib/pq driver so the queries in this package, which use
+// the '?' placeholders SQLite understands, can be executed unchanged against PostgreSQL.
+type pgDriver struct {
+	pq.Driver
+}
+
+func (d pgDriver) Open(dsn string) (driver.Conn, error) {
+	c, err := d.Driver.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return pgConn{Conn: c}, nil
+}
+
+type pgConn struct {
+	driver.Conn
+}
+
+func (c pgConn) Prepare(query string) (driver.Stmt, error) {
+	return c.Conn.Prepare(rebind(query))
+}
+
+func (c pgConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if pc, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return pc.PrepareContext(ctx, rebind(query))
+	}
+	return c.Prepare(query)
+}
+
+func (c pgConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if bc, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return bc.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c pgConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if nc, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return nc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// rebind replaces the '?' placeholders in query with PostgreSQL's positional '$N' ones,
+// leaving string literals and quoted identifiers untouched.
+func rebind(query string) string {
+	b := strings.Builder{}
+	b.Grow(len(query) + 8)
+
+	pos := 0
+	var quote rune
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '?':
+			pos++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(pos))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func isPostgresDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
+
+func isPostgres(c *sql.DB) bool {
+	_, ok := c.Driver().(pgDriver)
+	return ok
+}
+
+func openPostgres(dsn string) (*sql.DB, error) {
+	db, err := sql.Open(postgresDriverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	var feedsTable sql.NullString
+	if err = db.QueryRow(`SELECT to_regclass('feeds')::text`).Scan(&feedsTable); err != nil {
+		return nil, err
+	}
+	if !feedsTable.Valid {
+		if err = createPostgresTables(db); err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+func createPostgresTables(c *sql.DB) error {
+	tables := []string{
+		`CREATE TABLE feeds (
+		id SERIAL PRIMARY KEY,
+		url TEXT,
+		title TEXT,
+		author TEXT,
+		frequency REAL,
+		last_loaded TIMESTAMPTZ,
+		last_status INTEGER,
+		flags INTEGER DEFAULT 0,
+		CONSTRAINT feeds_uulr UNIQUE (url)
+	);`,
+		`CREATE TABLE items (
+		id SERIAL PRIMARY KEY,
+		url TEXT,
+		feed_id INTEGER REFERENCES feeds(id),
+		guid TEXT,
+		title TEXT,
+		author TEXT,
+		feed_index INTEGER,
+		published_date TIMESTAMPTZ,
+		last_loaded TIMESTAMPTZ,
+		last_status INTEGER,
+		CONSTRAINT items_uulr UNIQUE (url)
+	);`,
+		`CREATE TABLE contents (
+		id SERIAL PRIMARY KEY,
+		item_id INTEGER REFERENCES items(id),
+		path TEXT,
+		type TEXT,
+		created TIMESTAMPTZ,
+		CONSTRAINT contents_uindex UNIQUE (item_id, type),
+		CONSTRAINT contents_upath UNIQUE (path)
+	);`,
+		`CREATE TABLE users (
+		id SERIAL PRIMARY KEY,
+		raw TEXT,
+		flags INTEGER
+	);`,
+		`CREATE TABLE destinations (
+		id SERIAL PRIMARY KEY,
+		type TEXT,
+		credentials JSONB,
+		created TIMESTAMPTZ,
+		flags INTEGER DEFAULT 0
+	);`,
+		`CREATE TABLE dispatched (
+		id SERIAL PRIMARY KEY,
+		destination_id INTEGER REFERENCES destinations(id) ON DELETE CASCADE,
+		item_id INTEGER REFERENCES items(id),
+		last_try TIMESTAMPTZ,
+		last_status BOOLEAN,
+		last_message TEXT,
+		flags INTEGER DEFAULT 0,
+		CONSTRAINT item_destination_uindex UNIQUE (item_id, destination_id)
+	);`,
+		`CREATE TABLE subscriptions (
+		id SERIAL PRIMARY KEY,
+		feed_id INTEGER REFERENCES feeds(id),
+		destination_id INTEGER REFERENCES destinations(id) ON DELETE CASCADE,
+		created TIMESTAMPTZ,
+		flags INTEGER DEFAULT 0,
+		CONSTRAINT feed_destination_uindex UNIQUE (feed_id, destination_id)
+	);`,
+	}
+	for _, table := range tables {
+		if _, err := c.Exec(table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqlJSONField returns the expression for extracting the top level field from the JSON document in column col.
+func sqlJSONField(c *sql.DB, col, field string) string {
+	if isPostgres(c) {
+		return fmt.Sprintf("%s->>'%s'", col, field)
+	}
+	return fmt.Sprintf("json_extract(%s, '$.%s')", col, field)
+}
+
+// sqlDate returns the expression for the date part of column col, optionally shifted back by the ago duration.
+func sqlDate(c *sql.DB, col string, ago time.Duration) string {
+	if isPostgres(c) {
+		if ago == 0 {
+			return fmt.Sprintf("%s::date", col)
+		}
+		return fmt.Sprintf("(%s - interval '%f hours')::date", col, ago.Hours())
+	}
+	if ago == 0 {
+		return fmt.Sprintf("date(%s)", col)
+	}
+	return fmt.Sprintf("date(%s, '-%f hour')", col, ago.Hours())
+}
+
+// migratedTables lists the tables copied by MigrateDB, in the order required by their foreign keys,
+// together with the columns holding timestamps and whether their ids come from a sequence.
+var migratedTables = []struct {
+	name   string
+	dates  []string
+	serial bool
+}{
+	{name: "feeds", dates: []string{"last_loaded"}, serial: true},
+	{name: "items", dates: []string{"published_date", "last_loaded"}, serial: true},
+	{name: "contents", dates: []string{"created"}, serial: true},
+	{name: "users", serial: true},
+	{name: "destinations", dates: []string{"created"}, serial: true},
+	{name: "dispatched", dates: []string{"last_try"}, serial: true},
+	{name: "subscriptions", dates: []string{"created"}, serial: true},
+	{name: "feed_stats"},
+	{name: "retention_policies", serial: true},
+	{name: "images", dates: []string{"created"}, serial: true},
+	{name: "volumes", dates: []string{"created"}, serial: true},
+	{name: "cleanup_rules", serial: true},
+}
+
+// MigrateDB copies all rows from the SQLite database src into the PostgreSQL database dst,
+// keeping their ids, and returns the number of rows copied for each table.
+func MigrateDB(ctx context.Context, src, dst *sql.DB) (map[string]int, error) {
+	if isPostgres(src) || !isPostgres(dst) {
+		return nil, fmt.Errorf("migration is supported only from SQLite to PostgreSQL")
+	}
+	counts := make(map[string]int)
+	for _, t := range migratedTables {
+		cnt, err := copyTable(ctx, src, dst, t.name, t.dates...)
+		if err != nil {
+			return counts, fmt.Errorf("unable to copy table %s: %w", t.name, err)
+		}
+		counts[t.name] = cnt
+		if !t.serial {
+			continue
+		}
+
+		setSeq := fmt.Sprintf(`SELECT setval(pg_get_serial_sequence('%s', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM %s;`, t.name, t.name)
+		if _, err = dst.ExecContext(ctx, setSeq); err != nil {
+			return counts, fmt.Errorf("unable to reset id sequence for table %s: %w", t.name, err)
+		}
+	}
+	return counts, nil
+}
+
+func copyTable(ctx context.Context, src, dst *sql.DB, table string, dates ...string) (int, error) {
+	rows, err := src.QueryContext(ctx, fmt.Sprintf(`SELECT * FROM %s;`, table))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	tokens := make([]string, len(cols))
+	isDate := make([]bool, len(cols))
+	for i, col := range cols {
+		tokens[i] = "?"
+		for _, d := range dates {
+			isDate[i] = isDate[i] || d == col
+		}
+	}
+	ins := fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s) ON CONFLICT DO NOTHING;`, table, strings.Join(cols, ", "), strings.Join(tokens, ", "))
+	s, err := dst.PrepareContext(ctx, ins)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+
+	count := 0
+	for rows.Next() {
+		vals := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err = rows.Scan(ptrs...); err != nil {
+			return count, err
+		}
+		for i, v := range vals {
+			vals[i] = migratedValue(v, isDate[i])
+		}
+		if _, err = s.ExecContext(ctx, vals...); err != nil {
+			// NOTE(marius): SQLite doesn't enforce foreign keys, so we can have orphaned rows which we skip
+			log.Printf("Skipping %s row %v: %s", table, vals[0], err)
+			continue
+		}
+		count++
+	}
+	return count, rows.Err()
+}
+
+var migratedDateLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05Z07:00", "2006-01-02 15:04:05", "2006-01-02"}
+
+// migratedValue converts a value loaded from SQLite to one that PostgreSQL accepts for the column it's going into.
+func migratedValue(v interface{}, isDate bool) interface{} {
+	if b, ok := v.([]byte); ok {
+		v = string(b)
+	}
+	if !isDate {
+		return v
+	}
+	switch vv := v.(type) {
+	case time.Time:
+		return vv
+	case string:
+		for _, layout := range migratedDateLayouts {
+			if t, err := time.Parse(layout, vv); err == nil {
+				return t
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package feeds
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDB opens a new SQLite database in dir, skipping the test for the builds without FTS5, see the test target
+// of the Makefile.
+func testDB(t *testing.T, dir string) *sql.DB {
+	t.Helper()
+	c, err := DB(dir, "")
+	if err != nil && strings.Contains(err.Error(), "fts5") {
+		t.Skipf("the SQLite driver needs the sqlite_fts5 build tag: %s", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// testDatabases returns a new SQLite database and, when FEEDS_TEST_POSTGRES holds the connection string of one,
+// the PostgreSQL database, whose tables get emptied after the test.
+func testDatabases(t *testing.T) map[string]*sql.DB {
+	t.Helper()
+	all := map[string]*sql.DB{"sqlite": testDB(t, t.TempDir())}
+	dsn := os.Getenv("FEEDS_TEST_POSTGRES")
+	if dsn == "" {
+		return all
+	}
+	c, err := DB(t.TempDir(), dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		names := make([]string, 0, len(migratedTables))
+		for _, table := range migratedTables {
+			names = append(names, table.name)
+		}
+		if _, err := c.Exec(fmt.Sprintf("TRUNCATE %s RESTART IDENTITY CASCADE;", strings.Join(names, ", "))); err != nil {
+			t.Errorf("unable to empty the PostgreSQL tables: %s", err)
+		}
+		c.Close()
+	})
+	all["postgres"] = c
+	return all
+}
+
+func TestNonDispatchedItemLanguages(t *testing.T) {
+	for name, c := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now().UTC().Format(time.RFC3339)
+			items := []struct {
+				feed int
+				lang string
+			}{
+				{1, ""},
+				{1, "en"},
+				{2, ""},
+				{2, "de"},
+			}
+			_, err := c.Exec(`INSERT INTO feeds (title, author, url, flags, language) VALUES ('Roman', 'Autor', 'https://example.de/feed', 0, 'de'),
+	('Unknown', 'Author', 'https://example.com/feed', 0, NULL);`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, it := range items {
+				_, err = c.Exec(`INSERT INTO items (url, feed_id, title, author, feed_index, last_loaded, language) VALUES (?, ?, ?, 'Author', ?, ?, ?);`,
+					fmt.Sprintf("https://example.com/%d", i+1), it.feed, fmt.Sprintf("Chapter %d", i+1), i+1, now, it.lang)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = c.Exec(`INSERT INTO contents (item_id, path, type, created, flags) VALUES (?, ?, 'epub', ?, 0);`, i+1, fmt.Sprintf("blobs/%d.epub", i+1), now)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err = c.Exec(`INSERT INTO destinations (type, credentials, flags, created) VALUES ('email', '{"to":"reader@example.com"}', 0, ?);`, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = c.Exec(`INSERT INTO subscriptions (feed_id, destination_id, volume_size, languages) VALUES (1, 1, 0, 'en'), (2, 1, 0, 'en');`)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			all, err := GetNonDispatchedItemContentsForDestination(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0, len(all))
+			for _, disp := range all {
+				got = append(got, disp.Item.Title)
+			}
+			// NOTE(marius): the first item is in the language of its German feed, the third one in an unknown language
+			if want := []string{"Chapter 2", "Chapter 3"}; fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("GetNonDispatchedItemContentsForDestination() = %v, want %v", got, want)
+			}
+		})
+	}
+}
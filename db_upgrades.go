@@ -0,0 +1,299 @@
+package feeds
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// schemaUpgrade holds the statements that change the database schema from the previous version,
+// with separate versions for SQLite and PostgreSQL when their syntax differs.
+type schemaUpgrade struct {
+	sqlite   []string
+	postgres []string
+}
+
+func (u schemaUpgrade) statements(c *sql.DB) []string {
+	if isPostgres(c) && u.postgres != nil {
+		return u.postgres
+	}
+	return u.sqlite
+}
+
+// schemaUpgrades are applied in order on top of the tables created by createTables and createPostgresTables.
+// The version of a database is the number of upgrades applied to it.
+var schemaUpgrades = []schemaUpgrade{
+	{
+		// 1: contents can share the same content addressed file, and we keep per feed statistics of their sizes
+		// NOTE(marius): the existing contents have no size, it gets filled from their files by UpdateContentSizes
+		sqlite: []string{
+			`CREATE TABLE contents_upgrade (
+		id INTEGER PRIMARY KEY ASC AUTOINCREMENT,
+		item_id INTEGER,
+		path TEXT,
+		type TEXT,
+		created TEXT,
+		size INTEGER,
+		FOREIGN KEY(item_id) REFERENCES items(id),
+		CONSTRAINT contents_uindex UNIQUE (item_id, type)
+	);`,
+			`INSERT INTO contents_upgrade (id, item_id, path, type, created) SELECT id, item_id, path, type, created FROM contents;`,
+			`DROP TABLE contents;`,
+			`ALTER TABLE contents_upgrade RENAME TO contents;`,
+			`CREATE TABLE feed_stats (
+		feed_id INTEGER,
+		type TEXT,
+		count INTEGER DEFAULT 0,
+		size INTEGER DEFAULT 0,
+		FOREIGN KEY(feed_id) REFERENCES feeds(id),
+		CONSTRAINT feed_stats_uindex UNIQUE (feed_id, type)
+	);`,
+			`INSERT INTO feed_stats (feed_id, type, count, size) SELECT items.feed_id, contents.type, COUNT(*), COALESCE(SUM(contents.size), 0)
+		FROM contents INNER JOIN items ON items.id = contents.item_id GROUP BY items.feed_id, contents.type;`,
+		},
+		postgres: []string{
+			`ALTER TABLE contents DROP CONSTRAINT contents_upath;`,
+			`ALTER TABLE contents ADD COLUMN size BIGINT;`,
+			`CREATE TABLE feed_stats (
+		feed_id INTEGER REFERENCES feeds(id),
+		type TEXT,
+		count INTEGER DEFAULT 0,
+		size BIGINT DEFAULT 0,
+		CONSTRAINT feed_stats_uindex UNIQUE (feed_id, type)
+	);`,
+			`INSERT INTO feed_stats (feed_id, type, count, size) SELECT items.feed_id, contents.type, COUNT(*), COALESCE(SUM(contents.size), 0)
+		FROM contents INNER JOIN items ON items.id = contents.item_id GROUP BY items.feed_id, contents.type;`,
+		},
+	},
+	{
+		// 2: contents can be disabled by the retention policies
+		sqlite: []string{
+			`ALTER TABLE contents ADD COLUMN flags INTEGER DEFAULT 0;`,
+			`CREATE TABLE retention_policies (
+		id INTEGER PRIMARY KEY ASC,
+		feed_id INTEGER,
+		type TEXT,
+		days INTEGER,
+		after_dispatch INTEGER DEFAULT 0,
+		FOREIGN KEY(feed_id) REFERENCES feeds(id) ON DELETE CASCADE,
+		CONSTRAINT retention_policies_uindex UNIQUE (feed_id, type)
+	);`,
+		},
+		postgres: []string{
+			`ALTER TABLE contents ADD COLUMN flags INTEGER DEFAULT 0;`,
+			`CREATE TABLE retention_policies (
+		id SERIAL PRIMARY KEY,
+		feed_id INTEGER REFERENCES feeds(id) ON DELETE CASCADE,
+		type TEXT,
+		days INTEGER,
+		after_dispatch BOOLEAN DEFAULT false,
+		CONSTRAINT retention_policies_uindex UNIQUE (feed_id, type)
+	);`,
+		},
+	},
+	{
+		// 3: images downloaded for the articles
+		sqlite: []string{
+			`CREATE TABLE images (
+		id INTEGER PRIMARY KEY ASC AUTOINCREMENT,
+		item_id INTEGER,
+		url TEXT,
+		path TEXT,
+		type TEXT,
+		size INTEGER,
+		created TEXT,
+		FOREIGN KEY(item_id) REFERENCES items(id),
+		CONSTRAINT images_uindex UNIQUE (item_id, url)
+	);`,
+		},
+		postgres: []string{
+			`CREATE TABLE images (
+		id SERIAL PRIMARY KEY,
+		item_id INTEGER REFERENCES items(id),
+		url TEXT,
+		path TEXT,
+		type TEXT,
+		size BIGINT,
+		created TIMESTAMPTZ,
+		CONSTRAINT images_uindex UNIQUE (item_id, url)
+	);`,
+		},
+	},
+	{
+		// 4: ebooks compiled from multiple items, which destinations can subscribe to
+		sqlite: []string{
+			`ALTER TABLE subscriptions ADD COLUMN volume_size INTEGER DEFAULT 0;`,
+			`CREATE TABLE volumes (
+		id INTEGER PRIMARY KEY ASC AUTOINCREMENT,
+		feed_id INTEGER,
+		title TEXT,
+		first_index INTEGER,
+		last_index INTEGER,
+		type TEXT,
+		path TEXT,
+		size INTEGER,
+		created TEXT,
+		FOREIGN KEY(feed_id) REFERENCES feeds(id),
+		CONSTRAINT volumes_uindex UNIQUE (feed_id, first_index, last_index, type)
+	);`,
+		},
+		postgres: []string{
+			`ALTER TABLE subscriptions ADD COLUMN volume_size INTEGER DEFAULT 0;`,
+			`CREATE TABLE volumes (
+		id SERIAL PRIMARY KEY,
+		feed_id INTEGER REFERENCES feeds(id),
+		title TEXT,
+		first_index INTEGER,
+		last_index INTEGER,
+		type TEXT,
+		path TEXT,
+		size BIGINT,
+		created TIMESTAMPTZ,
+		CONSTRAINT volumes_uindex UNIQUE (feed_id, first_index, last_index, type)
+	);`,
+		},
+	},
+	{
+		// 5: feeds have the image of their RSS channel and an uploaded base image for the generated covers
+		sqlite: []string{
+			`ALTER TABLE feeds ADD COLUMN image_url TEXT;`,
+			`ALTER TABLE feeds ADD COLUMN icon TEXT;`,
+			`ALTER TABLE feeds ADD COLUMN cover TEXT;`,
+		},
+	},
+	{
+		// 6: rules removing the boilerplate from the readable HTML of the items of a feed
+		sqlite: []string{
+			`CREATE TABLE cleanup_rules (
+		id INTEGER PRIMARY KEY ASC AUTOINCREMENT,
+		feed_id INTEGER,
+		type TEXT,
+		value TEXT,
+		FOREIGN KEY(feed_id) REFERENCES feeds(id) ON DELETE CASCADE
+	);`,
+		},
+		postgres: []string{
+			`CREATE TABLE cleanup_rules (
+		id SERIAL PRIMARY KEY,
+		feed_id INTEGER REFERENCES feeds(id) ON DELETE CASCADE,
+		type TEXT,
+		value TEXT
+	);`,
+		},
+	},
+	{
+		// 7: feeds can have CSS selectors for the title and the body of their articles
+		sqlite: []string{
+			`ALTER TABLE feeds ADD COLUMN title_selector TEXT;`,
+			`ALTER TABLE feeds ADD COLUMN content_selector TEXT;`,
+		},
+	},
+	{
+		// 8: feeds can have a stylesheet for their ebooks
+		sqlite: []string{
+			`ALTER TABLE feeds ADD COLUMN stylesheet TEXT;`,
+		},
+	},
+	{
+		// 9: the raw contents record the charset they were transcoded to UTF-8 from
+		sqlite: []string{
+			`ALTER TABLE contents ADD COLUMN charset TEXT;`,
+		},
+	},
+	{
+		// 10: items have the verdict of the quality checks of their content
+		sqlite: []string{
+			`ALTER TABLE items ADD COLUMN quality TEXT;`,
+			`ALTER TABLE items ADD COLUMN quality_reason TEXT;`,
+		},
+	},
+	{
+		// 11: contents record the version of the converter and the hash of the options they were generated with
+		sqlite: []string{
+			`ALTER TABLE contents ADD COLUMN version INTEGER;`,
+			`ALTER TABLE contents ADD COLUMN rules_hash TEXT;`,
+		},
+	},
+	{
+		// 12: full text search index of the readable text of the items, filled by the index command
+		sqlite: []string{
+			`CREATE VIRTUAL TABLE items_search USING fts5(title, body, tokenize = 'unicode61 remove_diacritics 2');`,
+		},
+		postgres: []string{
+			`CREATE TABLE items_search (
+		item_id INTEGER PRIMARY KEY REFERENCES items(id),
+		title TEXT,
+		body TEXT,
+		document tsvector GENERATED ALWAYS AS (to_tsvector('simple', coalesce(title, '') || ' ' || coalesce(body, ''))) STORED
+	);`,
+			`CREATE INDEX items_search_document ON items_search USING GIN (document);`,
+		},
+	},
+	{
+		// 13: reading statistics of the readable text of the items, filled with the search index
+		sqlite: []string{
+			`ALTER TABLE items ADD COLUMN words INTEGER;`,
+			`ALTER TABLE items ADD COLUMN characters INTEGER;`,
+		},
+	},
+	{
+		// 14: languages of the feeds and of the items, and the languages the subscriptions are limited to
+		sqlite: []string{
+			`ALTER TABLE feeds ADD COLUMN language TEXT;`,
+			`ALTER TABLE items ADD COLUMN language TEXT;`,
+			`ALTER TABLE subscriptions ADD COLUMN languages TEXT;`,
+		},
+	},
+	{
+		// 15: the reason of the generated files failing their validation, which keeps them from being dispatched
+		sqlite: []string{
+			`ALTER TABLE contents ADD COLUMN invalid TEXT;`,
+		},
+	},
+	{
+		// 16: the conversion options the contents were generated with, the hashes of the ebooks only cover the options
+		// of their feed from now on, so the older ones are dropped
+		sqlite: []string{
+			`ALTER TABLE contents ADD COLUMN options TEXT;`,
+			`UPDATE contents SET rules_hash = NULL WHERE type NOT IN ('raw', 'html');`,
+		},
+	},
+}
+
+func schemaVersion(c *sql.DB) (int, error) {
+	if _, err := c.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER);`); err != nil {
+		return 0, err
+	}
+	var version sql.NullInt32
+	if err := c.QueryRow(`SELECT MAX(version) FROM schema_version;`).Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int32), nil
+}
+
+// upgradeTables brings the schema of the database to the latest version.
+func upgradeTables(c *sql.DB) error {
+	version, err := schemaVersion(c)
+	if err != nil {
+		return fmt.Errorf("unable to load schema version: %w", err)
+	}
+	for i := version; i < len(schemaUpgrades); i++ {
+		tx, err := c.Begin()
+		if err != nil {
+			return err
+		}
+		for _, stmt := range schemaUpgrades[i].statements(c) {
+			if _, err = tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("unable to upgrade schema to version %d: %w", i+1, err)
+			}
+		}
+		if _, err = tx.Exec(`INSERT INTO schema_version (version) VALUES (?);`, i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
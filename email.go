@@ -0,0 +1,30 @@
+package feeds
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// EmailDestination represents the combination of the email service target with the email address of a user.
+type EmailDestination struct {
+	Target ServiceEmail `json:"target"`
+	To     string       `json:"to"`
+	// ContentType is the type of the content sent to the address, when it's not the default one.
+	ContentType string `json:"content_type,omitempty"`
+}
+
+func (e EmailDestination) Type() string {
+	return "email"
+}
+
+func (e EmailDestination) Service() DestinationService {
+	return e.Target
+}
+
+func DispatchToEmail(ctx context.Context, s Storage, disp DispatchItem) (bool, error) {
+	var target EmailDestination
+	if err := json.Unmarshal(disp.Destination.Credentials, &target); err != nil {
+		return false, err
+	}
+	return emailContent(ctx, s, disp, target.Target.SendCredentials, target.To)
+}
@@ -1,19 +1,81 @@
 package feeds
 
 import (
+	"encoding/base64"
+	"log"
+	"path/filepath"
+
 	"github.com/bmaupin/go-epub"
 )
 
+func init() {
+	RegisterConverter(format{typ: OutputTypeEPUB, dependency: OutputTypeHTML, version: 2, mimeType: "application/epub+zip", book: epubBook})
+}
+
 func ToEPub(content []byte, title, author, outPath string) error {
+	return epubBook([]chapter{{Title: title, Content: content}}, title, author, ebookMeta{Language: EbookLanguage}, DefaultConvertOptions, outPath)
+}
+
+// epubBook writes an EPUB with one section for each chapter, which go-epub lists in the table of contents.
+func epubBook(chapters []chapter, title, author string, meta ebookMeta, opts ConvertOptions, outPath string) error {
 	e := epub.NewEpub(title)
 
 	e.SetAuthor(author)
+	if meta.Identifier != "" {
+		e.SetIdentifier(meta.Identifier)
+	}
+	if meta.Language != "" {
+		e.SetLang(meta.Language)
+	}
+	if meta.Description != "" {
+		e.SetDescription(meta.Description)
+	}
+
+	if cover, _, ok := ebookCover(outPath); ok {
+		internal, err := e.AddImage(cover, filepath.Base(cover))
+		if err != nil {
+			log.Printf("Unable to embed cover: %s", err)
+		} else {
+			e.SetCover(internal, "")
+		}
+	}
 
-	e.AddSection(string(content), title, "", "")
+	css := ""
+	if stylesheet := opts.stylesheet(); stylesheet != "" {
+		var err error
+		source := "data:text/css;base64," + base64.StdEncoding.EncodeToString([]byte(stylesheet))
+		if css, err = e.AddCSS(source, "style.css"); err != nil {
+			log.Printf("Unable to embed stylesheet: %s", err)
+		}
+	}
+
+	embedded := make(map[string]string)
+	for _, ch := range chapters {
+		content := ch.Content
+		for _, img := range ebookImages(content, outPath) {
+			internal, ok := embedded[img.Src]
+			if !ok {
+				imgPath, err := processedImageFile(img.Path, opts)
+				if err != nil {
+					log.Printf("Unable to process image %s: %s", img.Src, err)
+					continue
+				}
+				if internal, err = e.AddImage(imgPath, filepath.Base(imgPath)); err != nil {
+					log.Printf("Unable to embed image %s: %s", img.Src, err)
+					continue
+				}
+				embedded[img.Src] = internal
+			}
+			content = replaceSrc(content, img.Src, `src="`+internal+`"`)
+		}
+		if _, err := e.AddSection(string(content), ch.Title, "", css); err != nil {
+			return err
+		}
+	}
 
 	// Write the EPUB
 	if err := e.Write(outPath); err != nil {
 		return err
 	}
-	return nil
+	return addEPubMetadata(outPath, meta)
 }
@@ -0,0 +1,338 @@
+package feeds
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// fb2Genre is the genre of the generated FictionBook files, which is mandatory in their description.
+const fb2Genre = "prose_contemporary"
+
+var xmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+
+func init() {
+	RegisterConverter(format{typ: OutputTypeFB2, dependency: OutputTypeHTML, version: 2, mimeType: "application/x-fictionbook+xml", book: fb2Book})
+}
+
+func ToFB2(content []byte, title, author, outPath string) error {
+	return fb2Book([]chapter{{Title: title, Content: content}}, title, author, ebookMeta{Language: EbookLanguage}, DefaultConvertOptions, outPath)
+}
+
+// fb2Book writes a FictionBook 2 file with a section for each of the chapters.
+// The images, including the cover, are embedded as base64 encoded binaries.
+func fb2Book(chapters []chapter, title, author string, meta ebookMeta, opts ConvertOptions, outPath string) error {
+	w := fb2Writer{opts: opts, binaries: make(map[string]string)}
+
+	body := bytes.Buffer{}
+	for _, ch := range chapters {
+		w.images = make(map[string]string)
+		for _, img := range ebookImages(ch.Content, outPath) {
+			w.images[img.Src] = img.Path
+		}
+		doc, err := html.Parse(bytes.NewReader(ch.Content))
+		if err != nil {
+			return err
+		}
+		w.buf.Reset()
+		if root := findElement(doc, atom.Body); root != nil {
+			w.walk(root)
+		}
+		w.closePara()
+		body.WriteString("<section>\n")
+		fmt.Fprintf(&body, "<title><p>%s</p></title>\n", xmlEscaper.Replace(ch.Title))
+		body.Write(w.buf.Bytes())
+		body.WriteString("</section>\n")
+	}
+
+	out := bytes.Buffer{}
+	out.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	out.WriteString(`<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">` + "\n")
+	out.WriteString("<description>\n<title-info>\n")
+	fmt.Fprintf(&out, "<genre>%s</genre>\n", fb2Genre)
+	out.WriteString(fb2Author(author))
+	fmt.Fprintf(&out, "<book-title>%s</book-title>\n", xmlEscaper.Replace(title))
+	if meta.Description != "" {
+		fmt.Fprintf(&out, "<annotation><p>%s</p></annotation>\n", xmlEscaper.Replace(meta.Description))
+	}
+	if cover, _, ok := ebookCover(outPath); ok {
+		if id := w.binary(cover, "cover.jpg"); id != "" {
+			fmt.Fprintf(&out, `<coverpage><image l:href="#%s"/></coverpage>`+"\n", id)
+		}
+	}
+	if !meta.Published.IsZero() {
+		fmt.Fprintf(&out, `<date value="%s">%s</date>`+"\n", meta.Published.Format("2006-01-02"), meta.Published.Format("2006-01-02"))
+	}
+	if meta.Language != "" {
+		fmt.Fprintf(&out, "<lang>%s</lang>\n", xmlEscaper.Replace(meta.Language))
+	}
+	if meta.Series != "" {
+		fmt.Fprintf(&out, `<sequence name="%s" number="%d"/>`+"\n", xmlEscaper.Replace(meta.Series), meta.SeriesIndex)
+	}
+	out.WriteString("</title-info>\n<document-info>\n")
+	out.WriteString("<author><nickname>feed-sync</nickname></author>\n<program-used>feed-sync</program-used>\n")
+	if meta.Source != "" {
+		fmt.Fprintf(&out, "<src-url>%s</src-url>\n", xmlEscaper.Replace(meta.Source))
+	}
+	if meta.Identifier != "" {
+		fmt.Fprintf(&out, "<id>%s</id>\n", xmlEscaper.Replace(strings.TrimPrefix(meta.Identifier, "urn:uuid:")))
+	}
+	out.WriteString("<version>1.0</version>\n</document-info>\n")
+	if meta.Publisher != "" {
+		fmt.Fprintf(&out, "<publish-info><publisher>%s</publisher></publish-info>\n", xmlEscaper.Replace(meta.Publisher))
+	}
+	out.WriteString("</description>\n<body>\n")
+	fmt.Fprintf(&out, "<title><p>%s</p></title>\n", xmlEscaper.Replace(title))
+	out.Write(body.Bytes())
+	out.WriteString("</body>\n")
+	for _, id := range w.order {
+		fmt.Fprintf(&out, `<binary id="%s" content-type="image/jpeg">%s</binary>`+"\n", id, w.binaries[id])
+	}
+	out.WriteString("</FictionBook>\n")
+	return os.WriteFile(outPath, out.Bytes(), 0644)
+}
+
+// fb2Author returns the author element, with the first and last names when the author has two names,
+// or with the nickname otherwise.
+func fb2Author(author string) string {
+	names := strings.Fields(author)
+	if len(names) == 2 {
+		return fmt.Sprintf("<author><first-name>%s</first-name><last-name>%s</last-name></author>\n",
+			xmlEscaper.Replace(names[0]), xmlEscaper.Replace(names[1]))
+	}
+	return fmt.Sprintf("<author><nickname>%s</nickname></author>\n", xmlEscaper.Replace(author))
+}
+
+// fb2Inline maps the inline HTML elements to their FictionBook counterparts.
+var fb2Inline = map[atom.Atom]string{
+	atom.B: "strong", atom.Strong: "strong",
+	atom.I: "emphasis", atom.Em: "emphasis", atom.Cite: "emphasis", atom.Var: "emphasis",
+	atom.Del: "strikethrough", atom.S: "strikethrough", atom.Strike: "strikethrough",
+	atom.Code: "code", atom.Kbd: "code", atom.Samp: "code", atom.Tt: "code",
+	atom.Sub: "sub", atom.Sup: "sup",
+}
+
+// fb2Writer renders HTML as the paragraphs of a FictionBook section, where the text can appear only
+// inside paragraphs, so they get opened for any text outside them, and the open inline elements
+// get closed and reopened around the block elements.
+type fb2Writer struct {
+	opts   ConvertOptions
+	buf    bytes.Buffer
+	images map[string]string
+	// binaries holds the base64 encoded images by their id, in the order of the ids
+	binaries map[string]string
+	order    []string
+
+	inline []string
+	inPara bool
+	quote  int
+	lists  []htmlList
+	pre    int
+}
+
+func (w *fb2Writer) openPara() {
+	if w.inPara {
+		return
+	}
+	w.buf.WriteString("<p>")
+	for _, tag := range w.inline {
+		w.buf.WriteString("<" + tag + ">")
+	}
+	w.inPara = true
+}
+
+func (w *fb2Writer) closePara() {
+	if !w.inPara {
+		return
+	}
+	for i := len(w.inline) - 1; i >= 0; i-- {
+		w.buf.WriteString("</" + w.inline[i] + ">")
+	}
+	w.buf.WriteString("</p>\n")
+	w.inPara = false
+}
+
+func (w *fb2Writer) text(s string) {
+	if w.pre == 0 {
+		s = whitespaceRe.ReplaceAllString(s, " ")
+		if !w.inPara {
+			s = strings.TrimLeft(s, " ")
+		}
+	}
+	if s == "" {
+		return
+	}
+	if w.pre == 0 {
+		w.openPara()
+		w.buf.WriteString(xmlEscaper.Replace(s))
+		return
+	}
+	for i, line := range strings.Split(s, "\n") {
+		if i > 0 {
+			w.closePara()
+		}
+		w.openPara()
+		w.buf.WriteString(xmlEscaper.Replace(line))
+	}
+}
+
+func (w *fb2Writer) walk(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		switch c.Type {
+		case html.TextNode:
+			w.text(c.Data)
+		case html.ElementNode:
+			w.element(c)
+		}
+	}
+}
+
+func (w *fb2Writer) element(n *html.Node) {
+	if tag, ok := fb2Inline[n.DataAtom]; ok {
+		if w.inPara {
+			w.buf.WriteString("<" + tag + ">")
+		}
+		w.inline = append(w.inline, tag)
+		w.walk(n)
+		w.inline = w.inline[:len(w.inline)-1]
+		if w.inPara {
+			w.buf.WriteString("</" + tag + ">")
+		}
+		return
+	}
+	switch n.DataAtom {
+	case atom.Script, atom.Style, atom.Head, atom.Noscript:
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		w.closePara()
+		text := strings.TrimSpace(whitespaceRe.ReplaceAllString(textContent(n), " "))
+		if text != "" {
+			fmt.Fprintf(&w.buf, "<subtitle>%s</subtitle>\n", xmlEscaper.Replace(text))
+		}
+	case atom.Br:
+		w.closePara()
+	case atom.Hr:
+		w.closePara()
+		w.buf.WriteString("<empty-line/>\n")
+	case atom.Pre:
+		w.closePara()
+		w.pre++
+		w.inline = append(w.inline, "code")
+		w.walk(n)
+		w.closePara()
+		w.inline = w.inline[:len(w.inline)-1]
+		w.pre--
+	case atom.Blockquote:
+		w.closePara()
+		if w.quote == 0 {
+			w.buf.WriteString("<cite>\n")
+		}
+		w.quote++
+		w.walk(n)
+		w.closePara()
+		w.quote--
+		if w.quote == 0 {
+			w.buf.WriteString("</cite>\n")
+		}
+	case atom.Ul, atom.Ol:
+		w.closePara()
+		w.lists = append(w.lists, htmlList{ordered: n.DataAtom == atom.Ol})
+		w.walk(n)
+		w.lists = w.lists[:len(w.lists)-1]
+		w.closePara()
+	case atom.Li:
+		w.closePara()
+		marker := "•"
+		if len(w.lists) > 0 {
+			l := &w.lists[len(w.lists)-1]
+			l.count++
+			if l.ordered {
+				marker = strconv.Itoa(l.count) + "."
+			}
+		}
+		w.openPara()
+		w.buf.WriteString(strings.Repeat("  ", len(w.lists)-1) + marker + " ")
+		w.walk(n)
+		w.closePara()
+	case atom.Table:
+		w.closePara()
+		w.table(n)
+	case atom.Img:
+		w.image(n)
+	case atom.P, atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Figure, atom.Figcaption, atom.Dl, atom.Dt, atom.Dd:
+		w.closePara()
+		w.walk(n)
+		w.closePara()
+	default:
+		w.walk(n)
+	}
+}
+
+func (w *fb2Writer) image(n *html.Node) {
+	src := attr(n, "src")
+	imgPath, ok := w.images[src]
+	if !ok || w.quote > 0 {
+		// NOTE(marius): the citations can't contain images
+		return
+	}
+	id := w.binary(imgPath, fmt.Sprintf("image%d.jpg", len(w.order)+1))
+	if id == "" {
+		return
+	}
+	w.closePara()
+	fmt.Fprintf(&w.buf, `<image l:href="#%s"/>`+"\n", id)
+}
+
+// binary embeds the image at imgPath, converted to JPEG, under the id, unless it was already embedded.
+func (w *fb2Writer) binary(imgPath, id string) string {
+	for _, existing := range w.order {
+		if w.binaries[existing] == imgPath {
+			return existing
+		}
+	}
+	data, err := encodeJPEG(imgPath, w.opts)
+	if err != nil {
+		log.Printf("Unable to embed image %s: %s", imgPath, err)
+		return ""
+	}
+	w.binaries[id] = base64.StdEncoding.EncodeToString(data)
+	w.order = append(w.order, id)
+	return id
+}
+
+// table renders the text of the cells of the table.
+func (w *fb2Writer) table(n *html.Node) {
+	rows := bytes.Buffer{}
+	var collect func(*html.Node)
+	collect = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode || c.DataAtom == atom.Table {
+				continue
+			}
+			if c.DataAtom != atom.Tr {
+				collect(c)
+				continue
+			}
+			rows.WriteString("<tr>")
+			for cell := c.FirstChild; cell != nil; cell = cell.NextSibling {
+				if cell.Type == html.ElementNode && (cell.DataAtom == atom.Td || cell.DataAtom == atom.Th) {
+					text := strings.TrimSpace(whitespaceRe.ReplaceAllString(textContent(cell), " "))
+					fmt.Fprintf(&rows, "<%s>%s</%s>", cell.Data, xmlEscaper.Replace(text), cell.Data)
+				}
+			}
+			rows.WriteString("</tr>\n")
+		}
+	}
+	collect(n)
+	if rows.Len() > 0 {
+		w.buf.WriteString("<table>\n")
+		w.buf.Write(rows.Bytes())
+		w.buf.WriteString("</table>\n")
+	}
+}
@@ -1,6 +1,7 @@
 package feeds
 
 import (
+	"context"
 	"database/sql"
 	"io"
 	"log"
@@ -24,6 +25,13 @@ type Feed struct {
 	Updated    time.Time
 	LastStatus int
 	Flags      int
+	// ImageURL is the image of the RSS channel, Icon and Cover are the names in the storage of
+	// the downloaded channel image and of the uploaded base image of the covers.
+	ImageURL string
+	Icon     string
+	Cover    string
+	// Language is the base language declared by the RSS channel, or the most common one of the items.
+	Language string
 }
 
 func (f Feed) Enabled() bool {
@@ -53,10 +61,15 @@ func sourceType(contentType string, body []byte) string {
 	return TypeRSS
 }
 
-func GetFeedInfo(u url.URL) (*rss.Feed, error) {
-	client := http.DefaultClient
-	resp, err := client.Get(u.String())
+func GetFeedInfo(ctx context.Context, u url.URL) (*rss.Feed, error) {
+	ctx, cancel := context.WithTimeout(ctx, FetchTimeout)
+	defer cancel()
 
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -70,10 +83,15 @@ func GetFeedInfo(u url.URL) (*rss.Feed, error) {
 	return rss.Parse(body)
 }
 
-func CheckFeed(f Feed, c *sql.DB) (bool, error) {
-	client := http.DefaultClient
-	resp, err := client.Get(f.URL.String())
+func CheckFeed(ctx context.Context, f Feed, c *sql.DB) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, FetchTimeout)
+	defer cancel()
 
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.URL.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return false, err
 	}
@@ -133,7 +151,7 @@ func CheckFeed(f Feed, c *sql.DB) (bool, error) {
 	})
 	itemIns := `
 INSERT INTO items (url, feed_id, guid, title, published_date, last_loaded, author, feed_index)
-VALUES (?, ?, ?, ?, ?, ?, (select author from feeds where id = ? LIMIT 1), ifnull((select feed_index from items where feed_id = ? order by feed_index desc limit 1),0)+1);
+VALUES (?, ?, ?, ?, ?, ?, (select author from feeds where id = ? LIMIT 1), coalesce((select feed_index from items where feed_id = ? order by feed_index desc limit 1),0)+1);
 `
 	itemUpd := ` UPDATE items SET url = ?, guid = ?, title = ?, published_date = ?, last_loaded = ? WHERE id = ?;`
 	i, err := c.Prepare(itemIns)
@@ -165,6 +183,18 @@ VALUES (?, ?, ?, ?, ?, ?, (select author from feeds where id = ? LIMIT 1), ifnul
 	if _, err = c.Exec(updateFeed, params...); err != nil {
 		return false, err
 	}
+	if lang := normalizeLanguage(doc.Language); lang != "" {
+		if _, err = c.Exec("UPDATE feeds SET language = ? WHERE id = ?", lang, f.ID); err != nil {
+			return false, err
+		}
+	}
+	if doc.Image != nil && doc.Image.URL != "" {
+		// NOTE(marius): the icon is downloaded again when generating the next cover if the image changed
+		updateImage := "UPDATE feeds SET image_url = ?, icon = NULL WHERE id = ? AND (image_url IS NULL OR image_url != ?)"
+		if _, err = c.Exec(updateImage, doc.Image.URL, f.ID, doc.Image.URL); err != nil {
+			return false, err
+		}
+	}
 
 	return true, nil
 }
@@ -6,28 +6,35 @@ require (
 	git.sr.ht/~ghost08/ratt v0.0.0-20231202071651-e72ca2d0814e
 	git.sr.ht/~mariusor/ssm v0.0.0-20231226154447-2c8a6f08b9ca
 	github.com/766b/mobi v0.0.0-20200528201125-c87aa9e3c890
+	github.com/PuerkitoBio/goquery v1.8.1
 	github.com/SlyMarbo/rss v1.0.5
+	github.com/andybalholm/cascadia v1.3.2
 	github.com/bmaupin/go-epub v1.1.0
 	github.com/dghubble/sessions v0.1.0
+	github.com/dustin/go-humanize v1.0.1
+	github.com/google/uuid v1.5.0
 	github.com/jordan-wright/email v4.0.1-0.20210109023952-943e75fe5223+incompatible
+	github.com/jung-kurt/gofpdf v1.16.2
+	github.com/klauspost/compress v1.17.4
 	github.com/leotaku/mobi v0.5.0
+	github.com/lib/pq v1.10.9
 	github.com/mariusor/go-readability v0.0.0-20210422152301-8c985fff1048
 	github.com/mattn/go-sqlite3 v1.14.19
+	github.com/minio/minio-go/v7 v7.0.66
 	github.com/motemen/go-pocket v0.0.0-20201204003030-43b897100651
+	golang.org/x/image v0.18.0
+	golang.org/x/net v0.19.0
 	golang.org/x/sync v0.5.0
+	golang.org/x/text v0.14.0
 	gopkg.in/yaml.v2 v2.4.0
 	modernc.org/sqlite v1.28.0
 )
 
 require (
-	github.com/PuerkitoBio/goquery v1.8.1 // indirect
 	github.com/alecthomas/kong v0.8.1 // indirect
-	github.com/andybalholm/cascadia v1.3.2 // indirect
 	github.com/axgle/mahonia v0.0.0-20180208002826-3358181d7394 // indirect
-	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/gabriel-vasile/mimetype v1.4.3 // indirect
 	github.com/gofrs/uuid v4.4.0+incompatible // indirect
-	github.com/google/uuid v1.5.0 // indirect
 	github.com/gorilla/feeds v1.1.2 // indirect
 	github.com/gorilla/securecookie v1.1.1 // indirect
 	github.com/itchyny/gojq v0.12.14 // indirect
@@ -39,9 +46,7 @@ require (
 	github.com/vincent-petithory/dataurl v1.0.0 // indirect
 	github.com/yuin/gopher-lua v1.1.1 // indirect
 	golang.org/x/mod v0.14.0 // indirect
-	golang.org/x/net v0.19.0 // indirect
 	golang.org/x/sys v0.15.0 // indirect
-	golang.org/x/text v0.14.0 // indirect
 	golang.org/x/tools v0.16.1 // indirect
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 	lukechampine.com/uint128 v1.3.0 // indirect
@@ -0,0 +1,332 @@
+package feeds
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	ImagesDir = "images"
+
+	// maxImageSize is the maximum size of an image we download
+	maxImageSize = 20 << 20
+)
+
+var (
+	// DownloadImages enables saving to the storage the images referenced by the articles,
+	// so they can be embedded in the generated ebooks.
+	DownloadImages = true
+)
+
+var imageExt = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// imageSrcRe matches the src attributes of the images saved to the storage.
+var imageSrcRe = regexp.MustCompile(`src="(/` + ImagesDir + `/[^"]+)"`)
+
+// imageName returns the content addressed storage name of the image.
+func imageName(data []byte, ext string) string {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	return path.Join(ImagesDir, hash[:2], hash+ext)
+}
+
+// fetchImages downloads the images referenced by the readable HTML content of the item, saves them
+// to the storage and rewrites their src attributes to point to the saved files.
+// Images which can't be downloaded are left pointing to their original location.
+func fetchImages(ctx context.Context, c *sql.DB, s Storage, item *Item) error {
+	cont, ok := item.Content[OutputTypeHTML]
+	if !ok || !DownloadImages {
+		return nil
+	}
+	data, err := LoadContent(s, cont)
+	if err != nil {
+		return err
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	doc.Find("img[src]").Each(func(_ int, sel *goquery.Selection) {
+		src, _ := sel.Attr("src")
+		if strings.HasPrefix(src, "/"+ImagesDir+"/") {
+			return
+		}
+		u, err := item.URL.Parse(strings.TrimSpace(src))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return
+		}
+		name, err := saveImage(ctx, c, s, item.ID, u.String())
+		if err != nil {
+			log.Printf("Unable to download image %s: %s", u, err)
+			return
+		}
+		sel.SetAttr("src", "/"+name)
+		changed = true
+	})
+	if !changed {
+		return nil
+	}
+
+	html, err := doc.Find("body").Html()
+	if err != nil {
+		return err
+	}
+	name, err := saveContentBlob(s, []byte(html), OutputTypeHTML)
+	if err != nil {
+		return err
+	}
+	cont.Path, cont.Size = name, int64(len(html))
+	item.Content[OutputTypeHTML] = cont
+	return nil
+}
+
+// saveImage downloads the image at url and saves it to the storage, unless it was already saved for the item.
+func saveImage(ctx context.Context, c *sql.DB, s Storage, itemID int, url string) (string, error) {
+	var name string
+	err := c.QueryRow(`SELECT path FROM images WHERE item_id = ? AND url = ?;`, itemID, url).Scan(&name)
+	if err == nil && blobExists(s, name) {
+		return name, nil
+	}
+
+	name, mimeType, size, err := downloadImage(ctx, s, url)
+	if err != nil {
+		return "", err
+	}
+	ins := `INSERT INTO images (item_id, url, path, type, size, created) VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT (item_id, url) DO UPDATE SET path = excluded.path;`
+	if _, err = c.Exec(ins, itemID, url, name, mimeType, size, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// downloadImage saves the image at url to the storage under its content addressed name.
+func downloadImage(ctx context.Context, s Storage, url string) (string, string, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, FetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", "", 0, err
+	}
+	req.Header.Add("User-Agent", "feed-sync//1.0")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", "", 0, fmt.Errorf("invalid response received %s", res.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxImageSize+1))
+	if err != nil {
+		return "", "", 0, err
+	}
+	if len(data) > maxImageSize {
+		return "", "", 0, fmt.Errorf("image is larger than %d bytes", maxImageSize)
+	}
+	mimeType := http.DetectContentType(data)
+	ext, ok := imageExt[mimeType]
+	if !ok {
+		return "", "", 0, fmt.Errorf("unsupported image type %s", mimeType)
+	}
+
+	name := imageName(data, ext)
+	if !blobExists(s, name) {
+		if err = s.Save(name, bytes.NewReader(data)); err != nil {
+			return "", "", 0, err
+		}
+	}
+	return name, mimeType, len(data), nil
+}
+
+// copyImages saves in dir the images from the storage referenced by content, so the converters can embed them.
+func copyImages(s Storage, content []byte, dir string) error {
+	for _, m := range imageSrcRe.FindAllSubmatch(content, -1) {
+		name := strings.TrimPrefix(string(m[1]), "/")
+		localPath := filepath.Join(dir, filepath.FromSlash(name))
+		if _, err := os.Stat(localPath); err == nil {
+			continue
+		}
+		data, err := loadBlob(s, name)
+		if err != nil {
+			log.Printf("Unable to load image %s: %s", name, err)
+			continue
+		}
+		if err = os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+			return err
+		}
+		if err = os.WriteFile(localPath, data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// embedImages copies to dir the images from the storage referenced by content, when opts enable them, and removes
+// the img elements of the ones which aren't available in dir, which would end up as broken references in the ebooks.
+func embedImages(s Storage, content []byte, dir string, opts ConvertOptions) ([]byte, error) {
+	if opts.Images {
+		if err := copyImages(s, content, dir); err != nil {
+			return nil, err
+		}
+	}
+	if !imageSrcRe.Match(content) {
+		return content, nil
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	removed := false
+	doc.Find(`img[src^="/` + ImagesDir + `/"]`).Each(func(_ int, sel *goquery.Selection) {
+		src, _ := sel.Attr("src")
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(src, "/")))); opts.Images && err == nil {
+			return
+		}
+		sel.Remove()
+		removed = true
+	})
+	if !removed {
+		return content, nil
+	}
+	html, err := doc.Find("body").Html()
+	return []byte(html), err
+}
+
+// ebookImage is an image referenced by the content of an ebook, copied by copyImages to Path.
+type ebookImage struct {
+	Src  string
+	Path string
+}
+
+// ebookImages returns the images referenced by content which are available in the directory
+// where the ebook at outPath is generated.
+func ebookImages(content []byte, outPath string) []ebookImage {
+	dir := filepath.Dir(outPath)
+	seen := make(map[string]bool)
+	images := make([]ebookImage, 0)
+	for _, m := range imageSrcRe.FindAllSubmatch(content, -1) {
+		src := string(m[1])
+		if seen[src] {
+			continue
+		}
+		seen[src] = true
+		localPath := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(src, "/")))
+		if _, err := os.Stat(localPath); err != nil {
+			continue
+		}
+		images = append(images, ebookImage{Src: src, Path: localPath})
+	}
+	return images
+}
+
+// replaceSrc replaces the src attribute of the images pointing to src with the attr attribute.
+func replaceSrc(content []byte, src, attr string) []byte {
+	return bytes.ReplaceAll(content, []byte(`src="`+src+`"`), []byte(attr))
+}
+
+// decodeImage loads the image at imgPath, converted to grayscale and scaled down if the opts require it.
+func decodeImage(imgPath string, opts ConvertOptions) (image.Image, error) {
+	f, err := os.Open(imgPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	return processImage(img, opts), nil
+}
+
+func processImage(img image.Image, opts ConvertOptions) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if opts.ImageWidth > 0 && w > opts.ImageWidth {
+		h = h * opts.ImageWidth / w
+		w = opts.ImageWidth
+	}
+	if w == b.Dx() && !opts.Grayscale {
+		return img
+	}
+	var dst draw.Image
+	if opts.Grayscale {
+		dst = image.NewGray(image.Rect(0, 0, w, h))
+	} else {
+		dst = image.NewRGBA(image.Rect(0, 0, w, h))
+	}
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// processedImageFile returns the path of a file holding the image at imgPath converted to grayscale and scaled
+// down if the opts require it, or imgPath itself when no processing is needed.
+func processedImageFile(imgPath string, opts ConvertOptions) (string, error) {
+	if opts.ImageWidth == 0 && !opts.Grayscale {
+		return imgPath, nil
+	}
+	img, err := decodeImage(imgPath, opts)
+	if err != nil {
+		return "", err
+	}
+	ext := ".jpg"
+	if strings.EqualFold(filepath.Ext(imgPath), ".png") {
+		ext = ".png"
+	}
+	outPath := strings.TrimSuffix(imgPath, filepath.Ext(imgPath)) + "-processed" + ext
+	f, err := os.Create(outPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if ext == ".png" {
+		err = png.Encode(f, img)
+	} else {
+		err = jpeg.Encode(f, img, &jpeg.Options{Quality: 85})
+	}
+	return outPath, err
+}
+
+// encodeJPEG returns the image at imgPath as JPEG data, the format MOBI files support.
+func encodeJPEG(imgPath string, opts ConvertOptions) ([]byte, error) {
+	img, err := decodeImage(imgPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.Buffer{}
+	if err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,113 @@
+package feeds
+
+import (
+	"archive/zip"
+	"bytes"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEmbedImages(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenStorage(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := bytes.Buffer{}
+	if err = png.Encode(&img, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	saved := imageName(img.Bytes(), ".png")
+	if err = s.Save(saved, bytes.NewReader(img.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	missing := imageName([]byte("missing"), ".png")
+	content := `<p>Text <img src="/` + saved + `" alt="saved"/></p><p><img src="/` + missing + `" alt="missing"/></p>` +
+		`<p><img src="https://example.com/remote.png" alt="remote"/></p>`
+
+	tests := []struct {
+		name   string
+		images bool
+		want   []string
+		absent []string
+	}{
+		{"enabled", true, []string{`alt="saved"`, `alt="remote"`}, []string{`alt="missing"`}},
+		{"disabled", false, []string{`alt="remote"`}, []string{`alt="saved"`, `alt="missing"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := t.TempDir()
+			got, err := embedImages(s, []byte(content), out, ConvertOptions{Images: tt.images})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(string(got), want) {
+					t.Errorf("embedImages() = %s, missing %s", got, want)
+				}
+			}
+			for _, absent := range tt.absent {
+				if strings.Contains(string(got), absent) {
+					t.Errorf("embedImages() = %s, contains %s", got, absent)
+				}
+			}
+			_, err = os.Stat(filepath.Join(out, filepath.FromSlash(saved)))
+			if copied := err == nil; copied != tt.images {
+				t.Errorf("embedImages() copied the image %t, want %t", copied, tt.images)
+			}
+		})
+	}
+}
+
+func TestConvertItemWithoutImages(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenStorage(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := bytes.Buffer{}
+	if err = png.Encode(&img, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	name := imageName(img.Bytes(), ".png")
+	if err = s.Save(name, bytes.NewReader(img.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DefaultConvertOptions
+	opts.Images = false
+	outPath := filepath.Join(t.TempDir(), "item.epub")
+	it := Item{Title: "Chapter 1", Author: "Author", Feed: Feed{Title: "Feed"}}
+	buf := []byte(`<p>Story text.</p><p><img src="/` + name + `" alt="map"/></p><p>More story text.</p>`)
+	if err = convertItem(s, it, converters[OutputTypeEPUB], buf, opts, outPath); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.OpenReader(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if !strings.HasSuffix(f.Name, ".xhtml") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), `alt="map"`) {
+			t.Errorf("%s references the image which isn't embedded: %s", f.Name, data)
+		}
+	}
+}
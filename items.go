@@ -21,6 +21,13 @@ type Item struct {
 	Status    int
 	Feed      Feed
 	Content   map[string]Content
+	// Quality is the verdict of the quality checks of the content, and QualityReason the reason of rejecting it.
+	Quality       string
+	QualityReason string
+	// Reading holds the length of the text of the readable HTML, zero until it's generated.
+	Reading ReadingStats
+	// Language is the base language detected from the text, or declared by the page, empty when unknown.
+	Language string
 }
 
 type Content struct {
@@ -28,6 +35,15 @@ type Content struct {
 	Path    string
 	Created time.Time
 	Type    string
+	Size    int64
+	Flags   int
+	// Version is the version of the converter the content was generated with, and Hash the one of the options of its feed.
+	Version int
+	Hash    string
+	// Options are the conversion options the content was generated with, encoded as JSON.
+	Options string
+	// Invalid is the reason of the generated file failing the validation of its type, the invalid contents aren't dispatched.
+	Invalid string
 }
 
 func (i Item) Path(ext string) string {
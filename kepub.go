@@ -0,0 +1,211 @@
+package feeds
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// kepubStyle is the stylesheet Kobo's own conversion adds, which keeps the reader from adding blank pages.
+const kepubStyle = `div#book-inner { margin-top: 0; margin-bottom: 0; }`
+
+// kepubParagraphs are the elements whose text segments are numbered as a new paragraph.
+var kepubParagraphs = map[atom.Atom]bool{
+	atom.P: true, atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Li: true, atom.Dt: true, atom.Dd: true, atom.Td: true, atom.Th: true, atom.Pre: true,
+	atom.Caption: true, atom.Figcaption: true,
+}
+
+// sentenceEndRe matches the punctuation ending a sentence, including the closing quotes and the whitespace following it.
+var sentenceEndRe = regexp.MustCompile(`[.!?…]+['"”’)\]]*\s+`)
+
+func init() {
+	RegisterConverter(format{typ: OutputTypeKEPUB, dependency: OutputTypeEPUB, ext: "kepub.epub", mimeType: "application/kepub+zip", convert: ToKEPUB})
+}
+
+// ToKEPUB converts the EPUB in content to the kepub flavour read by Kobo devices: the text of the content documents
+// is split in koboSpan elements, which the reader uses for tracking the reading progress and for the page statistics.
+func ToKEPUB(content []byte, title, author, outPath string) error {
+	r, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return fmt.Errorf("invalid EPUB: %w", err)
+	}
+	f, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := zip.NewWriter(f)
+	for _, zf := range r.File {
+		switch strings.ToLower(path.Ext(zf.Name)) {
+		case ".xhtml", ".html", ".htm":
+		default:
+			// NOTE(marius): copying the raw entries keeps the mimetype file first and uncompressed
+			if err = w.Copy(zf); err != nil {
+				return err
+			}
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		doc, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		if doc, err = kepubify(doc); err != nil {
+			return fmt.Errorf("unable to convert %s: %w", zf.Name, err)
+		}
+		fw, err := w.CreateHeader(&zip.FileHeader{Name: zf.Name, Method: zip.Deflate, Modified: zf.Modified})
+		if err != nil {
+			return err
+		}
+		if _, err = fw.Write(doc); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// kepubify wraps the body of the XHTML document in the book-columns and book-inner divs
+// and the sentences of its text in numbered koboSpan elements.
+func kepubify(doc []byte) ([]byte, error) {
+	decl := []byte{}
+	if trimmed := bytes.TrimSpace(doc); bytes.HasPrefix(trimmed, []byte("<?xml")) {
+		if end := bytes.Index(trimmed, []byte("?>")); end > 0 {
+			decl = append(trimmed[:end+2:end+2], '\n')
+			doc = trimmed[end+2:]
+		}
+	}
+	root, err := html.Parse(bytes.NewReader(doc))
+	if err != nil {
+		return nil, err
+	}
+	head, body := findElement(root, atom.Head), findElement(root, atom.Body)
+	if head == nil || body == nil {
+		return nil, fmt.Errorf("missing head or body")
+	}
+
+	style := &html.Node{Type: html.ElementNode, Data: "style", DataAtom: atom.Style, Attr: []html.Attribute{
+		{Key: "type", Val: "text/css"}, {Key: "id", Val: "kobostylehacks"},
+	}}
+	style.AppendChild(&html.Node{Type: html.TextNode, Data: kepubStyle})
+	head.AppendChild(style)
+
+	columns := kepubElement("div", atom.Div, html.Attribute{Key: "id", Val: "book-columns"})
+	inner := kepubElement("div", atom.Div, html.Attribute{Key: "id", Val: "book-inner"})
+	for c := body.FirstChild; c != nil; c = body.FirstChild {
+		body.RemoveChild(c)
+		inner.AppendChild(c)
+	}
+	columns.AppendChild(inner)
+	body.AppendChild(columns)
+
+	k := kepubSpans{}
+	k.walk(inner, false)
+
+	buf := bytes.Buffer{}
+	buf.Write(decl)
+	if err = html.Render(&buf, root); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func findElement(n *html.Node, a atom.Atom) *html.Node {
+	if n.Type == html.ElementNode && n.DataAtom == a {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if found := findElement(c, a); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func kepubElement(name string, a atom.Atom, attr ...html.Attribute) *html.Node {
+	return &html.Node{Type: html.ElementNode, Data: name, DataAtom: a, Attr: attr}
+}
+
+// kepubSpans numbers the koboSpan elements as kobo.<paragraph>.<segment>.
+type kepubSpans struct {
+	paragraph int
+	segment   int
+}
+
+func (k *kepubSpans) next() html.Attribute {
+	k.segment++
+	return html.Attribute{Key: "id", Val: fmt.Sprintf("kobo.%d.%d", k.paragraph, k.segment)}
+}
+
+func (k *kepubSpans) newParagraph() {
+	k.paragraph++
+	k.segment = 0
+}
+
+func (k *kepubSpans) walk(n *html.Node, inParagraph bool) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		switch c.Type {
+		case html.TextNode:
+			if !inParagraph && strings.TrimSpace(c.Data) != "" {
+				k.newParagraph()
+			}
+			k.wrapText(c)
+		case html.ElementNode:
+			switch {
+			case c.DataAtom == atom.Script || c.DataAtom == atom.Style:
+			case c.DataAtom == atom.Img:
+				if !inParagraph {
+					k.newParagraph()
+				}
+				span := kepubElement("span", atom.Span, html.Attribute{Key: "class", Val: "koboSpan"}, k.next())
+				n.InsertBefore(span, c)
+				n.RemoveChild(c)
+				span.AppendChild(c)
+			case kepubParagraphs[c.DataAtom]:
+				k.newParagraph()
+				k.walk(c, true)
+			default:
+				k.walk(c, inParagraph)
+			}
+		}
+		c = next
+	}
+}
+
+// wrapText replaces the text node t with koboSpan elements containing each of its sentences.
+func (k *kepubSpans) wrapText(t *html.Node) {
+	text := t.Data
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+	parent := t.Parent
+	start := 0
+	segments := make([]string, 0)
+	for _, m := range sentenceEndRe.FindAllStringIndex(text, -1) {
+		segments = append(segments, text[start:m[1]])
+		start = m[1]
+	}
+	if start < len(text) {
+		segments = append(segments, text[start:])
+	}
+	for _, seg := range segments {
+		span := kepubElement("span", atom.Span, html.Attribute{Key: "class", Val: "koboSpan"}, k.next())
+		span.AppendChild(&html.Node{Type: html.TextNode, Data: seg})
+		parent.InsertBefore(span, t)
+	}
+	parent.RemoveChild(t)
+}
@@ -0,0 +1,65 @@
+package feeds
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKepubify(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want []string
+	}{
+		{
+			name: "sentences",
+			doc:  `<html><head><title>T</title></head><body><p>One. “Two!” Three</p></body></html>`,
+			want: []string{
+				`<style type="text/css" id="kobostylehacks">`,
+				`<body><div id="book-columns"><div id="book-inner"><p>`,
+				`<span class="koboSpan" id="kobo.1.1">One. </span><span class="koboSpan" id="kobo.1.2">“Two!” </span><span class="koboSpan" id="kobo.1.3">Three</span>`,
+			},
+		},
+		{
+			name: "xml declaration",
+			doc: `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head></head><body><p>Text</p></body></html>`,
+			want: []string{"<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<html", `<span class="koboSpan" id="kobo.1.1">Text</span>`},
+		},
+		{
+			name: "paragraphs",
+			doc:  `<html><head></head><body><h1>Title</h1><p>Para</p><p><img src="a.png"/></p></body></html>`,
+			want: []string{
+				`<h1><span class="koboSpan" id="kobo.1.1">Title</span></h1>`,
+				`<p><span class="koboSpan" id="kobo.2.1">Para</span></p>`,
+				`<p><span class="koboSpan" id="kobo.3.1"><img src="a.png"/></span></p>`,
+			},
+		},
+		{
+			name: "inline elements",
+			doc:  `<html><head></head><body><p>Para <em>emph. x</em> end.</p></body></html>`,
+			want: []string{`<em><span class="koboSpan" id="kobo.1.2">emph. </span><span class="koboSpan" id="kobo.1.3">x</span></em><span class="koboSpan" id="kobo.1.4"> end.</span>`},
+		},
+		{
+			name: "loose text and scripts",
+			doc:  `<html><head></head><body>Loose text. More<script>var a = 1.</script></body></html>`,
+			want: []string{
+				`<span class="koboSpan" id="kobo.1.1">Loose text. </span><span class="koboSpan" id="kobo.1.2">More</span>`,
+				`<script>var a = 1.</script>`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := kepubify([]byte(tt.doc))
+			if err != nil {
+				t.Fatalf("kepubify() error = %v", err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(string(got), want) {
+					t.Errorf("kepubify() = %s, missing %s", got, want)
+				}
+			}
+		})
+	}
+}
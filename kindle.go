@@ -1,10 +1,17 @@
 package feeds
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"log"
+	"mime"
+	"net"
+	"net/mail"
 	"net/smtp"
+	"path"
+	"time"
 
 	"github.com/jordan-wright/email"
 	_ "modernc.org/sqlite"
@@ -39,6 +46,10 @@ type SMTPCreds struct {
 type MyKindleDestination struct {
 	Target ServiceMyKindle `json:"target"`
 	To     string          `json:"to"`
+	// ContentType is the type of the content sent to the device, when it's not the default one.
+	ContentType string `json:"content_type,omitempty"`
+	// Options holds the conversion options overriding the default ones for the device.
+	Options json.RawMessage `json:"options,omitempty"`
 }
 
 func (k MyKindleDestination) Type() string {
@@ -49,34 +60,125 @@ func (k MyKindleDestination) Service() DestinationService {
 	return k.Target
 }
 
-func DispatchToKindle(disp DispatchItem) (bool, error) {
+func DispatchToKindle(ctx context.Context, s Storage, disp DispatchItem) (bool, error) {
 	var target MyKindleDestination
 	if err := json.Unmarshal(disp.Destination.Credentials, &target); err != nil {
 		return false, err
 	}
-	var cont Content
-	for _, typ := range ValidTargets[target.Type()].ValidContentTypes() {
-		var ok bool
-		if cont, ok = disp.Item.Content[typ]; ok {
-			break
-		}
+	return emailContent(ctx, s, disp, target.Target.SendCredentials, target.To)
+}
+
+// emailContent sends the content of the item of disp, of the type of its destination, attached to an email to
+// the to address, using the settings SMTP account.
+func emailContent(ctx context.Context, s Storage, disp DispatchItem, settings SMTPCreds, to string) (bool, error) {
+	cont, ok := disp.Item.Content[destinationType(disp.Destination)]
+	if !ok {
+		return false, fmt.Errorf("no %s content to send", destinationType(disp.Destination))
 	}
 
 	e := email.NewEmail()
-	log.Printf("Emailing %s to %s %s", cont.Path, target.To, target.Type())
+	log.Printf("Emailing %s to %s %s", cont.Path, to, disp.Destination.Type)
 
-	settings := target.Target.SendCredentials
 	e.From = settings.From
-	e.To = []string{target.To}
+	e.To = []string{to}
 	e.Bcc = []string{settings.From}
 	e.Subject = fmt.Sprintf("%s: %s", disp.Item.Feed.Title, disp.Item.Title)
-	if _, err := e.AttachFile(cont.Path); err != nil {
+	f, err := s.Open(cont.Path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	mimeType := mime.TypeByExtension(path.Ext(cont.Path))
+	if conv, ok := ConverterFor(cont.Type); ok {
+		mimeType = conv.MimeType()
+	}
+	if _, err := e.Attach(f, path.Base(cont.Path), mimeType); err != nil {
 		return false, err
 	}
 
-	err := e.Send(settings.Server+":"+settings.Port, smtp.PlainAuth("", settings.User, settings.Password, settings.Server))
+	err = sendEmail(ctx, e, settings.Server+":"+settings.Port, smtp.PlainAuth("", settings.User, settings.Password, settings.Server))
 	if err != nil {
 		return false, err
 	}
 	return true, nil
 }
+
+// sendEmail sends the message like email.Send does, but aborting the SMTP conversation when ctx is done,
+// so a hung server doesn't stall the dispatching.
+func sendEmail(ctx context.Context, e *email.Email, addr string, auth smtp.Auth) error {
+	from, err := mail.ParseAddress(e.From)
+	if err != nil {
+		return err
+	}
+	to := make([]string, 0, len(e.To)+len(e.Cc)+len(e.Bcc))
+	for _, list := range [][]string{e.To, e.Cc, e.Bcc} {
+		for _, rcpt := range list {
+			a, err := mail.ParseAddress(rcpt)
+			if err != nil {
+				return err
+			}
+			to = append(to, a.Address)
+		}
+	}
+	raw, err := e.Bytes()
+	if err != nil {
+		return err
+	}
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		// NOTE(marius): unblocks the reads and writes in progress when ctx is cancelled before its deadline
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	host, _, _ := net.SplitHostPort(addr)
+	if err = smtpSend(conn, host, auth, from.Address, to, raw); err != nil && ctx.Err() != nil {
+		return fmt.Errorf("unable to send email to %s: %w", addr, ctx.Err())
+	}
+	return err
+}
+
+func smtpSend(conn net.Conn, host string, auth smtp.Auth, from string, to []string, raw []byte) error {
+	cl, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer cl.Close()
+	if ok, _ := cl.Extension("STARTTLS"); ok {
+		if err = cl.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if ok, _ := cl.Extension("AUTH"); ok && auth != nil {
+		if err = cl.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err = cl.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err = cl.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := cl.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(raw); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return cl.Quit()
+}
@@ -0,0 +1,248 @@
+package feeds
+
+import (
+	"bytes"
+	"database/sql"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/text/language"
+)
+
+// languageSampleWords is the number of words of the text the language is detected from.
+const languageSampleWords = 2000
+
+// scriptLanguages are the languages detected from the script of the text, for the scripts mostly used by one language.
+var scriptLanguages = []struct {
+	script *unicode.RangeTable
+	lang   string
+}{
+	{unicode.Hangul, "ko"},
+	{unicode.Hiragana, "ja"},
+	{unicode.Katakana, "ja"},
+	{unicode.Han, "zh"},
+	{unicode.Cyrillic, "ru"},
+	{unicode.Greek, "el"},
+	{unicode.Arabic, "ar"},
+	{unicode.Hebrew, "he"},
+	{unicode.Thai, "th"},
+	{unicode.Devanagari, "hi"},
+}
+
+// languageStopwords are the most frequent words of the languages written in the Latin script, which tell them apart.
+var languageStopwords = map[string][]string{
+	"en": {"the", "and", "of", "to", "is", "that", "it", "was", "he", "for", "with", "his", "you", "she", "had", "not", "but", "they", "this", "what"},
+	"fr": {"le", "la", "les", "de", "un", "et", "des", "est", "une", "que", "qui", "dans", "pas", "pour", "sur", "il", "elle", "je", "ne", "du", "au", "avec", "mais"},
+	"de": {"der", "die", "und", "das", "ist", "nicht", "ich", "sie", "er", "ein", "eine", "zu", "den", "mit", "sich", "auf", "dem", "des", "war", "es"},
+	"es": {"el", "la", "de", "un", "los", "las", "que", "y", "en", "una", "es", "por", "con", "para", "no", "se", "su", "lo", "del", "al", "pero", "como", "yo"},
+	"it": {"il", "la", "un", "di", "che", "è", "e", "non", "per", "una", "sono", "con", "della", "le", "ma", "gli", "lo", "mi", "si", "ha", "io", "anche"},
+	"pt": {"o", "a", "os", "de", "que", "e", "do", "da", "em", "um", "uma", "não", "para", "com", "é", "no", "na", "se", "ele", "mas", "eu"},
+	"nl": {"de", "het", "een", "en", "van", "is", "dat", "niet", "ik", "je", "op", "zijn", "met", "voor", "hij", "ze", "maar", "wat", "er", "die"},
+	"ro": {"și", "în", "este", "nu", "cu", "pe", "la", "un", "că", "din", "care", "se", "mai", "ce", "sunt", "lui", "fost", "ea", "el", "pentru"},
+	"pl": {"i", "w", "nie", "się", "na", "że", "z", "do", "to", "jest", "jak", "ale", "co", "tak", "po", "jego", "już", "był", "była", "mnie"},
+	"sv": {"och", "att", "det", "som", "en", "är", "på", "inte", "jag", "för", "med", "har", "den", "av", "var", "han", "hon", "till", "om", "men"},
+}
+
+// detectLanguage guesses the language of text, from its script or from the frequency of the most common words
+// of the languages using the Latin script. It returns an empty string when the text doesn't tell.
+func detectLanguage(text string) string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsMark(r)
+	})
+	if len(words) > languageSampleWords {
+		words = words[:languageSampleWords]
+	}
+
+	scripts := make(map[string]int)
+	letters, latin := 0, 0
+	for _, word := range words {
+		for _, r := range word {
+			if !unicode.IsLetter(r) {
+				continue
+			}
+			letters++
+			if unicode.Is(unicode.Latin, r) {
+				latin++
+				continue
+			}
+			for _, s := range scriptLanguages {
+				if unicode.Is(s.script, r) {
+					scripts[s.lang]++
+					break
+				}
+			}
+		}
+	}
+	if letters == 0 {
+		return ""
+	}
+	if latin*2 < letters {
+		// NOTE(marius): the Japanese text mixes kanji with the kana, a few kana tell it apart from Chinese
+		if scripts["ja"] > 0 && scripts["ja"]*10 >= scripts["zh"] {
+			return "ja"
+		}
+		best := ""
+		for _, lang := range sortedKeys(scripts) {
+			if best == "" || scripts[lang] > scripts[best] {
+				best = lang
+			}
+		}
+		if best == "ru" && strings.ContainsAny(text, "іїєґІЇЄҐ") {
+			return "uk"
+		}
+		return best
+	}
+
+	scores := make(map[string]int)
+	for lang, stopwords := range languageStopwords {
+		set := make(map[string]bool, len(stopwords))
+		for _, w := range stopwords {
+			set[w] = true
+		}
+		for _, word := range words {
+			if set[word] {
+				scores[lang]++
+			}
+		}
+	}
+	best, second := "", 0
+	for _, lang := range sortedKeys(scores) {
+		if best == "" || scores[lang] > scores[best] {
+			best = lang
+		}
+	}
+	for lang, score := range scores {
+		if lang != best && score > second {
+			second = score
+		}
+	}
+	// NOTE(marius): the stopwords make up a good part of any text, too few of them, or as many of the ones of
+	// another language, mean we can't tell
+	if best == "" || scores[best] < 3 || scores[best]*10 < len(words) || scores[best]*4 < second*5 {
+		return ""
+	}
+	return best
+}
+
+// normalizeLanguage returns the base language of the BCP 47 tag, eg. "en" for "en-US", or an empty string if it's invalid.
+func normalizeLanguage(tag string) string {
+	tag = strings.TrimSpace(strings.ReplaceAll(tag, "_", "-"))
+	if tag == "" {
+		return ""
+	}
+	t, err := language.Parse(tag)
+	if err != nil {
+		return ""
+	}
+	base, conf := t.Base()
+	if conf < language.High {
+		return ""
+	}
+	return base.String()
+}
+
+// htmlLanguage returns the language declared by the lang attribute of the html element of the page,
+// or by its Content-Language meta element.
+func htmlLanguage(content []byte) string {
+	doc, err := html.Parse(bytes.NewReader(content))
+	if err != nil {
+		return ""
+	}
+	if el := findElement(doc, atom.Html); el != nil {
+		for _, a := range el.Attr {
+			if a.Key == "lang" || a.Key == "xml:lang" {
+				if lang := normalizeLanguage(a.Val); lang != "" {
+					return lang
+				}
+			}
+		}
+	}
+	if head := findElement(doc, atom.Head); head != nil {
+		for m := head.FirstChild; m != nil; m = m.NextSibling {
+			if m.Type != html.ElementNode || m.DataAtom != atom.Meta || !strings.EqualFold(attr(m, "http-equiv"), "content-language") {
+				continue
+			}
+			if lang := normalizeLanguage(strings.Split(attr(m, "content"), ",")[0]); lang != "" {
+				return lang
+			}
+		}
+	}
+	return ""
+}
+
+// itemLanguage returns the language detected from the text of the item, falling back to the one declared
+// by its page when the text doesn't tell.
+func itemLanguage(s Storage, it Item, text string) string {
+	if lang := detectLanguage(text); lang != "" {
+		return lang
+	}
+	if _, ok := it.Content[OutputTypeRAW]; !ok {
+		return ""
+	}
+	raw, err := getItemContentForType(s, it, OutputTypeRAW)
+	if err != nil {
+		return ""
+	}
+	return htmlLanguage(raw)
+}
+
+// ebookLanguage returns the language of the ebooks generated for the item: the one of the item, of its feed,
+// or EbookLanguage when none of them is known.
+func ebookLanguage(it Item) string {
+	if it.Language != "" {
+		return it.Language
+	}
+	if it.Feed.Language != "" {
+		return it.Feed.Language
+	}
+	return EbookLanguage
+}
+
+// updateFeedsLanguage sets the language of the feeds which don't declare one to the most common one of their items.
+func updateFeedsLanguage(c *sql.DB) error {
+	upd := `UPDATE feeds SET language = (SELECT items.language FROM items
+	WHERE items.feed_id = feeds.id AND items.language IS NOT NULL AND items.language != ''
+	GROUP BY items.language ORDER BY COUNT(*) DESC, items.language LIMIT 1)
+WHERE language IS NULL OR language = '';`
+	_, err := c.Exec(upd)
+	return err
+}
+
+// languageMatches reports whether the language of the item, or of its feed when the item doesn't have one, is one
+// of the languages, all of them matching for an empty list, and the items with an unknown language matching any of them.
+func languageMatches(it Item, languages []string) bool {
+	lang := it.Language
+	if lang == "" {
+		lang = it.Feed.Language
+	}
+	if lang == "" || len(languages) == 0 {
+		return true
+	}
+	return slices.Contains(languages, lang)
+}
+
+// ParseLanguages returns the base languages of the comma or space separated list of BCP 47 tags.
+func ParseLanguages(list string) []string {
+	languages := make([]string, 0)
+	for _, tag := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		lang := normalizeLanguage(tag)
+		if lang == "" || slices.Contains(languages, lang) {
+			continue
+		}
+		languages = append(languages, lang)
+	}
+	return languages
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,183 @@
+package feeds
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// EbookLanguage is the language set in the metadata of the generated ebooks whose items and feed have an unknown language.
+var EbookLanguage = "en"
+
+// ebookMeta holds the metadata of the generated ebooks, besides their title and author.
+type ebookMeta struct {
+	Series      string
+	SeriesIndex int
+	Language    string
+	Publisher   string
+	Published   time.Time
+	Source      string
+	Identifier  string
+	// Description is the length of the text and its estimated reading time.
+	Description string
+}
+
+// itemMeta returns the metadata of the ebooks generated for the item: they are part of the series named
+// after the feed, and their identifier is derived from the GUID of the item, so it doesn't change between generations.
+func itemMeta(it Item) ebookMeta {
+	m := ebookMeta{
+		Series:      it.Feed.Title,
+		SeriesIndex: it.FeedIndex,
+		Language:    ebookLanguage(it),
+		Published:   it.Published,
+	}
+	key := it.GUID
+	if it.URL != nil {
+		m.Source = it.URL.String()
+		m.Publisher = strings.TrimPrefix(it.URL.Hostname(), "www.")
+		if key == "" {
+			key = m.Source
+		}
+	}
+	if key == "" {
+		key = fmt.Sprintf("%s#%d", it.Feed.Title, it.FeedIndex)
+	}
+	m.Identifier = stableIdentifier(key)
+	return m
+}
+
+// volumeMeta returns the metadata of the volume, which is part of the series named after the feed,
+// and has the identifier derived from the range of items it contains. Its language is the one of its first
+// item with a known language.
+func volumeMeta(v Volume) ebookMeta {
+	first := Item{Feed: v.Feed}
+	for _, it := range v.Items {
+		if it.Language != "" {
+			first.Language = it.Language
+			break
+		}
+	}
+	m := ebookMeta{
+		Series:      v.Feed.Title,
+		SeriesIndex: v.First,
+		Language:    ebookLanguage(first),
+	}
+	source := v.Feed.Title
+	if v.Feed.URL != nil {
+		source = v.Feed.URL.String()
+		m.Source = source
+		m.Publisher = strings.TrimPrefix(v.Feed.URL.Hostname(), "www.")
+	}
+	if len(v.Items) > 0 {
+		m.Published = v.Items[len(v.Items)-1].Published
+	}
+	m.Identifier = stableIdentifier(fmt.Sprintf("%s#volume-%d-%d", source, v.First, v.Last))
+	return m
+}
+
+// stableIdentifier returns a URN containing the name based UUID of key.
+func stableIdentifier(key string) string {
+	return "urn:uuid:" + uuid.NewSHA1(uuid.NameSpaceURL, []byte(key)).String()
+}
+
+// epubMetadata returns the package document elements for the metadata go-epub doesn't support:
+// the series, both in the calibre and in the EPUB3 belongs-to-collection form, the publisher, date and source.
+func (m ebookMeta) epubMetadata() string {
+	el := make([]string, 0)
+	if m.Publisher != "" {
+		el = append(el, fmt.Sprintf(`<dc:publisher>%s</dc:publisher>`, html.EscapeString(m.Publisher)))
+	}
+	if !m.Published.IsZero() {
+		el = append(el, fmt.Sprintf(`<dc:date>%s</dc:date>`, m.Published.UTC().Format(time.RFC3339)))
+	}
+	if m.Source != "" {
+		el = append(el, fmt.Sprintf(`<dc:source>%s</dc:source>`, html.EscapeString(m.Source)))
+	}
+	if m.Series != "" {
+		series := html.EscapeString(m.Series)
+		index := strconv.Itoa(m.SeriesIndex)
+		el = append(el,
+			fmt.Sprintf(`<meta name="calibre:series" content="%s"/>`, series),
+			fmt.Sprintf(`<meta name="calibre:series_index" content="%s"/>`, index),
+			fmt.Sprintf(`<meta property="belongs-to-collection" id="series">%s</meta>`, series),
+			`<meta refines="#series" property="collection-type">series</meta>`,
+			fmt.Sprintf(`<meta refines="#series" property="group-position">%s</meta>`, index),
+		)
+	}
+	if len(el) == 0 {
+		return ""
+	}
+	return "  " + strings.Join(el, "\n    ") + "\n  "
+}
+
+// addEPubMetadata rewrites the package document of the EPUB at epubPath to contain the metadata.
+func addEPubMetadata(epubPath string, m ebookMeta) error {
+	meta := m.epubMetadata()
+	if meta == "" {
+		return nil
+	}
+	r, err := zip.OpenReader(epubPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	buf := bytes.Buffer{}
+	w := zip.NewWriter(&buf)
+	for _, f := range r.File {
+		if !strings.HasSuffix(f.Name, ".opf") {
+			// NOTE(marius): copying the raw entries keeps the mimetype file stored uncompressed
+			if err = w.Copy(f); err != nil {
+				return err
+			}
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		opf, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		opf = bytes.Replace(opf, []byte("</metadata>"), []byte(meta+"</metadata>"), 1)
+		fw, err := w.CreateHeader(&zip.FileHeader{Name: f.Name, Method: zip.Deflate, Modified: f.Modified})
+		if err != nil {
+			return err
+		}
+		if _, err = fw.Write(opf); err != nil {
+			return err
+		}
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return os.WriteFile(epubPath, buf.Bytes(), 0644)
+}
+
+// mobiUniqueID returns the numeric id of the MOBI files derived from the stable identifier.
+func (m ebookMeta) mobiUniqueID() uint32 {
+	u, err := uuid.Parse(strings.TrimPrefix(m.Identifier, "urn:uuid:"))
+	if err != nil {
+		return 0
+	}
+	return uint32(u[0])<<24 | uint32(u[1])<<16 | uint32(u[2])<<8 | uint32(u[3])
+}
+
+// mobiSubject returns the series of the ebook in the form used for the subject of the MOBI files,
+// as they don't have a dedicated record for it.
+func (m ebookMeta) mobiSubject() string {
+	if m.Series == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s #%d", m.Series, m.SeriesIndex)
+}
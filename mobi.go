@@ -1,10 +1,27 @@
 package feeds
 
 import (
+	"fmt"
+	"log"
+	"time"
+
 	"github.com/766b/mobi"
 )
 
+// mobiEmbImage is the type of the embedded records holding the images of the content,
+// as opposed to the cover and thumbnail ones.
+const mobiEmbImage = mobi.EmbThumb + 1
+
+func init() {
+	RegisterConverter(format{typ: OutputTypeMOBI, dependency: OutputTypeHTML, version: 2, mimeType: "application/x-mobipocket-ebook", book: mobiBook})
+}
+
 func ToMobi(content []byte, title, author, outPath string) error {
+	return mobiBook([]chapter{{Title: title, Content: content}}, title, author, ebookMeta{Language: EbookLanguage}, DefaultConvertOptions, outPath)
+}
+
+// mobiBook writes a MOBI file with one chapter for each of chapters, which get indexed in its table of contents.
+func mobiBook(chapters []chapter, title, author string, meta ebookMeta, opts ConvertOptions, outPath string) (err error) {
 	m, err := mobi.NewWriter(outPath)
 	if err != nil {
 		return err
@@ -16,7 +33,59 @@ func ToMobi(content []byte, title, author, outPath string) error {
 	if author != "" {
 		m.NewExthRecord(mobi.EXTH_AUTHOR, author)
 	}
-	m.NewChapter(title, content)
+	if meta.Publisher != "" {
+		m.NewExthRecord(mobi.EXTH_PUBLISHER, meta.Publisher)
+	}
+	if subject := meta.mobiSubject(); subject != "" {
+		m.NewExthRecord(mobi.EXTH_SUBJECT, subject)
+	}
+	if !meta.Published.IsZero() {
+		m.NewExthRecord(mobi.EXTH_PUBLISHINGDATE, meta.Published.UTC().Format(time.RFC3339))
+	}
+	if meta.Source != "" {
+		m.NewExthRecord(mobi.EXTH_SOURCE, meta.Source)
+	}
+	if meta.Identifier != "" {
+		// NOTE(marius): the Kindle uses the ASIN for syncing and for matching the covers of the documents, which our
+		// identifiers are not, so we keep them as a source, like calibre does for its own ones
+		m.NewExthRecord(mobi.EXTH_SOURCE, meta.Identifier)
+	}
+	if meta.Language != "" {
+		m.NewExthRecord(mobi.EXTH_LANGUAGE, meta.Language)
+	}
+	if meta.Description != "" {
+		m.NewExthRecord(mobi.EXTH_DESCRIPTION, meta.Description)
+	}
+	if cover, thumb, ok := ebookCover(outPath); ok {
+		// NOTE(marius): the cover records come before the images of the content, which are indexed after them
+		m.AddCover(cover, thumb)
+	}
+	embedded := make(map[string]int)
+	for _, ch := range chapters {
+		content := ch.Content
+		for _, img := range ebookImages(content, outPath) {
+			index, ok := embedded[img.Src]
+			if !ok {
+				data, err := encodeJPEG(img.Path, opts)
+				if err != nil {
+					log.Printf("Unable to embed image %s: %s", img.Src, err)
+					continue
+				}
+				m.Embedded = append(m.Embedded, mobi.EmbeddedData{Type: mobiEmbImage, Data: data})
+				// NOTE(marius): the image records are referenced by their 1 based index
+				index = len(m.Embedded)
+				embedded[img.Src] = index
+			}
+			content = replaceSrc(content, img.Src, fmt.Sprintf(`recindex="%05d"`, index))
+		}
+		m.NewChapter(ch.Title, content)
+	}
+	// NOTE(marius): the writer panics on the errors of writing the file instead of returning them
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("unable to write MOBI: %v", r)
+		}
+	}()
 	// Output MOBI File
 	m.Write()
 	return nil
@@ -0,0 +1,51 @@
+package feeds
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/766b/mobi"
+)
+
+// exthRecords returns the values of the EXTH records of the MOBI file data, by their type.
+func exthRecords(t *testing.T, data []byte) map[uint32][]string {
+	t.Helper()
+	rec := data[binary.BigEndian.Uint32(data[pdbHeaderLen:]):]
+	exth := rec[mobiMagicOffset+int(binary.BigEndian.Uint32(rec[mobiHeaderLen:])):]
+	if string(exth[:4]) != "EXTH" {
+		t.Fatal("missing EXTH header")
+	}
+	records := make(map[uint32][]string)
+	count, pos := int(binary.BigEndian.Uint32(exth[8:])), 12
+	for i := 0; i < count; i++ {
+		typ, size := binary.BigEndian.Uint32(exth[pos:]), int(binary.BigEndian.Uint32(exth[pos+4:]))
+		records[typ] = append(records[typ], string(exth[pos+8:pos+size]))
+		pos += size
+	}
+	return records
+}
+
+func TestMobiBookIdentifier(t *testing.T) {
+	outPath := filepath.Join(t.TempDir(), "item.mobi")
+	meta := ebookMeta{Source: "https://example.com/chapter-1", Identifier: stableIdentifier("https://example.com/chapter-1")}
+	chapters := []chapter{{Title: "Chapter 1", Content: []byte("<p>Story text.</p>")}}
+	if err := mobiBook(chapters, "Chapter 1", "Author", meta, DefaultConvertOptions, outPath); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := exthRecords(t, data)
+	if asin, ok := records[uint32(mobi.EXTH_ASIN)]; ok {
+		t.Errorf("mobiBook() wrote the ASIN %v", asin)
+	}
+	for _, want := range []string{meta.Source, meta.Identifier} {
+		if !slices.Contains(records[uint32(mobi.EXTH_SOURCE)], want) {
+			t.Errorf("mobiBook() sources = %v, missing %s", records[uint32(mobi.EXTH_SOURCE)], want)
+		}
+	}
+}
@@ -0,0 +1,484 @@
+package feeds
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strings"
+
+	"github.com/jung-kurt/gofpdf"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/gobolditalic"
+	"golang.org/x/image/font/gofont/goitalic"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/gomonobold"
+	"golang.org/x/image/font/gofont/gomonobolditalic"
+	"golang.org/x/image/font/gofont/gomonoitalic"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	pdfFontFamily = "text"
+	pdfMonoFamily = "mono"
+
+	// pdfListIndent and pdfQuoteIndent are the indentations, in millimeters, of the list items and of the blockquotes
+	pdfListIndent  = 7.0
+	pdfQuoteIndent = 8.0
+)
+
+// PDFPageSizes are the page sizes in millimeters of the generated PDF files,
+// remarkable2 matches the screen of the reMarkable 2 tablet.
+var PDFPageSizes = map[string]gofpdf.SizeType{
+	"remarkable2": {Wd: 157.8, Ht: 210.4},
+	"a5":          {Wd: 148, Ht: 210},
+	"letter":      {Wd: 215.9, Ht: 279.4},
+}
+
+var pdfHeadingScale = map[atom.Atom]float64{
+	atom.H1: 1.6, atom.H2: 1.4, atom.H3: 1.25, atom.H4: 1.1, atom.H5: 1, atom.H6: 1,
+}
+
+var whitespaceRe = regexp.MustCompile(`\s+`)
+
+func init() {
+	RegisterConverter(format{typ: OutputTypePDF, dependency: OutputTypeHTML, mimeType: "application/pdf", book: pdfBook})
+}
+
+func ToPDF(content []byte, title, author, outPath string) error {
+	return pdfBook([]chapter{{Title: title, Content: content}}, title, author, ebookMeta{Language: EbookLanguage}, DefaultConvertOptions, outPath)
+}
+
+// pdfBook writes a PDF file with one chapter for each of chapters, starting on a new page and listed in its outline.
+func pdfBook(chapters []chapter, title, author string, meta ebookMeta, opts ConvertOptions, outPath string) error {
+	size, ok := PDFPageSizes[opts.PageSize]
+	if !ok {
+		return fmt.Errorf("invalid PDF page size %s", opts.PageSize)
+	}
+	pdf := gofpdf.NewCustom(&gofpdf.InitType{UnitStr: "mm", Size: size})
+	pdf.SetMargins(opts.Margin, opts.Margin, opts.Margin)
+	pdf.SetAutoPageBreak(true, opts.Margin+4)
+	pdf.SetTitle(title, true)
+	pdf.SetAuthor(author, true)
+	pdf.SetCreator("feed-sync", true)
+	if subject := meta.mobiSubject(); subject != "" {
+		pdf.SetSubject(subject, true)
+	}
+	pdfFonts(pdf, opts.Font)
+	if err := pdf.Error(); err != nil {
+		return fmt.Errorf("unable to load fonts: %w", err)
+	}
+
+	if cover, _, ok := ebookCover(outPath); ok {
+		pdf.AddPage()
+		imgOpts := gofpdf.ImageOptions{ImageType: "JPG"}
+		if info := pdf.RegisterImageOptions(cover, imgOpts); info != nil && pdf.Ok() {
+			w, h := info.Extent()
+			scale := math.Min(size.Wd/w, size.Ht/h)
+			w, h = w*scale, h*scale
+			pdf.ImageOptions(cover, (size.Wd-w)/2, (size.Ht-h)/2, w, h, false, imgOpts, 0, "")
+		}
+	}
+
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-opts.Margin - 2)
+		pdf.SetFont(pdfFontFamily, "", opts.FontSize*0.7)
+		pdf.CellFormat(0, 4, fmt.Sprintf("%d", pdf.PageNo()), "", 0, "C", false, 0, "")
+	})
+
+	for _, ch := range chapters {
+		r := pdfRenderer{pdf: pdf, opts: opts, size: opts.FontSize, fresh: true, images: make(map[string]string)}
+		for _, img := range ebookImages(ch.Content, outPath) {
+			r.images[img.Src] = img.Path
+		}
+		pdf.AddPage()
+		pdf.Bookmark(ch.Title, 0, -1)
+		r.heading(atom.H1, func() { r.text(ch.Title) })
+
+		doc, err := html.Parse(bytes.NewReader(ch.Content))
+		if err != nil {
+			return err
+		}
+		r.setFont()
+		if body := findElement(doc, atom.Body); body != nil {
+			r.walk(body)
+		}
+		if err = pdf.Error(); err != nil {
+			return fmt.Errorf("unable to render chapter %s: %w", ch.Title, err)
+		}
+	}
+	return pdf.OutputFileAndClose(outPath)
+}
+
+func pdfFonts(pdf *gofpdf.Fpdf, font string) {
+	if font != "" {
+		// NOTE(marius): a single font file is used for all the styles, so bold and italic text look like the regular one
+		for _, style := range []string{"", "B", "I", "BI"} {
+			pdf.AddUTF8Font(pdfFontFamily, style, font)
+		}
+	} else {
+		pdf.AddUTF8FontFromBytes(pdfFontFamily, "", goregular.TTF)
+		pdf.AddUTF8FontFromBytes(pdfFontFamily, "B", gobold.TTF)
+		pdf.AddUTF8FontFromBytes(pdfFontFamily, "I", goitalic.TTF)
+		pdf.AddUTF8FontFromBytes(pdfFontFamily, "BI", gobolditalic.TTF)
+	}
+	pdf.AddUTF8FontFromBytes(pdfMonoFamily, "", gomono.TTF)
+	pdf.AddUTF8FontFromBytes(pdfMonoFamily, "B", gomonobold.TTF)
+	pdf.AddUTF8FontFromBytes(pdfMonoFamily, "I", gomonoitalic.TTF)
+	pdf.AddUTF8FontFromBytes(pdfMonoFamily, "BI", gomonobolditalic.TTF)
+}
+
+type htmlList struct {
+	ordered bool
+	count   int
+}
+
+// pdfRenderer lays out the readable HTML of a chapter as flowing text.
+type pdfRenderer struct {
+	pdf    *gofpdf.Fpdf
+	opts   ConvertOptions
+	images map[string]string
+
+	size   float64
+	indent float64
+	bold   int
+	italic int
+	mono   int
+	pre    int
+	lists  []htmlList
+	// fresh is set at the start of a line, where the leading whitespace gets dropped
+	fresh bool
+}
+
+func (r *pdfRenderer) setFont() {
+	family := pdfFontFamily
+	if r.mono > 0 {
+		family = pdfMonoFamily
+	}
+	style := ""
+	if r.bold > 0 {
+		style += "B"
+	}
+	if r.italic > 0 {
+		style += "I"
+	}
+	r.pdf.SetFont(family, style, r.size)
+}
+
+// lineHeight returns the height of the lines of the current font size in millimeters.
+func (r *pdfRenderer) lineHeight() float64 {
+	return r.size * 25.4 / 72 * 1.4
+}
+
+func (r *pdfRenderer) left() float64 {
+	return r.opts.Margin + r.indent
+}
+
+func (r *pdfRenderer) width() float64 {
+	w, _ := r.pdf.GetPageSize()
+	return w - r.left() - r.opts.Margin
+}
+
+// newLine ends the current line, if it has any text.
+func (r *pdfRenderer) newLine() {
+	if !r.fresh {
+		r.pdf.Ln(r.lineHeight())
+		r.fresh = true
+	}
+}
+
+// paragraph ends the current block, leaving some space after it.
+func (r *pdfRenderer) paragraph() {
+	if r.fresh {
+		return
+	}
+	r.newLine()
+	r.pdf.Ln(r.lineHeight() * 0.4)
+}
+
+func (r *pdfRenderer) setIndent(delta float64) {
+	r.indent += delta
+	r.pdf.SetLeftMargin(r.left())
+	r.pdf.SetX(r.left())
+}
+
+// styled renders the children of n with the counter of one of the font styles incremented.
+func (r *pdfRenderer) styled(n *html.Node, counter *int) {
+	*counter++
+	r.setFont()
+	r.walk(n)
+	*counter--
+	r.setFont()
+}
+
+func (r *pdfRenderer) heading(a atom.Atom, fn func()) {
+	r.paragraph()
+	size := r.size
+	r.size = r.opts.FontSize * pdfHeadingScale[a]
+	r.bold++
+	r.setFont()
+	fn()
+	r.bold--
+	r.paragraph()
+	r.size = size
+	r.setFont()
+}
+
+func (r *pdfRenderer) walk(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		switch c.Type {
+		case html.TextNode:
+			r.text(c.Data)
+		case html.ElementNode:
+			r.element(c)
+		}
+	}
+}
+
+func (r *pdfRenderer) element(n *html.Node) {
+	switch n.DataAtom {
+	case atom.Script, atom.Style, atom.Head, atom.Noscript:
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		r.heading(n.DataAtom, func() { r.walk(n) })
+	case atom.P, atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Figure, atom.Figcaption, atom.Dl, atom.Dt:
+		r.paragraph()
+		r.walk(n)
+		r.paragraph()
+	case atom.Dd:
+		r.newLine()
+		r.setIndent(pdfListIndent)
+		r.walk(n)
+		r.newLine()
+		r.setIndent(-pdfListIndent)
+	case atom.Br:
+		r.pdf.Ln(r.lineHeight())
+		r.fresh = true
+	case atom.Hr:
+		r.paragraph()
+		y := r.pdf.GetY()
+		r.pdf.Line(r.left(), y, r.left()+r.width(), y)
+		r.pdf.Ln(r.lineHeight() * 0.4)
+	case atom.B, atom.Strong:
+		r.styled(n, &r.bold)
+	case atom.I, atom.Em, atom.Cite, atom.Var:
+		r.styled(n, &r.italic)
+	case atom.Code, atom.Kbd, atom.Samp, atom.Tt:
+		r.styled(n, &r.mono)
+	case atom.Pre:
+		r.paragraph()
+		r.pre++
+		r.styled(n, &r.mono)
+		r.pre--
+		r.fresh = false
+		r.paragraph()
+	case atom.Blockquote:
+		r.paragraph()
+		r.setIndent(pdfQuoteIndent)
+		r.styled(n, &r.italic)
+		r.paragraph()
+		r.setIndent(-pdfQuoteIndent)
+	case atom.Ul, atom.Ol:
+		r.paragraph()
+		r.lists = append(r.lists, htmlList{ordered: n.DataAtom == atom.Ol})
+		r.setIndent(pdfListIndent)
+		r.walk(n)
+		r.newLine()
+		r.setIndent(-pdfListIndent)
+		r.lists = r.lists[:len(r.lists)-1]
+		r.fresh = false
+		r.paragraph()
+	case atom.Li:
+		r.listItem(n)
+	case atom.Table:
+		r.table(n)
+	case atom.Img:
+		r.image(n)
+	default:
+		r.walk(n)
+	}
+}
+
+func (r *pdfRenderer) text(s string) {
+	if r.pre == 0 {
+		s = whitespaceRe.ReplaceAllString(s, " ")
+		if r.fresh {
+			s = strings.TrimLeft(s, " ")
+		}
+	}
+	if s == "" {
+		return
+	}
+	r.pdf.Write(r.lineHeight(), s)
+	r.fresh = false
+}
+
+func (r *pdfRenderer) listItem(n *html.Node) {
+	r.newLine()
+	marker := "•"
+	if len(r.lists) > 0 {
+		l := &r.lists[len(r.lists)-1]
+		l.count++
+		if l.ordered {
+			marker = fmt.Sprintf("%d.", l.count)
+		}
+	}
+	r.pdf.SetX(r.left() - pdfListIndent)
+	r.pdf.CellFormat(pdfListIndent-1, r.lineHeight(), marker, "", 0, "R", false, 0, "")
+	r.pdf.SetX(r.left())
+	r.walk(n)
+	r.newLine()
+}
+
+func (r *pdfRenderer) image(n *html.Node) {
+	src := attr(n, "src")
+	imgPath, ok := r.images[src]
+	if !ok {
+		return
+	}
+	data, err := encodeJPEG(imgPath, r.opts)
+	if err != nil {
+		log.Printf("Unable to embed image %s: %s", src, err)
+		return
+	}
+	opts := gofpdf.ImageOptions{ImageType: "JPG"}
+	info := r.pdf.RegisterImageOptionsReader(src, opts, bytes.NewReader(data))
+	if info == nil || !r.pdf.Ok() {
+		log.Printf("Unable to embed image %s: %s", src, r.pdf.Error())
+		r.pdf.ClearError()
+		return
+	}
+	_, pageHeight := r.pdf.GetPageSize()
+	maxW, maxH := r.width(), pageHeight-3*r.opts.Margin
+	w, h := info.Extent()
+	if w > maxW {
+		w, h = maxW, h*maxW/w
+	}
+	if h > maxH {
+		w, h = w*maxH/h, maxH
+	}
+	r.newLine()
+	r.pdf.ImageOptions(src, r.left()+(maxW-w)/2, -1, w, h, true, opts, 0, "")
+	r.pdf.SetX(r.left())
+	r.fresh = true
+}
+
+// table renders the text of the cells of the table in a grid of columns of equal width.
+func (r *pdfRenderer) table(n *html.Node) {
+	rows := make([][]*html.Node, 0)
+	cols := 0
+	var collect func(*html.Node)
+	collect = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode || c.DataAtom == atom.Table {
+				continue
+			}
+			if c.DataAtom != atom.Tr {
+				collect(c)
+				continue
+			}
+			row := make([]*html.Node, 0)
+			for cell := c.FirstChild; cell != nil; cell = cell.NextSibling {
+				if cell.Type == html.ElementNode && (cell.DataAtom == atom.Td || cell.DataAtom == atom.Th) {
+					row = append(row, cell)
+				}
+			}
+			if len(row) > cols {
+				cols = len(row)
+			}
+			rows = append(rows, row)
+		}
+	}
+	collect(n)
+	if cols == 0 {
+		return
+	}
+
+	r.paragraph()
+	lh := r.lineHeight()
+	colW := r.width() / float64(cols)
+	_, pageHeight := r.pdf.GetPageSize()
+	for _, row := range rows {
+		texts := make([][]string, len(row))
+		height := lh
+		for i, cell := range row {
+			if cell.DataAtom == atom.Th {
+				r.bold++
+			}
+			r.setFont()
+			texts[i] = r.splitText(strings.TrimSpace(whitespaceRe.ReplaceAllString(textContent(cell), " ")), colW-2)
+			if cell.DataAtom == atom.Th {
+				r.bold--
+			}
+			if h := float64(len(texts[i])) * lh; h > height {
+				height = h
+			}
+		}
+		height += 2
+		y := r.pdf.GetY()
+		if y+height > pageHeight-r.opts.Margin-4 {
+			r.pdf.AddPage()
+			y = r.pdf.GetY()
+		}
+		for i, cell := range row {
+			x := r.left() + float64(i)*colW
+			r.pdf.Rect(x, y, colW, height, "D")
+			if cell.DataAtom == atom.Th {
+				r.bold++
+			}
+			r.setFont()
+			for j, line := range texts[i] {
+				r.pdf.SetXY(x+1, y+1+float64(j)*lh)
+				r.pdf.CellFormat(colW-2, lh, line, "", 0, "L", false, 0, "")
+			}
+			if cell.DataAtom == atom.Th {
+				r.bold--
+			}
+		}
+		r.pdf.SetXY(r.left(), y+height)
+	}
+	r.setFont()
+	r.pdf.Ln(lh * 0.4)
+	r.fresh = true
+}
+
+// splitText wraps text in lines narrower than w with the current font.
+func (r *pdfRenderer) splitText(text string, w float64) []string {
+	lines := make([]string, 0)
+	line := ""
+	for _, word := range strings.Fields(text) {
+		next := strings.TrimSpace(line + " " + word)
+		if line != "" && r.pdf.GetStringWidth(next) > w {
+			lines = append(lines, line)
+			line = word
+			continue
+		}
+		line = next
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	s := strings.Builder{}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		s.WriteString(textContent(c))
+	}
+	return s.String()
+}
@@ -1,6 +1,7 @@
 package feeds
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"path"
@@ -28,7 +29,7 @@ func (p PocketDestination) Service() DestinationService {
 	return p.Target
 }
 
-func DispatchToPocket(disp DispatchItem) (bool, error) {
+func DispatchToPocket(ctx context.Context, disp DispatchItem) (bool, error) {
 	var target PocketDestination
 	if err := json.Unmarshal(disp.Destination.Credentials, &target); err != nil {
 		return false, err
@@ -48,8 +49,18 @@ func DispatchToPocket(disp DispatchItem) (bool, error) {
 
 	log.Printf("Sending %s %s to %s %s", cont.Type, path.Base(cont.Path), target.Username, target.Type())
 	client := api.NewClient(target.Target.ConsumerKey, target.AccessToken)
-	if err := client.Add(opt); err != nil {
-		return false, err
+	// NOTE(marius): the Pocket client doesn't take a context, so we stop waiting for it when ctx is done
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Add(opt)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return false, err
+		}
+	case <-ctx.Done():
+		return false, ctx.Err()
 	}
 
 	return true, nil
@@ -0,0 +1,154 @@
+package feeds
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+var (
+	// FetchWorkers is the number of the items fetched at the same time.
+	FetchWorkers = 8
+	// FetchPerHost is the number of the items fetched at the same time from one host, the items of a serial
+	// being usually on the same site.
+	FetchPerHost = 2
+	// FetchDelay is the pause between the fetches from one host, so the sites don't throttle or ban us.
+	FetchDelay = defaultSleepAfterBatch
+	// ConvertWorkers is the number of the items converted at the same time, the conversions being CPU bound.
+	ConvertWorkers = runtime.NumCPU()
+	// DispatchWorkers is the number of the ebooks sent at the same time, one by default as the SMTP servers
+	// limit the rate of the messages.
+	DispatchWorkers = 1
+	// ProgressInterval is the least time between the progress reports of the worker pools.
+	ProgressInterval = 10 * time.Second
+	// FetchTimeout is the longest time a fetch of a feed, of an article or of an image can take.
+	FetchTimeout = time.Minute
+	// DispatchTimeout is the longest time sending an ebook to a destination can take.
+	DispatchTimeout = 2 * time.Minute
+	// ConvertTimeout is the longest time converting an item to the ebook types can take, the types which
+	// weren't started by then being left out.
+	ConvertTimeout = 5 * time.Minute
+)
+
+// NotifyContext returns a context which is done on the first SIGINT or SIGTERM, after which the worker pools
+// finish the jobs in progress and stop, a second signal terminating the process right away.
+func NotifyContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+// runPool calls work for each of the n jobs from at most workers goroutines, logging the progress under name.
+// It stops starting new jobs when ctx is done or when a job returns an error. The jobs get a context cancelled with
+// ctx for waiting, and use context.WithoutCancel for the work which must finish cleanly once started, within its
+// own timeouts.
+func runPool(ctx context.Context, name string, n, workers int, work func(ctx context.Context, i int) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+	p := newProgress(name, n)
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(workers)
+	for i := 0; i < n && gctx.Err() == nil; i++ {
+		i := i
+		g.Go(func() error {
+			if gctx.Err() != nil {
+				// NOTE(marius): the context was done while waiting for a free worker
+				return nil
+			}
+			defer p.step()
+			return work(gctx, i)
+		})
+	}
+	err := g.Wait()
+	p.report()
+	if err == nil && ctx.Err() != nil {
+		log.Printf("%s stopped: %s", name, context.Cause(ctx))
+		err = ctx.Err()
+	}
+	return err
+}
+
+// progress logs the number of the finished jobs of a worker pool, and an estimate of the remaining time.
+type progress struct {
+	name  string
+	total int
+	start time.Time
+	done  atomic.Int64
+	last  atomic.Int64
+}
+
+func newProgress(name string, total int) *progress {
+	p := progress{name: name, total: total, start: time.Now()}
+	p.last.Store(p.start.UnixNano())
+	return &p
+}
+
+func (p *progress) step() {
+	p.done.Add(1)
+	now := time.Now().UnixNano()
+	last := p.last.Load()
+	if time.Duration(now-last) < ProgressInterval || !p.last.CompareAndSwap(last, now) {
+		return
+	}
+	p.report()
+}
+
+func (p *progress) report() {
+	done := int(p.done.Load())
+	elapsed := time.Since(p.start)
+	msg := fmt.Sprintf("%s %d/%d items in %s", p.name, done, p.total, elapsed.Round(time.Second))
+	if done > 0 && done < p.total {
+		left := elapsed / time.Duration(done) * time.Duration(p.total-done)
+		msg += fmt.Sprintf(", %s left", left.Round(time.Second))
+	}
+	log.Print(msg)
+}
+
+// hostLimiter limits the number of the requests made at the same time to each host, spacing them by delay.
+type hostLimiter struct {
+	mu    sync.Mutex
+	limit int
+	delay time.Duration
+	hosts map[string]chan struct{}
+}
+
+func newHostLimiter(limit int, delay time.Duration) *hostLimiter {
+	if limit < 1 {
+		limit = 1
+	}
+	return &hostLimiter{limit: limit, delay: delay, hosts: make(map[string]chan struct{})}
+}
+
+// acquire waits for a free slot for host, the returned function releases it after the delay.
+func (l *hostLimiter) acquire(ctx context.Context, host string) (func(), error) {
+	l.mu.Lock()
+	slots, ok := l.hosts[host]
+	if !ok {
+		slots = make(chan struct{}, l.limit)
+		l.hosts[host] = slots
+	}
+	l.mu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return func() {
+		time.Sleep(l.delay)
+		<-slots
+	}, nil
+}
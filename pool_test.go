@@ -0,0 +1,81 @@
+package feeds
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunPoolCancelsWaitingJobs(t *testing.T) {
+	hosts := newHostLimiter(1, 0)
+	// NOTE(marius): the only slot of the host is taken, so the jobs wait for it until the context is done
+	release, err := hosts.acquire(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started := atomic.Int64{}
+	done := make(chan error)
+	go func() {
+		done <- runPool(ctx, "Tested", 4, 2, func(ctx context.Context, i int) error {
+			release, err := hosts.acquire(ctx, "example.com")
+			if err != nil {
+				return nil
+			}
+			defer release()
+			started.Add(1)
+			return nil
+		})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("runPool() error = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("runPool() kept waiting for the host after the context was cancelled")
+	}
+	if n := started.Load(); n != 0 {
+		t.Errorf("runPool() started %d jobs, want 0", n)
+	}
+}
+
+func TestRunPool(t *testing.T) {
+	tests := []struct {
+		name    string
+		n       int
+		workers int
+		fail    int
+		wantErr bool
+	}{
+		{"no jobs", 0, 2, -1, false},
+		{"all jobs", 10, 3, -1, false},
+		{"no workers", 3, 0, -1, false},
+		{"failed job", 10, 1, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ran := atomic.Int64{}
+			err := runPool(context.Background(), "Tested", tt.n, tt.workers, func(ctx context.Context, i int) error {
+				ran.Add(1)
+				if i == tt.fail {
+					return errors.New("failed")
+				}
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("runPool() error = %v, want error %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && int(ran.Load()) != tt.n {
+				t.Errorf("runPool() ran %d jobs, want %d", ran.Load(), tt.n)
+			}
+		})
+	}
+}
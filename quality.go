@@ -0,0 +1,212 @@
+package feeds
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// The verdicts of the quality checks of the items.
+const (
+	// QualityOK is the verdict of the items passing the quality checks.
+	QualityOK = "ok"
+	// QualityRejected is the verdict of the items failing a quality check, which don't get ebooks generated.
+	QualityRejected = "rejected"
+	// QualityAccepted is the verdict of the rejected items a user accepted, which don't get checked anymore.
+	QualityAccepted = "accepted"
+)
+
+// The reasons of the rejected verdicts.
+const (
+	QualityTooShort     = "too short"
+	QualityNoParagraphs = "no paragraphs"
+	QualityErrorPage    = "error page"
+	QualityChallenge    = "captcha or bot challenge"
+	QualityLoginWall    = "login wall"
+)
+
+var (
+	// QualityMinWords is the least number of words of the readable HTML of an item, the interludes of the serials
+	// can be quite short so it only catches the pages which lost their text.
+	QualityMinWords = 50
+	// QualityMinParagraphs is the least number of paragraphs of the readable HTML of an item.
+	QualityMinParagraphs = 1
+	// qualityMarkersMaxWords is the number of words of the readable HTML under which it's checked for the
+	// error and login wall markers, the longer ones being articles which can contain them in their text.
+	qualityMarkersMaxWords = 300
+)
+
+// challengeMarkers are found in the raw pages of the captchas and of the bot challenges of Cloudflare and others.
+var challengeMarkers = []string{
+	"cf-browser-verification", "cf-challenge", "cf_chl_", "challenge-platform", "cf-turnstile",
+	"<title>just a moment...</title>", "attention required! | cloudflare", "checking your browser before accessing",
+	"enable javascript and cookies to continue", "g-recaptcha", "h-captcha", "hcaptcha.com", "ddos-guard",
+}
+
+// errorMarkers are found in the text of the error pages served with a successful status.
+var errorMarkers = []string{
+	"404 not found", "page not found", "this page doesn't exist", "this page does not exist",
+	"500 internal server error", "502 bad gateway", "503 service unavailable", "504 gateway timeout",
+	"error establishing a database connection", "the page you requested could not be found",
+}
+
+// loginMarkers are found in the text of the pages hiding their content to the anonymous users.
+var loginMarkers = []string{
+	"you must be logged in", "please log in to", "please login to", "log in to continue", "login to continue",
+	"sign in to continue", "sign in to read", "log in to read", "subscribe to continue reading",
+	"this content is for members only", "members only content", "this post is for paid subscribers",
+	"this post is for patrons", "become a patron to unlock", "is password protected",
+}
+
+// QualityCheck is the result of the quality checks of the content of an item.
+type QualityCheck struct {
+	Verdict    string
+	Reason     string
+	Words      int
+	Paragraphs int
+}
+
+func (q QualityCheck) Rejected() bool {
+	return q.Verdict == QualityRejected
+}
+
+// QualityError is returned for the items whose content was rejected by the quality checks.
+type QualityError struct {
+	Item  Item
+	Check QualityCheck
+}
+
+func (e QualityError) Error() string {
+	return fmt.Sprintf("item %d was rejected: %s (%d words, %d paragraphs)", e.Item.ID, e.Check.Reason, e.Check.Words, e.Check.Paragraphs)
+}
+
+// CheckQuality checks the readable HTML of an item, and the raw page it was extracted from, for the signs
+// of a page which doesn't contain the article: bot challenges, error pages, login walls or too little text.
+func CheckQuality(raw, readable []byte) QualityCheck {
+	q := QualityCheck{Verdict: QualityOK}
+	text := ""
+	if doc, err := html.Parse(bytes.NewReader(readable)); err == nil {
+		text = strings.ToLower(whitespaceRe.ReplaceAllString(textContent(doc), " "))
+		q.Paragraphs = countParagraphs(doc)
+	}
+	q.Words = len(strings.Fields(text))
+
+	reject := func(reason string) QualityCheck {
+		q.Verdict, q.Reason = QualityRejected, reason
+		return q
+	}
+	if q.Words < qualityMarkersMaxWords {
+		lowRaw := strings.ToLower(string(raw))
+		if containsAny(lowRaw, challengeMarkers) {
+			return reject(QualityChallenge)
+		}
+		if containsAny(text, errorMarkers) {
+			return reject(QualityErrorPage)
+		}
+		if containsAny(text, loginMarkers) {
+			return reject(QualityLoginWall)
+		}
+	}
+	if q.Words < QualityMinWords {
+		return reject(QualityTooShort)
+	}
+	if q.Paragraphs < QualityMinParagraphs {
+		return reject(QualityNoParagraphs)
+	}
+	return q
+}
+
+func containsAny(s string, markers []string) bool {
+	for _, m := range markers {
+		if strings.Contains(s, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// countParagraphs returns the number of the paragraphs of text, counting as one the text directly in the
+// other elements, except for the headings, the tables and the figure captions.
+func countParagraphs(n *html.Node) int {
+	switch n.DataAtom {
+	case atom.P, atom.Li, atom.Blockquote, atom.Pre, atom.Dd:
+		if strings.TrimSpace(textContent(n)) != "" {
+			return 1
+		}
+		return 0
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Table, atom.Figcaption, atom.Head:
+		return 0
+	}
+	cnt := 0
+	hasText := false
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		switch c.Type {
+		case html.TextNode:
+			hasText = hasText || strings.TrimSpace(c.Data) != ""
+		case html.ElementNode:
+			cnt += countParagraphs(c)
+		}
+	}
+	if hasText {
+		cnt++
+	}
+	return cnt
+}
+
+// checkItemQuality runs the quality checks on the readable HTML of the item and saves their verdict,
+// it returns a QualityError for the rejected ones. The items accepted by the users aren't checked again.
+func checkItemQuality(c *sql.DB, s Storage, it Item) error {
+	verdict, _, err := LoadItemQuality(c, it.ID)
+	if err != nil {
+		return err
+	}
+	if verdict == QualityAccepted {
+		return nil
+	}
+	readable, err := getItemContentForType(s, it, OutputTypeHTML)
+	if err != nil {
+		return err
+	}
+	raw, err := getItemContentForType(s, it, OutputTypeRAW)
+	if err != nil {
+		return err
+	}
+	q := CheckQuality(raw, readable)
+	if err = saveItemQuality(c, it.ID, q.Verdict, q.Reason); err != nil {
+		return err
+	}
+	if q.Rejected() {
+		return QualityError{Item: it, Check: q}
+	}
+	return nil
+}
+
+// LoadItemQuality loads the verdict of the quality checks of the item and the reason for rejecting it.
+func LoadItemQuality(c *sql.DB, itemID int) (string, string, error) {
+	var verdict, reason sql.NullString
+	err := c.QueryRow(`SELECT quality, quality_reason FROM items WHERE id = ?;`, itemID).Scan(&verdict, &reason)
+	return verdict.String, reason.String, err
+}
+
+func saveItemQuality(c *sql.DB, itemID int, verdict, reason string) error {
+	upd := `UPDATE items SET quality = ?, quality_reason = ? WHERE id = ?;`
+	_, err := c.Exec(upd, verdict, sql.NullString{String: reason, Valid: reason != ""}, itemID)
+	return err
+}
+
+// AcceptItem overrides the rejected verdict of the quality checks of the item, so it gets its ebooks generated.
+func AcceptItem(c *sql.DB, itemID int) error {
+	return saveItemQuality(c, itemID, QualityAccepted, "")
+}
+
+// RefetchItem resets the rejected item, so its page gets fetched again and checked anew.
+func RefetchItem(c *sql.DB, it Item) error {
+	if _, err := c.Exec(`UPDATE items SET quality = NULL, quality_reason = NULL WHERE id = ?;`, it.ID); err != nil {
+		return err
+	}
+	return MarkItemsAsFailed(c, it)
+}
@@ -1,12 +1,58 @@
 package feeds
 
 import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html"
 	"os"
 	"path"
+	"strings"
 
+	"github.com/PuerkitoBio/goquery"
 	"github.com/mariusor/go-readability"
 )
 
+func init() {
+	RegisterConverter(readabilityConverter{format{typ: OutputTypeHTML, dependency: OutputTypeRAW, mimeType: "text/html; charset=utf-8"}})
+}
+
+// readabilityConverter generates the readable HTML, extracted with the selectors of the options when they
+// match and without the boilerplate matched by their cleanup rules.
+type readabilityConverter struct {
+	format
+}
+
+func (r readabilityConverter) Convert(chapters []chapter, _, _ string, _ ebookMeta, opts ConvertOptions, outPath string) error {
+	if len(chapters) != 1 {
+		return fmt.Errorf("%s files can't contain %d chapters", r.typ, len(chapters))
+	}
+	return readableHtml(chapters[0].Content, opts.Selectors, opts.Cleanup, outPath)
+}
+
+// ExtractSelectors are the CSS selectors of the title and of the body of the articles of a feed, for the
+// sites where Readability keeps the wrong elements. Readability is still used when they don't match anything.
+type ExtractSelectors struct {
+	Title   string
+	Content string
+}
+
+// Validate returns an error for the first invalid selector.
+func (e ExtractSelectors) Validate() error {
+	for _, sel := range []string{e.Title, e.Content} {
+		if sel == "" {
+			continue
+		}
+		if err := validSelector(sel); err != nil {
+			return fmt.Errorf("invalid selector %q: %w", sel, err)
+		}
+	}
+	return nil
+}
+
+// extractedElements are the elements which are never part of the readable HTML extracted with the selectors.
+const extractedElements = "script, style, noscript, iframe, form, button, input, select, textarea"
+
 func Readability(content []byte) (*readability.Document, error) {
 	doc, err := readability.NewDocument(string(content))
 	if err != nil {
@@ -24,8 +70,58 @@ func Readability(content []byte) (*readability.Document, error) {
 	return doc, nil
 }
 
-func ToReadableHtml(content []byte, title, author, outPath string) error {
+// ReadableContent returns the title and the readable HTML of the content, using the selectors when they
+// match and Readability otherwise.
+func ReadableContent(content []byte, sel ExtractSelectors) (string, []byte, error) {
+	title := ""
+	if sel.Title != "" || sel.Content != "" {
+		doc, err := goquery.NewDocumentFromReader(bytes.NewReader(content))
+		if err != nil {
+			return "", nil, err
+		}
+		if sel.Title != "" && validSelector(sel.Title) == nil {
+			title = strings.TrimSpace(whitespaceRe.ReplaceAllString(doc.Find(sel.Title).First().Text(), " "))
+		}
+		if sel.Content != "" && validSelector(sel.Content) == nil {
+			if body := doc.Find(sel.Content); body.Length() > 0 {
+				if title == "" {
+					title = strings.TrimSpace(doc.Find("title").First().Text())
+				}
+				body.Find(extractedElements).Remove()
+
+				buf := strings.Builder{}
+				buf.WriteString("<div>")
+				if title != "" && body.Find("h1").Length() == 0 {
+					// NOTE(marius): same as Readability's EnsureTitleInArticle
+					fmt.Fprintf(&buf, "<h1>%s</h1>", html.EscapeString(title))
+				}
+				body.Each(func(_ int, s *goquery.Selection) {
+					h, _ := goquery.OuterHtml(s)
+					buf.WriteString(h)
+				})
+				buf.WriteString("</div>")
+				return title, []byte(buf.String()), nil
+			}
+		}
+	}
+
 	doc, err := Readability(content)
+	if err != nil {
+		return "", nil, err
+	}
+	cont := doc.Content()
+	if title == "" {
+		title = doc.Title
+	}
+	return title, []byte(cont), nil
+}
+
+func ToReadableHtml(content []byte, title, author, outPath string) error {
+	return readableHtml(content, ExtractSelectors{}, nil, outPath)
+}
+
+func readableHtml(content []byte, sel ExtractSelectors, rules CleanupRules, outPath string) error {
+	_, cont, err := ReadableContent(content, sel)
 	if err != nil {
 		return err
 	}
@@ -35,9 +131,28 @@ func ToReadableHtml(content []byte, title, author, outPath string) error {
 			return err
 		}
 	}
-	cont := doc.Content()
-	if err = os.WriteFile(outPath, []byte(cont), 0644); err != nil {
+	if cont, err = rules.Apply(cont); err != nil {
+		return err
+	}
+	if err = os.WriteFile(outPath, cont, 0644); err != nil {
 		return err
 	}
 	return nil
 }
+
+// LoadFeedSelectors loads the extraction selectors of the feed.
+func LoadFeedSelectors(c *sql.DB, feedID int) (ExtractSelectors, error) {
+	var title, content sql.NullString
+	err := c.QueryRow(`SELECT title_selector, content_selector FROM feeds WHERE id = ?;`, feedID).Scan(&title, &content)
+	return ExtractSelectors{Title: title.String, Content: content.String}, err
+}
+
+// SaveFeedSelectors saves the extraction selectors of the feed, empty ones fall back to Readability.
+func SaveFeedSelectors(c *sql.DB, feedID int, sel ExtractSelectors) error {
+	if err := sel.Validate(); err != nil {
+		return err
+	}
+	upd := `UPDATE feeds SET title_selector = ?, content_selector = ? WHERE id = ?;`
+	_, err := c.Exec(upd, sql.NullString{String: sel.Title, Valid: sel.Title != ""}, sql.NullString{String: sel.Content, Valid: sel.Content != ""}, feedID)
+	return err
+}
@@ -0,0 +1,220 @@
+package feeds
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+)
+
+// feedConvertOptions returns the default conversion options with the extraction selectors, the stylesheet
+// and the cleanup rules of the feed.
+func feedConvertOptions(c *sql.DB, feedID int) ConvertOptions {
+	opts := DefaultConvertOptions
+	sel, err := LoadFeedSelectors(c, feedID)
+	if err != nil {
+		log.Printf("Unable to load selectors: %s", err.Error())
+	}
+	opts.Selectors = sel
+	if css, err := LoadFeedStylesheet(c, feedID); err != nil {
+		log.Printf("Unable to load stylesheet: %s", err.Error())
+	} else {
+		opts.FeedStylesheet = css
+	}
+	rules, err := LoadCleanupRules(c, feedID)
+	if err != nil {
+		log.Printf("Unable to load cleanup rules: %s", err.Error())
+	}
+	opts.Cleanup = rules
+	return opts
+}
+
+// staleContent returns if the content was generated by an older version of its converter or with other options
+// of its feed, or failed its validation. The contents without a hash are only checked for their version.
+func staleContent(cont Content, opts ConvertOptions) bool {
+	conv, ok := converters[cont.Type]
+	if !ok {
+		return false
+	}
+	if cont.Hash != "" && cont.Hash != contentHash(cont.Type, opts) {
+		return true
+	}
+	return cont.Version != conv.Version() || cont.Invalid != ""
+}
+
+// encodeOptions returns the options saved with the generated contents, the ones of the feed are loaded again
+// when they are regenerated.
+func encodeOptions(opts ConvertOptions) string {
+	data, err := json.Marshal(opts)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// contentOptions returns the options the content was generated with, over the ones of its feed, so the contents
+// are regenerated with the options of the command which generated them instead of the one regenerating them.
+func contentOptions(cont Content, feed ConvertOptions) ConvertOptions {
+	if cont.Options == "" {
+		return feed
+	}
+	opts := feed
+	if err := json.Unmarshal([]byte(cont.Options), &opts); err != nil {
+		log.Printf("Invalid options of content %d: %s", cont.ID, err)
+		return feed
+	}
+	return opts
+}
+
+// loadReprocessItems loads the items of the feed, or of all feeds for a zero feedID, which have generated contents,
+// skipping the ones rejected by the quality checks.
+func loadReprocessItems(c *sql.DB, feedID int) ([]Item, error) {
+	sel := `SELECT items.id, items.feed_index, items.guid, items.title, items.author, items.url, items.published_date, items.language,
+	feeds.id, feeds.title, feeds.author, feeds.language, contents.id, contents.type, contents.path, contents.size, contents.flags, contents.version, contents.rules_hash,
+	contents.options, contents.invalid
+FROM items
+	INNER JOIN feeds ON feeds.id = items.feed_id
+	INNER JOIN contents ON contents.item_id = items.id
+WHERE (feeds.id = ? OR ? = 0) AND (items.quality IS NULL OR items.quality != ?)
+ORDER BY items.feed_id, items.feed_index;`
+	s, err := c.Query(sel, feedID, feedID, QualityRejected)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	all := make([]Item, 0)
+	for s.Next() {
+		var (
+			it                       Item
+			cont                     Content
+			feedIndex                sql.NullInt32
+			guid, itURL, published   sql.NullString
+			author, feedAuthor, hash sql.NullString
+			options, invalid         sql.NullString
+			lang, feedLang           sql.NullString
+			size                     sql.NullInt64
+			flags, version           sql.NullInt32
+		)
+		err = s.Scan(&it.ID, &feedIndex, &guid, &it.Title, &author, &itURL, &published, &lang, &it.Feed.ID, &it.Feed.Title, &feedAuthor, &feedLang,
+			&cont.ID, &cont.Type, &cont.Path, &size, &flags, &version, &hash, &options, &invalid)
+		if err != nil {
+			return nil, err
+		}
+		cont.Size, cont.Flags, cont.Version, cont.Hash = size.Int64, int(flags.Int32), int(version.Int32), hash.String
+		cont.Options, cont.Invalid = options.String, invalid.String
+		if l := len(all); l > 0 && all[l-1].ID == it.ID {
+			all[l-1].Content[cont.Type] = cont
+			continue
+		}
+		it.FeedIndex = int(feedIndex.Int32)
+		it.GUID, it.Author, it.Feed.Author = guid.String, author.String, feedAuthor.String
+		it.Language, it.Feed.Language = lang.String, feedLang.String
+		it.URL, _ = url.Parse(itURL.String)
+		it.Published, _ = time.Parse(time.RFC3339Nano, published.String)
+		it.Content = map[string]Content{cont.Type: cont}
+		all = append(all, it)
+	}
+	return all, s.Err()
+}
+
+// reprocessItem regenerates from the raw content the contents of the item which are stale, or all of them
+// when force is set, together with the ones depending on them. It returns the regenerated types.
+func reprocessItem(ctx context.Context, c *sql.DB, s Storage, it *Item, opts ConvertOptions, force bool) ([]string, error) {
+	regenerated := make(map[string]bool)
+	types := make([]string, 0)
+	for _, typ := range EbookTypes() {
+		cont, ok := it.Content[typ]
+		if !ok || cont.Flags&FlagsDisabled == FlagsDisabled {
+			continue
+		}
+		if !force && !regenerated[converters[typ].Dependency()] && !staleContent(cont, opts) {
+			continue
+		}
+		delete(it.Content, typ)
+		if _, err := generateItemContent(typ, s, it, contentOptions(cont, opts), true); err != nil {
+			it.Content[typ] = cont
+			return types, fmt.Errorf("unable to regenerate %s: %w", typ, err)
+		}
+		if typ == OutputTypeHTML {
+			if err := checkItemQuality(c, s, *it); err != nil {
+				it.Content[typ] = cont
+				return types, err
+			}
+			if err := fetchImages(ctx, c, s, it); err != nil {
+				log.Printf("Unable to save images: %s", err.Error())
+			}
+			if err := updateItemText(c, s, it); err != nil {
+				log.Printf("Unable to index the text: %s", err.Error())
+			}
+		}
+		updated := it.Content[typ]
+		updated.ID = cont.ID
+		if err := updateContent(c, updated); err != nil {
+			return types, err
+		}
+		it.Content[typ] = updated
+		regenerated[typ] = true
+		types = append(types, typ)
+	}
+	return types, nil
+}
+
+// updateContent saves the path, the size, the converter version, the options and their hash, and the validation of
+// the regenerated content, its creation date is kept so the subscriptions' back period still applies.
+func updateContent(c *sql.DB, cont Content) error {
+	upd := `UPDATE contents SET path = ?, size = ?, version = ?, rules_hash = ?, options = ?, invalid = ? WHERE id = ?;`
+	_, err := c.Exec(upd, cont.Path, cont.Size, cont.Version, cont.Hash, cont.Options, cont.Invalid, cont.ID)
+	return err
+}
+
+// resetDispatched marks the item as not dispatched to any of the destinations it was sent to.
+func resetDispatched(c *sql.DB, it Item) error {
+	_, err := c.Exec(`UPDATE dispatched SET last_status = ? WHERE item_id = ?;`, false, it.ID)
+	return err
+}
+
+// reprocessItems regenerates the stale contents of the items, it returns the number of reprocessed items.
+func reprocessItems(ctx context.Context, c *sql.DB, s Storage, items []Item, force, redispatch bool) (int, error) {
+	opts := make(map[int]ConvertOptions)
+	errs := make([]error, 0)
+	count := 0
+	for i := range items {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		it := &items[i]
+		o, ok := opts[it.Feed.ID]
+		if !ok {
+			o = feedConvertOptions(c, it.Feed.ID)
+			opts[it.Feed.ID] = o
+			if err := loadFeedImages(ctx, c, s, &it.Feed); err != nil {
+				log.Printf("Unable to load feed images: %s", err.Error())
+			}
+		}
+		if i > 0 && items[i-1].Feed.ID == it.Feed.ID {
+			it.Feed = items[i-1].Feed
+		}
+		types, err := reprocessItem(ctx, c, s, it, o, force)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("item %d: %w", it.ID, err))
+			continue
+		}
+		if len(types) == 0 {
+			continue
+		}
+		count++
+		log.Printf("Reprocessed [%5d] %s: %v", it.FeedIndex, it.Title, types)
+		if redispatch {
+			if err = resetDispatched(c, *it); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return count, errors.Join(errs...)
+}
@@ -0,0 +1,129 @@
+package feeds
+
+import (
+	"testing"
+)
+
+func TestStaleContent(t *testing.T) {
+	// NOTE(marius): the ebook command generates the contents with the options of its flags, which the commands
+	// checking them don't know about
+	ebook := DefaultConvertOptions
+	ebook.Compression = "zstd"
+	ebook.Typography = true
+	ebook.Grayscale = true
+	ebook.Stylesheet = "p { margin: 0; }"
+	ebook.FeedStylesheet = "body { font-family: serif; }"
+	ebook.Cleanup = CleanupRules{{FeedID: 1, Type: CleanupLeading, Value: "^Previous"}}
+
+	feed := DefaultConvertOptions
+	feed.FeedStylesheet = ebook.FeedStylesheet
+	feed.Cleanup = ebook.Cleanup
+
+	content := func(typ string, opts ConvertOptions) Content {
+		return Content{Type: typ, Version: converters[typ].Version(), Hash: contentHash(typ, opts)}
+	}
+	withStylesheet := feed
+	withStylesheet.FeedStylesheet = "body { font-family: sans-serif; }"
+	withRules := feed
+	withRules.Cleanup = nil
+
+	tests := []struct {
+		name  string
+		cont  Content
+		opts  ConvertOptions
+		stale bool
+	}{
+		{"epub with the options of another command", content(OutputTypeEPUB, ebook), feed, false},
+		{"mobi with the options of another command", content(OutputTypeMOBI, ebook), feed, false},
+		{"html with the options of another command", content(OutputTypeHTML, ebook), feed, false},
+		{"epub after changing the feed stylesheet", content(OutputTypeEPUB, ebook), withStylesheet, true},
+		{"azw3 after changing the feed stylesheet", content(OutputTypeAZW3, ebook), withStylesheet, true},
+		{"pdf after changing the feed stylesheet", content(OutputTypePDF, ebook), withStylesheet, false},
+		{"html after changing the cleanup rules", content(OutputTypeHTML, ebook), withRules, true},
+		{"epub after changing the cleanup rules", content(OutputTypeEPUB, ebook), withRules, false},
+		{"older converter version", Content{Type: OutputTypeEPUB, Version: 1, Hash: contentHash(OutputTypeEPUB, feed)}, feed, true},
+		{"without a version", Content{Type: OutputTypeEPUB}, feed, true},
+		{"without a hash", Content{Type: OutputTypeEPUB, Version: converters[OutputTypeEPUB].Version()}, withStylesheet, false},
+		{"invalid", Content{Type: OutputTypeMOBI, Version: converters[OutputTypeMOBI].Version(), Invalid: "invalid mobi: no text"}, feed, true},
+		{"unknown type", Content{Type: OutputTypeRAW}, feed, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := staleContent(tt.cont, tt.opts); got != tt.stale {
+				t.Errorf("staleContent() = %t, want %t", got, tt.stale)
+			}
+		})
+	}
+}
+
+func TestContentOptions(t *testing.T) {
+	ebook := DefaultConvertOptions
+	ebook.Compression = "gzip"
+	ebook.Typography = true
+	ebook.ImageWidth = 600
+	ebook.Stylesheet = "p { margin: 0; }"
+	ebook.FeedStylesheet = "body { font-family: serif; }"
+
+	feed := DefaultConvertOptions
+	feed.FeedStylesheet = "body { font-family: sans-serif; }"
+	feed.Selectors = ExtractSelectors{Content: "div.entry"}
+
+	tests := []struct {
+		name string
+		cont Content
+		want ConvertOptions
+	}{
+		{"without options", Content{}, feed},
+		{"invalid options", Content{Options: "{"}, feed},
+		{"with options", Content{Options: encodeOptions(ebook)}, func() ConvertOptions {
+			want := ebook
+			want.FeedStylesheet, want.Selectors = feed.FeedStylesheet, feed.Selectors
+			return want
+		}()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := contentOptions(tt.cont, feed)
+			if got.Compression != tt.want.Compression || got.Typography != tt.want.Typography || got.ImageWidth != tt.want.ImageWidth ||
+				got.Stylesheet != tt.want.Stylesheet || got.FeedStylesheet != tt.want.FeedStylesheet || got.Selectors != tt.want.Selectors {
+				t.Errorf("contentOptions() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDestinationOptions(t *testing.T) {
+	defaults := DefaultConvertOptions
+	defer func() { DefaultConvertOptions = defaults }()
+	// NOTE(marius): the ebook command changes the defaults, the dispatch must not depend on it
+	DefaultConvertOptions.Compression = "zstd"
+	DefaultConvertOptions.Typography = true
+
+	tests := []struct {
+		name     string
+		creds    string
+		override bool
+		wantErr  bool
+	}{
+		{"without options", `{"to":"x@kindle.com"}`, false, false},
+		{"null options", `{"options":null}`, false, false},
+		{"empty options", `{"options":{}}`, false, false},
+		{"grayscale", `{"options":{"grayscale":true}}`, true, false},
+		{"default value", `{"options":{"images":true}}`, true, false},
+		{"invalid options", `{"options":{"image_width":"wide"}}`, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, override, err := destinationOptions(Destination{Type: "myk", Credentials: []byte(tt.creds)})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("destinationOptions() error = %v, want error %t", err, tt.wantErr)
+			}
+			if override != tt.override {
+				t.Errorf("destinationOptions() override = %t, want %t", override, tt.override)
+			}
+			if err == nil && !opts.Typography {
+				t.Errorf("destinationOptions() lost the default options: %+v", opts)
+			}
+		})
+	}
+}
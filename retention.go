@@ -0,0 +1,204 @@
+package feeds
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// RetentionPolicy specifies for how many days the contents of a type are kept.
+// The days are counted from the creation of the content, or when AfterDispatch is set, from the
+// last time the item was successfully dispatched. A policy with a zero FeedID applies to all feeds
+// which don't have their own policy for the same type of content.
+type RetentionPolicy struct {
+	ID            int
+	FeedID        int
+	Type          string
+	Days          int
+	AfterDispatch bool
+}
+
+func (p RetentionPolicy) expired(created, dispatched time.Time) bool {
+	ref := created
+	if p.AfterDispatch {
+		if dispatched.IsZero() {
+			return false
+		}
+		ref = dispatched
+	}
+	if ref.IsZero() {
+		return false
+	}
+	return time.Now().UTC().Sub(ref) > time.Duration(p.Days)*24*time.Hour
+}
+
+type retentionPolicies map[int]map[string]RetentionPolicy
+
+func (rp retentionPolicies) find(feedID int, typ string) (RetentionPolicy, bool) {
+	if p, ok := rp[feedID][typ]; ok {
+		return p, true
+	}
+	p, ok := rp[0][typ]
+	return p, ok
+}
+
+func LoadRetentionPolicies(c *sql.DB) ([]RetentionPolicy, error) {
+	sel := `SELECT id, feed_id, type, days, after_dispatch FROM retention_policies;`
+	s, err := c.Query(sel)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	all := make([]RetentionPolicy, 0)
+	for s.Next() {
+		p := RetentionPolicy{}
+		var feedID sql.NullInt32
+		if err = s.Scan(&p.ID, &feedID, &p.Type, &p.Days, &p.AfterDispatch); err != nil {
+			return nil, err
+		}
+		p.FeedID = int(feedID.Int32)
+		all = append(all, p)
+	}
+	return all, nil
+}
+
+// GCReport holds the results of a garbage collection run.
+type GCReport struct {
+	MissingContents int
+	ExpiredContents int
+	OrphanFiles     int
+	Reclaimed       int64
+}
+
+// gcGracePeriod is the age files in the storage need to have before being considered orphans,
+// to avoid removing the ones that are just being saved by a concurrently running command.
+var gcGracePeriod = time.Hour
+
+type gcContent struct {
+	Content
+	FeedID     int
+	Loaded     time.Time
+	Dispatched time.Time
+}
+
+func loadGCContents(c *sql.DB) ([]gcContent, error) {
+	sel := `SELECT c.id, c.type, c.path, c.flags, c.created, i.feed_id, i.last_loaded,
+	(SELECT MAX(d.last_try) FROM dispatched d WHERE d.item_id = i.id AND d.last_status = ?)
+FROM contents c INNER JOIN items i ON i.id = c.item_id;`
+	s, err := c.Query(sel, true)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	all := make([]gcContent, 0)
+	for s.Next() {
+		var (
+			cont                        gcContent
+			path                        sql.NullString
+			created, loaded, dispatched sql.NullString
+		)
+		err = s.Scan(&cont.ID, &cont.Type, &path, &cont.Flags, &created, &cont.FeedID, &loaded, &dispatched)
+		if err != nil {
+			return nil, err
+		}
+		cont.Path = path.String
+		cont.Created, _ = time.Parse(time.RFC3339Nano, created.String)
+		cont.Loaded, _ = time.Parse(time.RFC3339Nano, loaded.String)
+		cont.Dispatched, _ = time.Parse(time.RFC3339Nano, dispatched.String)
+		all = append(all, cont)
+	}
+	return all, nil
+}
+
+// CollectGarbage reconciles the contents table with the files in the storage:
+// it removes the rows of contents whose files are missing, disables the contents expired according
+// to the retention policies, and deletes the files which are not referenced by any enabled content.
+// When dryRun is set, nothing is changed, only the report is computed.
+func CollectGarbage(c *sql.DB, s Storage, dryRun bool) (GCReport, error) {
+	report := GCReport{}
+
+	policies, err := LoadRetentionPolicies(c)
+	if err != nil {
+		return report, err
+	}
+	rp := make(retentionPolicies)
+	for _, p := range policies {
+		if rp[p.FeedID] == nil {
+			rp[p.FeedID] = make(map[string]RetentionPolicy)
+		}
+		rp[p.FeedID][p.Type] = p
+	}
+
+	contents, err := loadGCContents(c)
+	if err != nil {
+		return report, err
+	}
+
+	referenced := make(map[string]bool)
+	for _, cont := range contents {
+		if cont.Flags&FlagsDisabled == FlagsDisabled {
+			continue
+		}
+		if cont.Path == "" || !blobExists(s, cont.Path) {
+			log.Printf("Removing content %d %s, file %q is missing", cont.ID, cont.Type, cont.Path)
+			report.MissingContents++
+			if !dryRun {
+				if _, err = c.Exec(`DELETE FROM contents WHERE id = ?;`, cont.ID); err != nil {
+					return report, err
+				}
+			}
+			continue
+		}
+		created := cont.Created
+		if created.IsZero() {
+			created = cont.Loaded
+		}
+		if p, ok := rp.find(cont.FeedID, cont.Type); ok && p.expired(created, cont.Dispatched) {
+			log.Printf("Expiring content %d %s %q", cont.ID, cont.Type, cont.Path)
+			report.ExpiredContents++
+			if !dryRun {
+				if _, err = c.Exec(`UPDATE contents SET flags = ? WHERE id = ?;`, cont.Flags|FlagsDisabled, cont.ID); err != nil {
+					return report, err
+				}
+			}
+			continue
+		}
+		referenced[cont.Path] = true
+	}
+
+	for _, sel := range []string{`SELECT path FROM images;`, `SELECT path FROM volumes;`, `SELECT icon FROM feeds WHERE icon IS NOT NULL;`, `SELECT cover FROM feeds WHERE cover IS NOT NULL;`} {
+		paths, err := c.Query(sel)
+		if err != nil {
+			return report, err
+		}
+		for paths.Next() {
+			var name string
+			if err = paths.Scan(&name); err != nil {
+				paths.Close()
+				return report, err
+			}
+			referenced[name] = true
+		}
+		paths.Close()
+	}
+
+	for _, dir := range storageDirs {
+		err = s.Walk(dir, func(info BlobInfo) error {
+			if referenced[info.Name] || time.Since(info.ModTime) < gcGracePeriod {
+				return nil
+			}
+			report.OrphanFiles++
+			report.Reclaimed += info.Size
+			if dryRun {
+				return nil
+			}
+			return s.Remove(info.Name)
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
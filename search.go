@@ -0,0 +1,220 @@
+package feeds
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html"
+	"log"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// The markers of the matched terms in the snippets, replaced with mark elements after escaping the text.
+const (
+	searchMarkStart = "\uE000"
+	searchMarkEnd   = "\uE001"
+)
+
+// SearchLimit is the default number of the results of a search.
+var SearchLimit = 50
+
+// SearchQuery holds the text searched for in the items, of one feed or of all of them for a zero FeedID.
+type SearchQuery struct {
+	Text   string
+	FeedID int
+	Limit  int
+	Offset int
+}
+
+// SearchResult is an item matching a search, with a snippet of its text around the matches.
+type SearchResult struct {
+	Item Item
+	// Snippet is HTML escaped, with the matched terms in mark elements.
+	Snippet string
+}
+
+// indexItem saves the text of the item to the search index, replacing the previous one.
+func indexItem(c *sql.DB, it Item, text string) error {
+	id := searchID(c)
+	tx, err := c.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(fmt.Sprintf(`DELETE FROM items_search WHERE %s = ?;`, id), it.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	ins := fmt.Sprintf(`INSERT INTO items_search (%s, title, body) VALUES (?, ?, ?);`, id)
+	if _, err = tx.Exec(ins, it.ID, it.Title, text); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// searchID returns the column of the search index holding the item ids, the rowid of the FTS5 table for SQLite.
+func searchID(c *sql.DB) string {
+	if isPostgres(c) {
+		return "item_id"
+	}
+	return "rowid"
+}
+
+// ftsQuery turns the text typed by the users into an FTS5 query matching all of its words, and the phrases
+// in double quotes, so the operators and the unbalanced quotes don't end up as syntax errors.
+func ftsQuery(text string) string {
+	terms := make([]string, 0)
+	for i, part := range strings.Split(text, `"`) {
+		if i%2 == 1 {
+			if part = strings.TrimSpace(part); part != "" {
+				terms = append(terms, `"`+part+`"`)
+			}
+			continue
+		}
+		for _, word := range strings.FieldsFunc(part, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '\'' && r != '-'
+		}) {
+			terms = append(terms, `"`+word+`"`)
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
+// Search returns the items whose title or text match the query, in the order of the feed for the searches
+// scoped to one, so the first result is the first chapter the terms appear in, or by relevance otherwise.
+func Search(c *sql.DB, q SearchQuery) ([]SearchResult, error) {
+	if strings.TrimSpace(q.Text) == "" {
+		return nil, nil
+	}
+	if q.Limit <= 0 {
+		q.Limit = SearchLimit
+	}
+
+	var (
+		sel  string
+		args []any
+	)
+	if isPostgres(c) {
+		order := "rank DESC"
+		if q.FeedID != 0 {
+			order = "items.feed_index, items.id"
+		}
+		opts := fmt.Sprintf(`StartSel=%s, StopSel=%s, MaxWords=30, MinWords=10, MaxFragments=2, FragmentDelimiter=" … "`,
+			searchMarkStart, searchMarkEnd)
+		sel = fmt.Sprintf(`SELECT items.id, items.feed_index, items.title, items.url, items.published_date, feeds.id, feeds.title,
+	ts_headline('simple', items_search.body, query, ?), ts_rank(items_search.document, query) AS rank
+FROM items_search
+	INNER JOIN items ON items.id = items_search.item_id
+	INNER JOIN feeds ON feeds.id = items.feed_id,
+	websearch_to_tsquery('simple', ?) query
+WHERE items_search.document @@ query AND (items.feed_id = ? OR ? = 0)
+ORDER BY %s LIMIT ? OFFSET ?;`, order)
+		args = []any{opts, q.Text, q.FeedID, q.FeedID, q.Limit, q.Offset}
+	} else {
+		match := ftsQuery(q.Text)
+		if match == "" {
+			return nil, nil
+		}
+		order := "items_search.rank"
+		if q.FeedID != 0 {
+			order = "items.feed_index, items.id"
+		}
+		sel = fmt.Sprintf(`SELECT items.id, items.feed_index, items.title, items.url, items.published_date, feeds.id, feeds.title,
+	snippet(items_search, -1, ?, ?, ' … ', 24)
+FROM items_search
+	INNER JOIN items ON items.id = items_search.rowid
+	INNER JOIN feeds ON feeds.id = items.feed_id
+WHERE items_search MATCH ? AND (items.feed_id = ? OR ? = 0)
+ORDER BY %s LIMIT ? OFFSET ?;`, order)
+		args = []any{searchMarkStart, searchMarkEnd, match, q.FeedID, q.FeedID, q.Limit, q.Offset}
+	}
+
+	s, err := c.Query(sel, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	results := make([]SearchResult, 0)
+	for s.Next() {
+		var (
+			r                SearchResult
+			feedIndex        sql.NullInt32
+			itURL, published sql.NullString
+			snippet          string
+			rank             sql.NullFloat64
+			dest             = []any{&r.Item.ID, &feedIndex, &r.Item.Title, &itURL, &published, &r.Item.Feed.ID, &r.Item.Feed.Title, &snippet}
+		)
+		if isPostgres(c) {
+			dest = append(dest, &rank)
+		}
+		if err = s.Scan(dest...); err != nil {
+			return nil, err
+		}
+		r.Item.FeedIndex = int(feedIndex.Int32)
+		r.Item.URL, _ = url.Parse(itURL.String)
+		r.Item.Published, _ = time.Parse(time.RFC3339Nano, published.String)
+		r.Snippet = highlightSnippet(snippet)
+		results = append(results, r)
+	}
+	return results, s.Err()
+}
+
+// highlightSnippet escapes the snippet and replaces the markers of the matched terms with mark elements.
+func highlightSnippet(snippet string) string {
+	snippet = html.EscapeString(whitespaceRe.ReplaceAllString(snippet, " "))
+	return strings.NewReplacer(searchMarkStart, "<mark>", searchMarkEnd, "</mark>").Replace(snippet)
+}
+
+// loadIndexItems loads the items of the feed, or of all feeds for a zero feedID, which have readable HTML
+// but aren't in the search index yet or don't have reading statistics or a language, or all of them when rebuild is set.
+func loadIndexItems(c *sql.DB, feedID int, rebuild bool) ([]Item, error) {
+	sel := fmt.Sprintf(`SELECT items.id, items.title, contents.id, contents.path, contents.type, raw.id, raw.path FROM items
+	INNER JOIN contents ON contents.item_id = items.id AND contents.type = ? AND contents.flags != ?
+	LEFT JOIN contents raw ON raw.item_id = items.id AND raw.type = ?
+WHERE (items.feed_id = ? OR ? = 0) AND (items.quality IS NULL OR items.quality != ?)
+	AND (? OR items.words IS NULL OR items.language IS NULL OR NOT EXISTS (SELECT 1 FROM items_search WHERE items_search.%s = items.id))
+ORDER BY items.feed_id, items.feed_index;`, searchID(c))
+	s, err := c.Query(sel, OutputTypeHTML, FlagsDisabled, OutputTypeRAW, feedID, feedID, QualityRejected, rebuild)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	all := make([]Item, 0)
+	for s.Next() {
+		var (
+			it      Item
+			cont    Content
+			rawID   sql.NullInt32
+			rawPath sql.NullString
+		)
+		if err = s.Scan(&it.ID, &it.Title, &cont.ID, &cont.Path, &cont.Type, &rawID, &rawPath); err != nil {
+			return nil, err
+		}
+		it.Content = map[string]Content{cont.Type: cont}
+		if rawID.Valid && rawPath.Valid {
+			it.Content[OutputTypeRAW] = Content{ID: int(rawID.Int32), Path: rawPath.String, Type: OutputTypeRAW}
+		}
+		all = append(all, it)
+	}
+	return all, s.Err()
+}
+
+// indexItems adds the items to the search index and saves their reading statistics, it returns the number of the indexed ones.
+func indexItems(ctx context.Context, c *sql.DB, s Storage, items []Item) (int, error) {
+	count := atomic.Int64{}
+	err := runPool(ctx, "Indexed", len(items), ConvertWorkers, func(ctx context.Context, i int) error {
+		if err := updateItemText(c, s, &items[i]); err != nil {
+			log.Printf("Unable to index [%d] %s: %s", items[i].ID, items[i].Title, err)
+			return nil
+		}
+		count.Add(1)
+		return nil
+	})
+	return int(count.Load()), err
+}
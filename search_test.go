@@ -0,0 +1,49 @@
+package feeds
+
+import (
+	"testing"
+)
+
+func TestFtsQuery(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"empty", "", ""},
+		{"words", "dragon  sword", `"dragon" "sword"`},
+		{"phrase", `the "golden dragon" awakens`, `"the" "golden dragon" "awakens"`},
+		{"unbalanced quote", `"golden dragon`, `"golden dragon"`},
+		{"empty phrase", `"" dragon`, `"dragon"`},
+		{"operators", "dragon AND (sword OR -shield) NEAR/2 *", `"dragon" "AND" "sword" "OR" "-shield" "NEAR" "2"`},
+		{"apostrophes and hyphens", "Erin's well-known inn", `"Erin's" "well-known" "inn"`},
+		{"unicode", "異世界 café", `"異世界" "café"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ftsQuery(tt.text); got != tt.want {
+				t.Errorf("ftsQuery(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHighlightSnippet(t *testing.T) {
+	tests := []struct {
+		name    string
+		snippet string
+		want    string
+	}{
+		{"plain", "the inn", "the inn"},
+		{"marked", "the " + searchMarkStart + "inn" + searchMarkEnd + " opened", "the <mark>inn</mark> opened"},
+		{"escaped", searchMarkStart + "<b>" + searchMarkEnd + " & co", "<mark>&lt;b&gt;</mark> &amp; co"},
+		{"whitespace", "the\n\n  inn", "the inn"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := highlightSnippet(tt.snippet); got != tt.want {
+				t.Errorf("highlightSnippet(%q) = %q, want %q", tt.snippet, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,7 @@
+-- remove the sharing buttons and the chapter navigation from all feeds
+insert into cleanup_rules (type, value) values ('remove', '.sharedaddy, .jp-relatedposts, #jp-post-flair');
+insert into cleanup_rules (type, value) values ('leading', '^(Previous|Next) Chapter');
+insert into cleanup_rules (type, value) values ('trailing', '^(Previous|Next) Chapter');
+-- the author notes and the Patreon plugs of The Wandering Inn come after the chapter's end
+insert into cleanup_rules (feed_id, type, value) values ((select id from feeds where title = 'The Wandering Inn'), 'cut_after', '(?i)^author.?s note');
+insert into cleanup_rules (feed_id, type, value) values ((select id from feeds where title = 'The Wandering Inn'), 'trailing', '(?i)patreon');
@@ -0,0 +1,6 @@
+-- keep the ebook formats for 90 days after they have been dispatched, the raw HTML is kept forever
+insert into retention_policies (type, days, after_dispatch) values ('epub', 90, true);
+insert into retention_policies (type, days, after_dispatch) values ('mobi', 90, true);
+insert into retention_policies (type, days, after_dispatch) values ('azw3', 90, true);
+-- the readable HTML for The Wandering Inn is kept for a year
+insert into retention_policies (feed_id, type, days) values ((select id from feeds where title = 'The Wandering Inn'), 'html', 365);
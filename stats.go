@@ -0,0 +1,164 @@
+package feeds
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+	"unicode"
+
+	"github.com/dustin/go-humanize"
+)
+
+// ReadingSpeed is the number of words read in a minute, used for estimating the reading times.
+var ReadingSpeed = 250
+
+// ReadingStats holds the length of the readable text of an item, or of a number of them.
+type ReadingStats struct {
+	Words      int
+	Characters int
+}
+
+// ReadingTime returns the estimated time it takes to read the text.
+func (r ReadingStats) ReadingTime() time.Duration {
+	if ReadingSpeed <= 0 {
+		return 0
+	}
+	return time.Duration(r.Words) * time.Minute / time.Duration(ReadingSpeed)
+}
+
+// String returns the description of the length used in the metadata of the ebooks, eg. "2,345 words, about 9 minutes".
+func (r ReadingStats) String() string {
+	return fmt.Sprintf("%s words, about %s", humanize.Comma(int64(r.Words)), FormatReadingTime(r.ReadingTime()))
+}
+
+func (r ReadingStats) add(o ReadingStats) ReadingStats {
+	return ReadingStats{Words: r.Words + o.Words, Characters: r.Characters + o.Characters}
+}
+
+// FormatReadingTime returns the reading time rounded to minutes, or to hours for the long ones.
+func FormatReadingTime(d time.Duration) string {
+	minutes := int(d.Round(time.Minute) / time.Minute)
+	switch {
+	case minutes <= 1:
+		return "1 minute"
+	case minutes < 60:
+		return fmt.Sprintf("%d minutes", minutes)
+	case minutes < 90:
+		return "1 hour"
+	}
+	return fmt.Sprintf("%d hours", (minutes+30)/60)
+}
+
+// isIdeographic reports whether r is written without spaces between the words, in which case each character
+// counts as a word, as the word processors count them for Chinese and Japanese.
+func isIdeographic(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana)
+}
+
+// textStats counts the words and the characters, without the white space, of text.
+func textStats(text string) ReadingStats {
+	r := ReadingStats{}
+	inWord := false
+	for _, c := range text {
+		if unicode.IsSpace(c) {
+			inWord = false
+			continue
+		}
+		r.Characters++
+		switch {
+		case isIdeographic(c):
+			r.Words++
+			inWord = false
+		case unicode.IsLetter(c) || unicode.IsNumber(c):
+			if !inWord {
+				r.Words++
+			}
+			inWord = true
+		}
+	}
+	return r
+}
+
+// htmlStats returns the reading statistics of the text of the HTML content.
+func htmlStats(content []byte) ReadingStats {
+	text, err := plainText(content)
+	if err != nil {
+		return ReadingStats{}
+	}
+	return textStats(text)
+}
+
+// updateItemText saves the reading statistics and the language of the readable HTML of the item, and adds its text
+// to the search index. The unknown languages are saved as empty, so the item isn't analysed again.
+func updateItemText(c *sql.DB, s Storage, it *Item) error {
+	data, err := getItemContentForType(s, *it, OutputTypeHTML)
+	if err != nil {
+		return err
+	}
+	text, err := plainText(data)
+	if err != nil {
+		return err
+	}
+	it.Reading = textStats(text)
+	it.Language = itemLanguage(s, *it, text)
+	upd := `UPDATE items SET words = ?, characters = ?, language = ? WHERE id = ?;`
+	if _, err = c.Exec(upd, it.Reading.Words, it.Reading.Characters, it.Language, it.ID); err != nil {
+		return err
+	}
+	return indexItem(c, *it, text)
+}
+
+// FeedReadingStats aggregates the reading statistics of the items of a feed.
+type FeedReadingStats struct {
+	ReadingStats
+	// Items is the number of the items with statistics, the rejected ones being left out.
+	Items int
+	// First and Last are the publishing dates of the oldest and of the latest of the items.
+	First time.Time
+	Last  time.Time
+}
+
+// AverageWords returns the average length of the chapters.
+func (f FeedReadingStats) AverageWords() int {
+	if f.Items == 0 {
+		return 0
+	}
+	return f.Words / f.Items
+}
+
+// WordsPerWeek returns the number of words the feed publishes in a week, over the time between its first and
+// its last item, counted as at least a week.
+func (f FeedReadingStats) WordsPerWeek() int {
+	weeks := f.Last.Sub(f.First).Hours() / (7 * 24)
+	if weeks < 1 {
+		weeks = 1
+	}
+	return int(float64(f.Words) / weeks)
+}
+
+// LoadFeedsReadingStats returns the reading statistics of the feeds, by their ids.
+func LoadFeedsReadingStats(c *sql.DB) (map[int]FeedReadingStats, error) {
+	sel := `SELECT feed_id, COUNT(*), SUM(words), SUM(characters), MIN(published_date), MAX(published_date) FROM items
+WHERE words IS NOT NULL AND (quality IS NULL OR quality != ?) GROUP BY feed_id;`
+	s, err := c.Query(sel, QualityRejected)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	all := make(map[int]FeedReadingStats)
+	for s.Next() {
+		var (
+			id          int
+			st          FeedReadingStats
+			first, last sql.NullString
+		)
+		if err = s.Scan(&id, &st.Items, &st.Words, &st.Characters, &first, &last); err != nil {
+			return nil, err
+		}
+		st.First, _ = time.Parse(time.RFC3339Nano, first.String)
+		st.Last, _ = time.Parse(time.RFC3339Nano, last.String)
+		all[id] = st
+	}
+	return all, s.Err()
+}
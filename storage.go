@@ -0,0 +1,169 @@
+package feeds
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage is the location where the downloaded articles and the generated ebooks are kept.
+// The names it operates with are slash separated paths relative to the root of the storage,
+// and they are the values we save in the contents table.
+type Storage interface {
+	Open(name string) (io.ReadSeekCloser, error)
+	Save(name string, r io.Reader) error
+	Stat(name string) (BlobInfo, error)
+	Remove(name string) error
+	Walk(prefix string, fn func(BlobInfo) error) error
+}
+
+// storageDirs are the top level directories of the storage where the contents files are saved.
+var storageDirs = []string{BlobsDir, OutputDir, HtmlDir, ImagesDir, backupExternalDir}
+
+// BlobInfo describes a file from the Storage.
+type BlobInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// OpenStorage returns the storage described by dsn: a bucket for s3:// URLs,
+// or the local directory at basePath otherwise.
+func OpenStorage(basePath, dsn string) (Storage, error) {
+	if strings.HasPrefix(dsn, "s3://") {
+		return openS3Storage(dsn)
+	}
+	if dsn != "" {
+		basePath = dsn
+	}
+	return LocalStorage(basePath)
+}
+
+type localStorage struct {
+	root string
+}
+
+// LocalStorage returns a Storage saving files in the root directory of the local file system.
+func LocalStorage(root string) (Storage, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	return localStorage{root: root}, nil
+}
+
+func (l localStorage) path(name string) string {
+	if filepath.IsAbs(name) {
+		// NOTE(marius): older entries in the contents table have absolute paths
+		return name
+	}
+	return filepath.Join(l.root, filepath.FromSlash(name))
+}
+
+func (l localStorage) Open(name string) (io.ReadSeekCloser, error) {
+	return os.Open(l.path(name))
+}
+
+func (l localStorage) Save(name string, r io.Reader) error {
+	full := l.path(name)
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(full), "."+filepath.Base(full)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), full)
+}
+
+func (l localStorage) Stat(name string) (BlobInfo, error) {
+	fi, err := os.Stat(l.path(name))
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Name: name, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (l localStorage) Remove(name string) error {
+	return os.Remove(l.path(name))
+}
+
+func (l localStorage) Walk(prefix string, fn func(BlobInfo) error) error {
+	err := filepath.Walk(l.path(prefix), func(full string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if isTempBlob(full) {
+			// NOTE(marius): the files being written by Save, which get renamed to their blob name when complete
+			return nil
+		}
+		name, err := filepath.Rel(l.root, full)
+		if err != nil {
+			return err
+		}
+		return fn(BlobInfo{Name: filepath.ToSlash(name), Size: info.Size(), ModTime: info.ModTime()})
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// isTempBlob returns true for the temporary files Save writes the blobs to, named after them with a dot prefix.
+func isTempBlob(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), ".")
+}
+
+func blobExists(s Storage, name string) bool {
+	_, err := s.Stat(name)
+	return err == nil
+}
+
+func loadBlob(s Storage, name string) ([]byte, error) {
+	f, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// saveFileBlob moves the local file at filePath to name in the storage.
+func saveFileBlob(s Storage, name, filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = s.Save(name, f); err != nil {
+		return fmt.Errorf("unable to save %s: %w", name, err)
+	}
+	return nil
+}
+
+// blobName joins the elements of a storage name, making sure none of them contains path separators.
+func blobName(dir string, elems ...string) string {
+	parts := []string{dir}
+	for _, el := range elems {
+		parts = append(parts, sanitizeFileName(el))
+	}
+	return path.Join(parts...)
+}
@@ -0,0 +1,128 @@
+package feeds
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type s3Storage struct {
+	c      *minio.Client
+	bucket string
+	prefix string
+}
+
+// openS3Storage connects to the S3 compatible service described by a URL of the form:
+//
+//	s3://access-key:secret-key@host[:port]/bucket[/prefix][?region=us-east-1&insecure=true]
+//
+// The bucket is created if it doesn't exist.
+func openS3Storage(dsn string) (Storage, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	bucket, prefix, _ := strings.Cut(strings.Trim(u.Path, "/"), "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("missing bucket name in storage URL %s", u.Redacted())
+	}
+
+	secret, _ := u.User.Password()
+	insecure, _ := strconv.ParseBool(u.Query().Get("insecure"))
+	c, err := minio.New(u.Host, &minio.Options{
+		Creds:  credentials.NewStaticV4(u.User.Username(), secret, ""),
+		Secure: !insecure,
+		Region: u.Query().Get("region"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	exists, err := c.BucketExists(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("unable to access bucket %s: %w", bucket, err)
+	}
+	if !exists {
+		if err = c.MakeBucket(ctx, bucket, minio.MakeBucketOptions{Region: u.Query().Get("region")}); err != nil {
+			return nil, fmt.Errorf("unable to create bucket %s: %w", bucket, err)
+		}
+	}
+	return s3Storage{c: c, bucket: bucket, prefix: prefix}, nil
+}
+
+func (s s3Storage) key(name string) string {
+	return path.Join(s.prefix, strings.TrimLeft(name, "/"))
+}
+
+func (s s3Storage) name(key string) string {
+	return strings.TrimLeft(strings.TrimPrefix(key, s.prefix), "/")
+}
+
+// s3Error converts the "not found" errors returned by the S3 API to fs.ErrNotExist.
+func s3Error(name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if resp := minio.ToErrorResponse(err); resp.StatusCode == http.StatusNotFound {
+		return &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return err
+}
+
+func (s s3Storage) Open(name string) (io.ReadSeekCloser, error) {
+	obj, err := s.c.GetObject(context.Background(), s.bucket, s.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s3Error(name, err)
+	}
+	// NOTE(marius): GetObject doesn't make any request until the first read, so we check the object exists
+	if _, err = obj.Stat(); err != nil {
+		obj.Close()
+		return nil, s3Error(name, err)
+	}
+	return obj, nil
+}
+
+func (s s3Storage) Save(name string, r io.Reader) error {
+	opts := minio.PutObjectOptions{ContentType: mime.TypeByExtension(path.Ext(name))}
+	_, err := s.c.PutObject(context.Background(), s.bucket, s.key(name), r, -1, opts)
+	return err
+}
+
+func (s s3Storage) Stat(name string) (BlobInfo, error) {
+	info, err := s.c.StatObject(context.Background(), s.bucket, s.key(name), minio.StatObjectOptions{})
+	if err != nil {
+		return BlobInfo{}, s3Error(name, err)
+	}
+	return BlobInfo{Name: name, Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (s s3Storage) Remove(name string) error {
+	return s3Error(name, s.c.RemoveObject(context.Background(), s.bucket, s.key(name), minio.RemoveObjectOptions{}))
+}
+
+func (s s3Storage) Walk(prefix string, fn func(BlobInfo) error) error {
+	opts := minio.ListObjectsOptions{Prefix: s.key(prefix), Recursive: true}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for info := range s.c.ListObjects(ctx, s.bucket, opts) {
+		if info.Err != nil {
+			return info.Err
+		}
+		if err := fn(BlobInfo{Name: s.name(info.Key), Size: info.Size, ModTime: info.LastModified}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
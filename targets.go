@@ -1,10 +1,15 @@
 package feeds
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+)
 
 var ValidTargets = map[string]DestinationService{
 	"myk":    ServiceMyKindle{},
 	"pocket": ServicePocket{},
+	"email":  ServiceEmail{},
 	//"reMarkable": ServiceReMarkable{},
 }
 
@@ -33,8 +38,28 @@ func (k ServiceMyKindle) Description() string {
 	return "Syncs to your Kindle device through your Amazon Kindle email address"
 }
 
+// NOTE(marius): the Markdown and FictionBook files aren't among the formats accepted by the Kindle email service,
+// they can be sent by the email destinations instead
 func (k ServiceMyKindle) ValidContentTypes() []string {
-	return []string{"mobi"}
+	return registeredTypes(OutputTypeMOBI, OutputTypePDF, OutputTypeText)
+}
+
+// ServiceEmail is the target service sending the files as attachments to any email address, like the
+// Send-to-PocketBook one of the PocketBook devices, or the inbox of a note-taking application.
+type ServiceEmail struct {
+	SendCredentials SMTPCreds `json:"send_credentials"`
+}
+
+func (e ServiceEmail) Label() string {
+	return "Email"
+}
+
+func (e ServiceEmail) Description() string {
+	return "Sends the files to an email address, eg. your Send-to-PocketBook one"
+}
+
+func (e ServiceEmail) ValidContentTypes() []string {
+	return registeredTypes(OutputTypeEPUB, OutputTypeFB2, OutputTypeMarkdown, OutputTypePDF, OutputTypeText)
 }
 
 // ServiceReMarkable is the target service for reMarkable devices
@@ -50,7 +75,7 @@ func (r ServiceReMarkable) Description() string {
 }
 
 func (r ServiceReMarkable) ValidContentTypes() []string {
-	return []string{"epub" /*, "pdf"*/}
+	return registeredTypes(OutputTypeEPUB, OutputTypePDF)
 }
 
 var PocketConsumerKey = ""
@@ -81,3 +106,38 @@ func PocketInit() (*ServicePocket, error) {
 	}
 	return &ServicePocket{ConsumerKey: PocketConsumerKey}, nil
 }
+
+// chosenType returns the content type chosen in the credentials of the destination d.
+func chosenType(d Destination) string {
+	chosen := struct {
+		ContentType string `json:"content_type"`
+	}{}
+	json.Unmarshal(d.Credentials, &chosen)
+	return chosen.ContentType
+}
+
+// validDestinationType returns an error if the content type chosen for the destination d isn't accepted by its service.
+func validDestinationType(d Destination) error {
+	t, ok := ValidTargets[d.Type]
+	if !ok {
+		return fmt.Errorf("invalid destination type %s", d.Type)
+	}
+	typ := chosenType(d)
+	if typ == "" || slices.Contains(t.ValidContentTypes(), typ) {
+		return nil
+	}
+	return fmt.Errorf("invalid content type %s for %s, valid ones are %v", typ, t.Label(), t.ValidContentTypes())
+}
+
+// destinationType returns the content type chosen for the destination d, or the first of the content types
+// accepted by its service when none was chosen.
+func destinationType(d Destination) string {
+	t, ok := ValidTargets[d.Type]
+	if !ok || len(t.ValidContentTypes()) == 0 {
+		return ""
+	}
+	if typ := chosenType(d); slices.Contains(t.ValidContentTypes(), typ) {
+		return typ
+	}
+	return t.ValidContentTypes()[0]
+}
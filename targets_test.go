@@ -0,0 +1,35 @@
+package feeds
+
+import (
+	"testing"
+)
+
+func TestDestinationType(t *testing.T) {
+	tests := []struct {
+		name    string
+		dest    Destination
+		want    string
+		wantErr bool
+	}{
+		{"kindle default", Destination{Type: "myk", Credentials: []byte(`{"to":"x@kindle.com"}`)}, OutputTypeMOBI, false},
+		{"kindle pdf", Destination{Type: "myk", Credentials: []byte(`{"content_type":"pdf"}`)}, OutputTypePDF, false},
+		{"kindle text", Destination{Type: "myk", Credentials: []byte(`{"content_type":"txt"}`)}, OutputTypeText, false},
+		{"kindle epub", Destination{Type: "myk", Credentials: []byte(`{"content_type":"epub"}`)}, OutputTypeMOBI, true},
+		{"email default", Destination{Type: "email", Credentials: []byte(`{"to":"x@pbsync.com"}`)}, OutputTypeEPUB, false},
+		{"email fictionbook", Destination{Type: "email", Credentials: []byte(`{"content_type":"fb2"}`)}, OutputTypeFB2, false},
+		{"email markdown", Destination{Type: "email", Credentials: []byte(`{"content_type":"md"}`)}, OutputTypeMarkdown, false},
+		{"email mobi", Destination{Type: "email", Credentials: []byte(`{"content_type":"mobi"}`)}, OutputTypeEPUB, true},
+		{"pocket", Destination{Type: "pocket", Credentials: []byte(`{}`)}, OutputTypeRAW, false},
+		{"unknown target", Destination{Type: "fax"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validDestinationType(tt.dest); (err != nil) != tt.wantErr {
+				t.Errorf("validDestinationType() error = %v, want error %t", err, tt.wantErr)
+			}
+			if got := destinationType(tt.dest); got != tt.want {
+				t.Errorf("destinationType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
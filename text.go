@@ -0,0 +1,368 @@
+package feeds
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+func init() {
+	RegisterConverter(format{typ: OutputTypeMarkdown, dependency: OutputTypeHTML, version: 2, mimeType: "text/markdown; charset=utf-8", book: markdownBook})
+	RegisterConverter(format{typ: OutputTypeText, dependency: OutputTypeHTML, mimeType: "text/plain; charset=utf-8", book: textBook})
+}
+
+func ToMarkdown(content []byte, title, author, outPath string) error {
+	return markdownBook([]chapter{{Title: title, Content: content}}, title, author, ebookMeta{Language: EbookLanguage}, DefaultConvertOptions, outPath)
+}
+
+func ToText(content []byte, title, author, outPath string) error {
+	return textBook([]chapter{{Title: title, Content: content}}, title, author, ebookMeta{Language: EbookLanguage}, DefaultConvertOptions, outPath)
+}
+
+// markdownBook writes a Markdown file with a front matter holding the metadata, and a top level heading for each chapter.
+func markdownBook(chapters []chapter, title, author string, meta ebookMeta, _ ConvertOptions, outPath string) error {
+	buf := bytes.Buffer{}
+	buf.WriteString("---\n")
+	fmt.Fprintf(&buf, "title: %s\n", strconv.Quote(title))
+	if author != "" {
+		fmt.Fprintf(&buf, "author: %s\n", strconv.Quote(author))
+	}
+	if meta.Series != "" {
+		fmt.Fprintf(&buf, "series: %s\nseries_index: %d\n", strconv.Quote(meta.Series), meta.SeriesIndex)
+	}
+	if !meta.Published.IsZero() {
+		fmt.Fprintf(&buf, "date: %s\n", meta.Published.UTC().Format(time.RFC3339))
+	}
+	if meta.Source != "" {
+		fmt.Fprintf(&buf, "source: %s\n", strconv.Quote(meta.Source))
+	}
+	if meta.Language != "" {
+		fmt.Fprintf(&buf, "lang: %s\n", meta.Language)
+	}
+	if meta.Description != "" {
+		fmt.Fprintf(&buf, "description: %s\n", strconv.Quote(meta.Description))
+	}
+	buf.WriteString("---\n")
+
+	for _, ch := range chapters {
+		w := textWriter{markdown: true}
+		w.heading(1, ch.Title)
+		if err := w.render(ch.Content); err != nil {
+			return err
+		}
+		buf.WriteString("\n")
+		buf.WriteString(w.String())
+	}
+	return os.WriteFile(outPath, buf.Bytes(), 0644)
+}
+
+// textBook writes a plain text file, with the chapters separated by their titles, suitable for text-to-speech.
+func textBook(chapters []chapter, title, author string, _ ebookMeta, _ ConvertOptions, outPath string) error {
+	buf := bytes.Buffer{}
+	buf.WriteString(title + "\n")
+	if author != "" {
+		buf.WriteString("by " + author + "\n")
+	}
+	for _, ch := range chapters {
+		w := textWriter{}
+		if len(chapters) > 1 || ch.Title != title {
+			w.heading(1, ch.Title)
+		}
+		if err := w.render(ch.Content); err != nil {
+			return err
+		}
+		buf.WriteString("\n")
+		buf.WriteString(w.String())
+	}
+	return os.WriteFile(outPath, buf.Bytes(), 0644)
+}
+
+var markdownEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`, "<", `\<`)
+
+// textWriter renders HTML as Markdown, or as plain text without any markup.
+type textWriter struct {
+	markdown bool
+
+	buf strings.Builder
+	// prefixes are written at the start of each line, for the blockquotes and the continuation of the list items
+	prefixes []string
+	lists    []htmlList
+	pre      int
+	// breaks is the number of line breaks to write before the next text
+	breaks    int
+	lineStart bool
+	// linePrefix is the prefix of the current line
+	linePrefix string
+}
+
+func (w *textWriter) String() string {
+	return strings.TrimRight(w.buf.String(), "\n ") + "\n"
+}
+
+func (w *textWriter) render(content []byte) error {
+	doc, err := html.Parse(bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	if body := findElement(doc, atom.Body); body != nil {
+		w.walk(body)
+	}
+	return nil
+}
+
+// plainText returns the text of the HTML content without any markup, with its blocks separated by empty lines.
+func plainText(content []byte) (string, error) {
+	w := textWriter{}
+	if err := w.render(content); err != nil {
+		return "", err
+	}
+	return w.String(), nil
+}
+
+// block ends the current block, the next text starts after an empty line.
+func (w *textWriter) block() {
+	if w.buf.Len() > 0 && w.breaks < 2 {
+		w.breaks = 2
+	}
+}
+
+func (w *textWriter) newLine() {
+	if w.buf.Len() > 0 && w.breaks < 1 {
+		w.breaks = 1
+	}
+}
+
+// raw writes s after the pending line breaks, without escaping it.
+func (w *textWriter) raw(s string) {
+	if s == "" {
+		return
+	}
+	prefix := strings.Join(w.prefixes, "")
+	for ; w.breaks > 0; w.breaks-- {
+		w.buf.WriteString("\n")
+		if w.breaks > 1 {
+			// NOTE(marius): the empty lines between blocks keep only the prefix shared by the blocks
+			// around them, so they separate a blockquote from the text before and after it
+			blank := prefix
+			for !strings.HasPrefix(w.linePrefix, blank) {
+				blank = blank[:len(blank)-1]
+			}
+			w.buf.WriteString(strings.TrimRight(blank, " "))
+		} else {
+			w.buf.WriteString(prefix)
+		}
+		w.lineStart = true
+	}
+	w.linePrefix = prefix
+	if w.buf.Len() == 0 {
+		w.buf.WriteString(prefix)
+		w.lineStart = true
+	}
+	w.buf.WriteString(s)
+	w.lineStart = false
+}
+
+func (w *textWriter) text(s string) {
+	if w.pre > 0 {
+		lines := strings.Split(s, "\n")
+		for i, line := range lines {
+			if i > 0 {
+				w.breaks = 1
+			}
+			w.raw(line)
+		}
+		return
+	}
+	s = whitespaceRe.ReplaceAllString(s, " ")
+	if w.lineStart || w.breaks > 0 || w.buf.Len() == 0 {
+		s = strings.TrimLeft(s, " ")
+	}
+	if w.markdown {
+		s = markdownEscaper.Replace(s)
+	}
+	w.raw(s)
+}
+
+func (w *textWriter) heading(level int, title string) {
+	w.block()
+	if w.markdown {
+		w.raw(strings.Repeat("#", level) + " ")
+	}
+	w.text(title)
+	w.block()
+}
+
+// wrap renders the children of n between the markup delimiters, which are skipped for plain text.
+func (w *textWriter) wrap(n *html.Node, open, close string) {
+	if w.markdown {
+		w.raw(open)
+	}
+	w.walk(n)
+	if w.markdown {
+		w.raw(close)
+	}
+}
+
+func (w *textWriter) walk(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		switch c.Type {
+		case html.TextNode:
+			w.text(c.Data)
+		case html.ElementNode:
+			w.element(c)
+		}
+	}
+}
+
+func (w *textWriter) element(n *html.Node) {
+	switch n.DataAtom {
+	case atom.Script, atom.Style, atom.Head, atom.Noscript:
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		w.block()
+		if w.markdown {
+			w.raw(strings.Repeat("#", int(n.Data[1]-'0')) + " ")
+		}
+		w.walk(n)
+		w.block()
+	case atom.P, atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Figure, atom.Figcaption, atom.Dl, atom.Dt, atom.Dd:
+		w.block()
+		w.walk(n)
+		w.block()
+	case atom.Br:
+		if w.markdown {
+			w.raw(`\`)
+		}
+		w.breaks = 1
+	case atom.Hr:
+		w.block()
+		if w.markdown {
+			w.raw("---")
+		}
+		w.block()
+	case atom.B, atom.Strong:
+		w.wrap(n, "**", "**")
+	case atom.I, atom.Em, atom.Cite, atom.Var:
+		w.wrap(n, "_", "_")
+	case atom.Del, atom.S, atom.Strike:
+		w.wrap(n, "~~", "~~")
+	case atom.Code, atom.Kbd, atom.Samp, atom.Tt:
+		if w.markdown && w.pre == 0 {
+			w.raw("`" + strings.ReplaceAll(textContent(n), "`", "'") + "`")
+			return
+		}
+		w.walk(n)
+	case atom.Pre:
+		w.block()
+		if w.markdown {
+			w.raw("```")
+			w.breaks = 1
+		}
+		w.pre++
+		w.walk(n)
+		w.pre--
+		if w.markdown {
+			w.breaks = 1
+			w.raw("```")
+		}
+		w.block()
+	case atom.A:
+		href := attr(n, "href")
+		if !w.markdown || href == "" || strings.HasPrefix(href, "#") {
+			w.walk(n)
+			return
+		}
+		w.raw("[")
+		w.walk(n)
+		w.raw("](" + href + ")")
+	case atom.Img:
+		if w.markdown {
+			w.raw(fmt.Sprintf("![%s](%s)", markdownEscaper.Replace(attr(n, "alt")), attr(n, "src")))
+		}
+	case atom.Blockquote:
+		w.block()
+		if w.markdown {
+			w.prefixes = append(w.prefixes, "> ")
+		}
+		w.walk(n)
+		if w.markdown {
+			w.prefixes = w.prefixes[:len(w.prefixes)-1]
+		}
+		w.block()
+	case atom.Ul, atom.Ol:
+		w.block()
+		w.lists = append(w.lists, htmlList{ordered: n.DataAtom == atom.Ol})
+		w.walk(n)
+		w.lists = w.lists[:len(w.lists)-1]
+		w.block()
+	case atom.Li:
+		w.listItem(n)
+	case atom.Table:
+		w.table(n)
+	default:
+		w.walk(n)
+	}
+}
+
+func (w *textWriter) listItem(n *html.Node) {
+	w.newLine()
+	marker := "- "
+	if len(w.lists) > 0 {
+		l := &w.lists[len(w.lists)-1]
+		l.count++
+		if l.ordered {
+			marker = fmt.Sprintf("%d. ", l.count)
+		}
+	}
+	w.raw(marker)
+	w.lineStart = true
+	w.prefixes = append(w.prefixes, strings.Repeat(" ", len(marker)))
+	w.walk(n)
+	w.prefixes = w.prefixes[:len(w.prefixes)-1]
+	w.newLine()
+}
+
+// table renders the rows of the table with their cells separated by pipes, as Markdown tables.
+func (w *textWriter) table(n *html.Node) {
+	w.block()
+	first := true
+	var rows func(*html.Node)
+	rows = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode || c.DataAtom == atom.Table {
+				continue
+			}
+			if c.DataAtom != atom.Tr {
+				rows(c)
+				continue
+			}
+			cells := make([]string, 0)
+			for cell := c.FirstChild; cell != nil; cell = cell.NextSibling {
+				if cell.Type == html.ElementNode && (cell.DataAtom == atom.Td || cell.DataAtom == atom.Th) {
+					text := strings.TrimSpace(whitespaceRe.ReplaceAllString(textContent(cell), " "))
+					if w.markdown {
+						text = strings.ReplaceAll(markdownEscaper.Replace(text), "|", `\|`)
+					}
+					cells = append(cells, text)
+				}
+			}
+			if len(cells) == 0 {
+				continue
+			}
+			w.newLine()
+			w.raw("| " + strings.Join(cells, " | ") + " |")
+			if first && w.markdown {
+				w.newLine()
+				w.raw(strings.TrimSuffix(strings.Repeat("| --- ", len(cells)), " ") + " |")
+			}
+			first = false
+		}
+	}
+	rows(n)
+	w.block()
+}
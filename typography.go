@@ -0,0 +1,411 @@
+package feeds
+
+import (
+	"bytes"
+	"database/sql"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// sceneBreakClass is the class of the hr elements the scene breaks of the chapters are replaced with.
+const sceneBreakClass = "scene-break"
+
+// hyphenMinWord is the length of the shortest word getting soft hyphens, hyphenMinPart the length of the
+// shortest part of a hyphenated word.
+const (
+	hyphenMinWord = 8
+	hyphenMinPart = 3
+	softHyphen    = '\u00ad'
+)
+
+// hyphenatedTypes are the content types whose readers justify the text, which the soft hyphens are added for.
+var hyphenatedTypes = map[string]bool{OutputTypeEPUB: true, OutputTypeAZW3: true, OutputTypeMOBI: true}
+
+// sceneBreakRe matches the text of the paragraphs the authors use as scene breaks, like "* * *", "###" or "oOo".
+var sceneBreakRe = regexp.MustCompile(`^(?:(?:[*#~•·◇◆○●■□♦✦✧=_+\-–—]\s*){1,12}|(?i:(?:o\s*){3}|(?:x\s*){3}))$`)
+
+// mojibakeRe matches the UTF-8 sequences which were decoded as Windows-1252, like "â€™" instead of "’".
+var mojibakeRe = func() *regexp.Regexp {
+	cont := strings.Builder{}
+	for b := 0x80; b < 0xc0; b++ {
+		if r := charmap.Windows1252.DecodeByte(byte(b)); r != utf8.RuneError {
+			cont.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	return regexp.MustCompile(`[ÂÃÄÅÆÇÈÉÊËÌÍÎÏÐÑÒÓÔÕÖ×ØÙÚÛÜÝÞßàáâãäåæçèéêëìíîïðñòóôõö÷øùúûüýþÿ][` + cont.String() + `]{1,3}`)
+}()
+
+// quoteStyles are the opening and closing double quotes of the languages which don't use the English ones.
+// The single quotes stay the English ones, as the closing one is also the apostrophe.
+var quoteStyles = map[string][2]rune{
+	"de": {'„', '“'},
+	"fr": {'«', '»'},
+	"es": {'«', '»'},
+	"it": {'«', '»'},
+	"pt": {'«', '»'},
+	"ru": {'«', '»'},
+	"uk": {'«', '»'},
+	"pl": {'„', '”'},
+	"ro": {'„', '”'},
+	"sv": {'”', '”'},
+}
+
+var englishQuotes = [2]rune{'“', '”'}
+
+var dashesReplacer = strings.NewReplacer("---", "—", "--", "—", " - ", " – ", "...", "…", ". . .", "…")
+
+// blockElements are the elements whose text isn't joined with the text around them.
+var blockElements = map[atom.Atom]bool{
+	atom.Address: true, atom.Article: true, atom.Aside: true, atom.Blockquote: true, atom.Body: true,
+	atom.Center: true, atom.Dd: true, atom.Div: true, atom.Dl: true, atom.Dt: true, atom.Figcaption: true,
+	atom.Figure: true, atom.Footer: true, atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true,
+	atom.H5: true, atom.H6: true, atom.Header: true, atom.Hr: true, atom.Li: true, atom.Main: true,
+	atom.Nav: true, atom.Ol: true, atom.P: true, atom.Pre: true, atom.Section: true, atom.Table: true,
+	atom.Tbody: true, atom.Td: true, atom.Tfoot: true, atom.Th: true, atom.Thead: true, atom.Tr: true, atom.Ul: true,
+}
+
+// verbatimElements are the elements whose text the typography pass leaves alone.
+var verbatimElements = map[atom.Atom]bool{
+	atom.Pre: true, atom.Code: true, atom.Kbd: true, atom.Samp: true, atom.Script: true, atom.Style: true,
+	atom.Textarea: true,
+}
+
+// typography returns the readable HTML content prepared for the e-readers: with the broken encodings fixed,
+// the runs of line breaks split into paragraphs, the scene breaks marked up as hr elements, the quotes of
+// the language lang and the dashes normalised and, when hyphenate is set, soft hyphens in the long words of the paragraphs.
+func typography(content []byte, lang string, hyphenate bool) ([]byte, error) {
+	doc, err := html.Parse(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	body := findElement(doc, atom.Body)
+	if body == nil {
+		return content, nil
+	}
+
+	fixEncoding(body)
+	splitBreaks(body)
+	markSceneBreaks(body)
+	t := quotesWriter{quotes: englishQuotes}
+	if q, ok := quoteStyles[lang]; ok {
+		t.quotes = q
+	}
+	t.walk(body)
+	if hyphenate {
+		hyphenateText(body, false)
+	}
+
+	buf := bytes.Buffer{}
+	for c := body.FirstChild; c != nil; c = c.NextSibling {
+		if err = html.Render(&buf, c); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func fixEncoding(n *html.Node) {
+	if n.Type == html.TextNode {
+		n.Data = mojibakeRe.ReplaceAllStringFunc(n.Data, func(s string) string {
+			enc, err := charmap.Windows1252.NewEncoder().String(s)
+			if err != nil || !utf8.ValidString(enc) {
+				return s
+			}
+			return enc
+		})
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		fixEncoding(c)
+	}
+}
+
+func isBreak(n *html.Node) bool {
+	return n.Type == html.ElementNode && n.DataAtom == atom.Br
+}
+
+func isBlank(n *html.Node) bool {
+	return n.Type == html.TextNode && strings.TrimSpace(n.Data) == ""
+}
+
+// splitBreaks replaces the runs of two or more br elements in the paragraphs, and in the elements containing
+// only inline content, with paragraphs.
+func splitBreaks(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		// NOTE(marius): the paragraphs get replaced by the ones split from them
+		next := c.NextSibling
+		if c.Type == html.ElementNode && !verbatimElements[c.DataAtom] {
+			splitBreaks(c)
+		}
+		c = next
+	}
+	if n.Type != html.ElementNode || !blockElements[n.DataAtom] {
+		return
+	}
+	groups := make([][]*html.Node, 0)
+	group := make([]*html.Node, 0)
+	breaks := 0
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && blockElements[c.DataAtom] {
+			// NOTE(marius): the elements mixing blocks with the line breaks are left as they are
+			return
+		}
+		switch {
+		case isBreak(c):
+			breaks++
+		case isBlank(c):
+		default:
+			if breaks > 1 && len(group) > 0 {
+				groups = append(groups, group)
+				group = make([]*html.Node, 0)
+			}
+			breaks = 0
+		}
+		group = append(group, c)
+	}
+	groups = append(groups, group)
+	if len(groups) < 2 {
+		return
+	}
+
+	for _, g := range groups {
+		// NOTE(marius): the breaks around the new paragraphs are dropped
+		for len(g) > 0 && (isBreak(g[len(g)-1]) || isBlank(g[len(g)-1])) {
+			g = g[:len(g)-1]
+		}
+		for len(g) > 0 && (isBreak(g[0]) || isBlank(g[0])) {
+			g = g[1:]
+		}
+		p := &html.Node{Type: html.ElementNode, Data: "p", DataAtom: atom.P}
+		for _, c := range g {
+			n.RemoveChild(c)
+			p.AppendChild(c)
+		}
+		if len(g) > 0 {
+			if n.DataAtom == atom.P {
+				n.Parent.InsertBefore(p, n)
+			} else {
+				n.AppendChild(p)
+			}
+		}
+	}
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if isBreak(c) || isBlank(c) {
+			n.RemoveChild(c)
+		}
+		c = next
+	}
+	if n.DataAtom == atom.P && n.FirstChild == nil {
+		n.Parent.RemoveChild(n)
+	}
+}
+
+// markSceneBreaks replaces the paragraphs containing only a scene break marker with hr elements of the sceneBreakClass.
+func markSceneBreaks(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type != html.ElementNode || verbatimElements[c.DataAtom] {
+			c = next
+			continue
+		}
+		switch c.DataAtom {
+		case atom.Hr:
+			if attr(c, "class") == "" {
+				c.Attr = append(c.Attr, html.Attribute{Key: "class", Val: sceneBreakClass})
+			}
+		case atom.P, atom.Div, atom.Center:
+			if findElement(c, atom.Img) == nil && sceneBreakRe.MatchString(strings.TrimSpace(textContent(c))) {
+				hr := &html.Node{Type: html.ElementNode, Data: "hr", DataAtom: atom.Hr, Attr: []html.Attribute{{Key: "class", Val: sceneBreakClass}}}
+				n.InsertBefore(hr, c)
+				n.RemoveChild(c)
+			} else {
+				markSceneBreaks(c)
+			}
+		default:
+			markSceneBreaks(c)
+		}
+		c = next
+	}
+}
+
+// quotesWriter replaces the straight quotes with the typographic ones, depending on the character preceding
+// them, which can be in the previous text of the same block.
+type quotesWriter struct {
+	prev   rune
+	quotes [2]rune
+}
+
+func (q *quotesWriter) walk(n *html.Node) {
+	if n.Type == html.TextNode {
+		n.Data = q.text(dashesReplacer.Replace(n.Data))
+		return
+	}
+	if n.Type != html.ElementNode {
+		return
+	}
+	if verbatimElements[n.DataAtom] {
+		// NOTE(marius): a quote following the code closes
+		q.prev = 'x'
+		return
+	}
+	if blockElements[n.DataAtom] || n.DataAtom == atom.Br {
+		q.prev = 0
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		q.walk(c)
+	}
+	if blockElements[n.DataAtom] {
+		q.prev = 0
+	}
+}
+
+func opensQuote(prev rune) bool {
+	return prev == 0 || unicode.IsSpace(prev) || strings.ContainsRune("([{—–‘“„«-", prev)
+}
+
+func (q *quotesWriter) text(s string) string {
+	if !strings.ContainsAny(s, `"'`) {
+		if s != "" {
+			q.prev, _ = utf8.DecodeLastRuneInString(s)
+		}
+		return s
+	}
+	out := strings.Builder{}
+	runes := []rune(s)
+	for i, r := range runes {
+		switch r {
+		case '"':
+			if opensQuote(q.prev) {
+				r = q.quotes[0]
+			} else {
+				r = q.quotes[1]
+			}
+		case '\'':
+			// NOTE(marius): apostrophes, closing quotes and the elided years, like '90s, get the right single quote
+			if opensQuote(q.prev) && (i+1 >= len(runes) || !unicode.IsDigit(runes[i+1])) {
+				r = '‘'
+			} else {
+				r = '’'
+			}
+		}
+		out.WriteRune(r)
+		q.prev = r
+	}
+	return out.String()
+}
+
+// hyphenateText adds soft hyphens to the long words in the text of the paragraphs, skipping the headings and the links.
+func hyphenateText(n *html.Node, inParagraph bool) {
+	if n.Type == html.TextNode {
+		if inParagraph {
+			n.Data = hyphenateWords(n.Data)
+		}
+		return
+	}
+	if n.Type == html.ElementNode {
+		switch n.DataAtom {
+		case atom.P, atom.Li, atom.Dd, atom.Blockquote, atom.Td:
+			inParagraph = true
+		case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.A:
+			inParagraph = false
+		}
+		if verbatimElements[n.DataAtom] {
+			return
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		hyphenateText(c, inParagraph)
+	}
+}
+
+func hyphenateWords(s string) string {
+	out := strings.Builder{}
+	word := make([]rune, 0)
+	flush := func() {
+		out.WriteString(hyphenateWord(word))
+		word = word[:0]
+	}
+	for _, r := range s {
+		if unicode.IsLetter(r) {
+			word = append(word, r)
+			continue
+		}
+		flush()
+		out.WriteRune(r)
+	}
+	flush()
+	return out.String()
+}
+
+func isVowel(r rune) bool {
+	return strings.ContainsRune("aeiouyàáâãäåæèéêëìíîïòóôõöøœùúûüýÿăâîșțąęėįųő", unicode.ToLower(r))
+}
+
+// digraphs are the consonant pairs which aren't split by the hyphenation.
+var digraphs = map[string]bool{"ch": true, "ck": true, "gh": true, "ph": true, "qu": true, "sh": true, "th": true, "wh": true}
+
+// hyphenateWord adds the soft hyphens to word with a naive, language agnostic, heuristic: before the single
+// consonants between vowels (ba-con) and between the pairs of consonants between vowels (bas-ket).
+func hyphenateWord(word []rune) string {
+	if len(word) < hyphenMinWord || unicode.IsUpper(word[len(word)-1]) {
+		return string(word)
+	}
+	out := strings.Builder{}
+	last := 0
+	for i := hyphenMinPart; i <= len(word)-hyphenMinPart; i++ {
+		if i-last < hyphenMinPart || isVowel(word[i]) || !isVowel(word[i-1]) {
+			continue
+		}
+		// word[i] is a consonant following a vowel
+		at := -1
+		switch {
+		case i+1 < len(word) && isVowel(word[i+1]):
+			at = i
+		case i+2 < len(word) && !isVowel(word[i+1]) && isVowel(word[i+2]):
+			if digraphs[strings.ToLower(string(word[i:i+2]))] {
+				at = i
+			} else {
+				at = i + 1
+			}
+		}
+		if at < 0 || at-last < hyphenMinPart || len(word)-at < hyphenMinPart {
+			continue
+		}
+		out.WriteString(string(word[last:at]))
+		out.WriteRune(softHyphen)
+		last = at
+	}
+	out.WriteString(string(word[last:]))
+	return out.String()
+}
+
+// prepareHTML returns the HTML content passed to the converter of type typ, after the typography pass if enabled.
+func prepareHTML(content []byte, typ string, opts ConvertOptions) []byte {
+	if !opts.Typography {
+		return content
+	}
+	out, err := typography(content, opts.Language, opts.Hyphenate && hyphenatedTypes[typ])
+	if err != nil {
+		return content
+	}
+	return out
+}
+
+// LoadFeedStylesheet loads the stylesheet of the ebooks of the feed.
+func LoadFeedStylesheet(c *sql.DB, feedID int) (string, error) {
+	var css sql.NullString
+	err := c.QueryRow(`SELECT stylesheet FROM feeds WHERE id = ?;`, feedID).Scan(&css)
+	return css.String, err
+}
+
+// SaveFeedStylesheet saves the stylesheet of the ebooks of the feed.
+func SaveFeedStylesheet(c *sql.DB, feedID int, css string) error {
+	_, err := c.Exec(`UPDATE feeds SET stylesheet = ? WHERE id = ?;`, sql.NullString{String: css, Valid: css != ""}, feedID)
+	return err
+}
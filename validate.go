@@ -0,0 +1,276 @@
+package feeds
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// validators are the structural checks of the generated files of the content types which the readers reject
+// when they are broken, the MOBI and AZW3 files bouncing silently off the Kindle email service.
+var validators = map[string]func(p string) error{
+	OutputTypeEPUB:  validateEPUB,
+	OutputTypeKEPUB: validateEPUB,
+	OutputTypeMOBI:  func(p string) error { return validateMOBI(p, false) },
+	OutputTypeAZW3:  func(p string) error { return validateMOBI(p, true) },
+}
+
+// ValidationError is returned for the generated files which fail the structural checks of their content type.
+type ValidationError struct {
+	Type   string
+	Reason string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Type, e.Reason)
+}
+
+// validateContent checks the structure of the file of type typ at p, the types without a validator are always valid.
+func validateContent(typ, p string) error {
+	validate, ok := validators[typ]
+	if !ok {
+		return nil
+	}
+	if err := validate(p); err != nil {
+		return ValidationError{Type: typ, Reason: err.Error()}
+	}
+	return nil
+}
+
+const epubMimeType = "application/epub+zip"
+
+// epubContainer is the META-INF/container.xml of an EPUB, pointing to its package document.
+type epubContainer struct {
+	Rootfiles []struct {
+		FullPath string `xml:"full-path,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+// epubPackage is the package document of an EPUB, with the parts of it which are checked.
+type epubPackage struct {
+	Version  string `xml:"version,attr"`
+	Manifest []struct {
+		ID         string `xml:"id,attr"`
+		Href       string `xml:"href,attr"`
+		MediaType  string `xml:"media-type,attr"`
+		Properties string `xml:"properties,attr"`
+	} `xml:"manifest>item"`
+	Spine struct {
+		Toc      string `xml:"toc,attr"`
+		ItemRefs []struct {
+			IDRef string `xml:"idref,attr"`
+		} `xml:"itemref"`
+	} `xml:"spine"`
+}
+
+// validateEPUB checks the EPUB file at p: its mimetype entry, its container, its package document, whose manifest
+// must reference existing files, and the navigation document, and the well-formedness of its XHTML documents.
+func validateEPUB(p string) error {
+	r, err := zip.OpenReader(p)
+	if err != nil {
+		return fmt.Errorf("not a zip archive: %w", err)
+	}
+	defer r.Close()
+
+	files := make(map[string]*zip.File, len(r.File))
+	for _, f := range r.File {
+		files[f.Name] = f
+	}
+	if len(r.File) == 0 || r.File[0].Name != "mimetype" || r.File[0].Method != zip.Store {
+		return errors.New("the mimetype file is not the first uncompressed entry")
+	}
+	mime, err := readZipFile(r.File[0])
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(mime)) != epubMimeType {
+		return fmt.Errorf("invalid mimetype %q", mime)
+	}
+
+	cf, ok := files["META-INF/container.xml"]
+	if !ok {
+		return errors.New("missing META-INF/container.xml")
+	}
+	data, err := readWellFormed(cf)
+	if err != nil {
+		return err
+	}
+	container := epubContainer{}
+	if err = xml.Unmarshal(data, &container); err != nil || len(container.Rootfiles) == 0 || container.Rootfiles[0].FullPath == "" {
+		return errors.New("META-INF/container.xml doesn't reference a package document")
+	}
+	opfPath := container.Rootfiles[0].FullPath
+	of, ok := files[opfPath]
+	if !ok {
+		return fmt.Errorf("missing package document %s", opfPath)
+	}
+	if data, err = readWellFormed(of); err != nil {
+		return err
+	}
+	pkg := epubPackage{}
+	if err = xml.Unmarshal(data, &pkg); err != nil {
+		return fmt.Errorf("invalid package document %s: %w", opfPath, err)
+	}
+
+	manifest := make(map[string]string, len(pkg.Manifest))
+	nav, ncx := false, ""
+	for _, it := range pkg.Manifest {
+		href, err := url.PathUnescape(it.Href)
+		if err != nil {
+			return fmt.Errorf("invalid href %q in the manifest", it.Href)
+		}
+		name := path.Join(path.Dir(opfPath), href)
+		f, ok := files[name]
+		if !ok {
+			return fmt.Errorf("missing %s referenced by the manifest", name)
+		}
+		manifest[it.ID] = name
+		if strings.Contains(" "+it.Properties+" ", " nav ") {
+			nav = true
+		}
+		if it.MediaType == "application/x-dtbncx+xml" {
+			ncx = it.ID
+		}
+		switch it.MediaType {
+		case "application/xhtml+xml", "application/x-dtbncx+xml":
+			if _, err = readWellFormed(f); err != nil {
+				return err
+			}
+		}
+	}
+	if len(pkg.Spine.ItemRefs) == 0 {
+		return errors.New("empty spine")
+	}
+	for _, ref := range pkg.Spine.ItemRefs {
+		if _, ok := manifest[ref.IDRef]; !ok {
+			return fmt.Errorf("spine item %q is not in the manifest", ref.IDRef)
+		}
+	}
+	// NOTE(marius): the EPUB 3 files need a navigation document, the EPUB 2 ones an NCX table of contents
+	if strings.HasPrefix(pkg.Version, "3") && !nav {
+		return errors.New("missing navigation document")
+	}
+	if !strings.HasPrefix(pkg.Version, "3") && ncx == "" && pkg.Spine.Toc == "" {
+		return errors.New("missing NCX table of contents")
+	}
+	return nil
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %w", f.Name, err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", f.Name, err)
+	}
+	return data, nil
+}
+
+// readWellFormed reads the XML document f, it returns an error if it isn't well-formed.
+func readWellFormed(f *zip.File) ([]byte, error) {
+	data, err := readZipFile(f)
+	if err != nil {
+		return nil, err
+	}
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		if _, err = d.Token(); err == io.EOF {
+			return data, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s is not well-formed: %w", f.Name, err)
+		}
+	}
+}
+
+// The offsets of the fields of the Palm database header, and of the MOBI header from the start of the first record.
+const (
+	pdbHeaderLen    = 78
+	pdbTypeOffset   = 60
+	pdbRecordsCount = 76
+	mobiMagicOffset = 16
+	mobiHeaderLen   = 20
+	mobiVersion     = 36
+	mobiExthFlags   = 128
+)
+
+// validateMOBI checks the Palm database of the MOBI or, for kf8, AZW3 file at p: its type, its record table, and
+// the PalmDOC, MOBI and EXTH headers of its first record, which must account for the text records.
+func validateMOBI(p string, kf8 bool) error {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	if len(data) < pdbHeaderLen {
+		return errors.New("truncated header")
+	}
+	if typ := string(data[pdbTypeOffset : pdbTypeOffset+8]); typ != "BOOKMOBI" {
+		return fmt.Errorf("invalid database type %q", typ)
+	}
+	count := int(binary.BigEndian.Uint16(data[pdbRecordsCount:]))
+	if count == 0 {
+		return errors.New("no records")
+	}
+	if len(data) < pdbHeaderLen+8*count {
+		return errors.New("truncated record table")
+	}
+	offsets := make([]int, count+1)
+	for i := 0; i < count; i++ {
+		offsets[i] = int(binary.BigEndian.Uint32(data[pdbHeaderLen+8*i:]))
+	}
+	offsets[count] = len(data)
+	if offsets[0] < pdbHeaderLen+8*count {
+		return errors.New("the first record overlaps the record table")
+	}
+	for i := 0; i < count; i++ {
+		if offsets[i] > offsets[i+1] {
+			return fmt.Errorf("record %d is out of order or past the end of the file", i)
+		}
+	}
+
+	rec := data[offsets[0]:offsets[1]]
+	if len(rec) < mobiHeaderLen+4 || string(rec[mobiMagicOffset:mobiMagicOffset+4]) != "MOBI" {
+		return errors.New("missing MOBI header")
+	}
+	switch compression := binary.BigEndian.Uint16(rec); compression {
+	case 1, 2, 17480:
+	default:
+		return fmt.Errorf("unknown compression %d", compression)
+	}
+	textLength := binary.BigEndian.Uint32(rec[4:])
+	textRecords := int(binary.BigEndian.Uint16(rec[8:]))
+	if textLength == 0 || textRecords == 0 {
+		return errors.New("no text")
+	}
+	if textRecords >= count {
+		return fmt.Errorf("%d text records in %d records", textRecords, count)
+	}
+	headerLen := int(binary.BigEndian.Uint32(rec[mobiHeaderLen:]))
+	if len(rec) < mobiMagicOffset+headerLen {
+		return errors.New("truncated MOBI header")
+	}
+	if len(rec) >= mobiVersion+4 {
+		version := binary.BigEndian.Uint32(rec[mobiVersion:])
+		if kf8 && version < 8 {
+			return fmt.Errorf("MOBI version %d is not KF8", version)
+		}
+	}
+	if len(rec) >= mobiExthFlags+4 && binary.BigEndian.Uint32(rec[mobiExthFlags:])&0x40 != 0 {
+		exth := rec[mobiMagicOffset+headerLen:]
+		if len(exth) < 12 || string(exth[:4]) != "EXTH" || int(binary.BigEndian.Uint32(exth[4:])) > len(exth) {
+			return errors.New("invalid EXTH header")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package feeds
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var validateChapters = []chapter{
+	{Title: "Chapter 1", Content: []byte(`<p>Story text &amp; “quotes”. More story text.</p>`)},
+	{Title: "Chapter 2", Content: []byte(`<p>Some <b>bold</b><br/>text here.</p>`)},
+}
+
+// rewriteEPUB copies the EPUB at src to dst, replacing the content of the entries for which fn returns true
+// with data, and leaving out the ones for which it returns a nil data.
+func rewriteEPUB(t *testing.T, src, dst string, fn func(name string) (bool, []byte)) {
+	t.Helper()
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	f, err := os.Create(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	for _, zf := range r.File {
+		replace, data := fn(zf.Name)
+		switch {
+		case !replace:
+			err = w.Copy(zf)
+		case data != nil:
+			var fw io.Writer
+			if fw, err = w.CreateHeader(&zip.FileHeader{Name: zf.Name, Method: zip.Deflate}); err == nil {
+				_, err = fw.Write(data)
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateEPUB(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.epub")
+	if err := epubBook(validateChapters, "Title", "Author", ebookMeta{}, DefaultConvertOptions, valid); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		fn      func(name string) (bool, []byte)
+		wantErr string
+	}{
+		{"generated", func(string) (bool, []byte) { return false, nil }, ""},
+		{"compressed mimetype", func(name string) (bool, []byte) {
+			return name == "mimetype", []byte(epubMimeType)
+		}, "the mimetype file is not the first uncompressed entry"},
+		{"without container", func(name string) (bool, []byte) {
+			return name == "META-INF/container.xml", nil
+		}, "missing META-INF/container.xml"},
+		{"broken document", func(name string) (bool, []byte) {
+			return strings.HasSuffix(name, ".xhtml") && !strings.Contains(name, "nav"), []byte("<html><body><p>broken</body></html>")
+		}, "is not well-formed"},
+		{"missing document", func(name string) (bool, []byte) {
+			return strings.HasSuffix(name, ".xhtml") && !strings.Contains(name, "nav"), nil
+		}, "referenced by the manifest"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(dir, strings.Repeat("x", i+1)+".epub")
+			rewriteEPUB(t, valid, p, tt.fn)
+			err := validateEPUB(p)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validateEPUB() error = %v, want none", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validateEPUB() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	notZip := filepath.Join(dir, "not.epub")
+	if err := os.WriteFile(notZip, []byte("<html></html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateEPUB(notZip); err == nil || !strings.Contains(err.Error(), "not a zip archive") {
+		t.Errorf("validateEPUB() error = %v, want not a zip archive", err)
+	}
+}
+
+func TestValidateMOBI(t *testing.T) {
+	dir := t.TempDir()
+	mobi, azw3 := filepath.Join(dir, "valid.mobi"), filepath.Join(dir, "valid.azw3")
+	if err := mobiBook(validateChapters, "Title", "Author", ebookMeta{}, DefaultConvertOptions, mobi); err != nil {
+		t.Fatal(err)
+	}
+	if err := azw3Book(validateChapters, "Title", "Author", ebookMeta{}, DefaultConvertOptions, azw3); err != nil {
+		t.Fatal(err)
+	}
+	mobiData, err := os.ReadFile(mobi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	azw3Data, err := os.ReadFile(azw3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		kf8     bool
+		wantErr string
+	}{
+		{"generated mobi", mobiData, false, ""},
+		{"generated azw3", azw3Data, true, ""},
+		{"truncated header", mobiData[:pdbHeaderLen-1], false, "truncated header"},
+		{"text database", func() []byte {
+			data := append([]byte{}, mobiData...)
+			copy(data[pdbTypeOffset:], "TEXtREAd")
+			return data
+		}(), false, "invalid database type"},
+		{"truncated record table", mobiData[:pdbHeaderLen+8], false, "truncated record table"},
+		{"mobi as azw3", mobiData, true, "is not KF8"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(dir, strings.Repeat("x", i+1)+".mobi")
+			if err := os.WriteFile(p, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			err := validateMOBI(p, tt.kf8)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validateMOBI() error = %v, want none", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validateMOBI() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
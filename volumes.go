@@ -0,0 +1,408 @@
+package feeds
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+const volumesDir = "volumes"
+
+// Volume is an ebook compiled from a range of items of the same feed, with one chapter for each of them.
+type Volume struct {
+	ID      int
+	Feed    Feed
+	Title   string
+	First   int
+	Last    int
+	Items   []Item
+	Content map[string]Content
+}
+
+// Path returns the stable file name of the volume of type ext, derived from the range of items it contains.
+func (v Volume) Path(ext string) string {
+	return fmt.Sprintf("%05d-%05d %s.%s", v.First, v.Last, sanitizeFileName(v.Title), ext)
+}
+
+// VolumeSelection describes which items of a feed get compiled into volumes.
+type VolumeSelection struct {
+	// First and Last are the range of feed indexes of the items, a zero Last means up to the latest item.
+	First int
+	Last  int
+	// Undispatched selects only the items which haven't been dispatched successfully to any destination.
+	Undispatched bool
+	// PerVolume splits the items in volumes of at most this many chapters.
+	PerVolume int
+	// PerWords splits the items in volumes of about this many words, a volume ending with the chapter reaching it.
+	PerWords int
+	// ByArc splits the items in volumes for each of the arcs derived from their titles.
+	ByArc bool
+}
+
+// LoadVolumeItems returns the items of the feed which have readable HTML content, ordered by their feed index.
+func LoadVolumeItems(c *sql.DB, f Feed, sel VolumeSelection) ([]Item, error) {
+	wheres := []string{"i.feed_id = ?", "i.feed_index >= ?"}
+	params := []interface{}{FlagsDisabled, f.ID, sel.First}
+	if sel.Last > 0 {
+		wheres = append(wheres, "i.feed_index <= ?")
+		params = append(params, sel.Last)
+	}
+	if sel.Undispatched {
+		wheres = append(wheres, "NOT EXISTS (SELECT 1 FROM dispatched t WHERE t.item_id = i.id AND t.last_status = ?)")
+		params = append(params, true)
+	}
+	q := fmt.Sprintf(`SELECT i.id, i.feed_index, i.title, i.author, i.url, i.published_date, i.words, i.language, c.id, c.path, c.type FROM items i
+INNER JOIN contents c ON c.item_id = i.id AND c.type = 'html' AND c.flags != ?
+WHERE %s ORDER BY i.feed_index ASC;`, strings.Join(wheres, " AND "))
+	return loadVolumeItems(c, f, q, params...)
+}
+
+func loadVolumeItems(c *sql.DB, f Feed, q string, params ...interface{}) ([]Item, error) {
+	s, err := c.Query(q, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	all := make([]Item, 0)
+	for s.Next() {
+		var (
+			it                     = Item{Feed: f, Content: make(map[string]Content)}
+			cont                   Content
+			feedIndex, words       sql.NullInt32
+			author, uri, published sql.NullString
+			lang                   sql.NullString
+		)
+		if err = s.Scan(&it.ID, &feedIndex, &it.Title, &author, &uri, &published, &words, &lang, &cont.ID, &cont.Path, &cont.Type); err != nil {
+			return nil, err
+		}
+		it.Language = lang.String
+		it.FeedIndex = int(feedIndex.Int32)
+		it.Reading.Words = int(words.Int32)
+		it.Author = author.String
+		it.URL, _ = url.Parse(uri.String)
+		it.Published, _ = time.Parse(time.RFC3339Nano, published.String)
+		it.Content[cont.Type] = cont
+		all = append(all, it)
+	}
+	return all, nil
+}
+
+var (
+	arcNameRe   = regexp.MustCompile(`(?i)\b(volume|vol\.?|book|arc|part|season)\s*([0-9]+|[ivxlc]+)\b`)
+	arcNumberRe = regexp.MustCompile(`^\s*(\d+)\.\d+`)
+)
+
+// arcName derives the name of the arc an item belongs to from titles like "Volume 2, Chapter 5",
+// "Book III - Chapter 1" or "2.05 L", which the Wandering Inn uses.
+// It returns an empty string when the title doesn't contain one.
+func arcName(title string) string {
+	if m := arcNameRe.FindStringSubmatch(title); m != nil {
+		kind := strings.TrimSuffix(strings.ToLower(m[1]), ".")
+		if kind == "vol" {
+			kind = "volume"
+		}
+		return strings.ToUpper(kind[:1]) + kind[1:] + " " + strings.ToUpper(m[2])
+	}
+	if m := arcNumberRe.FindStringSubmatch(title); m != nil {
+		return "Volume " + m[1]
+	}
+	return ""
+}
+
+// SplitVolumes groups the items in volumes according to the selection.
+// The items with titles not containing an arc are added to the arc of the previous item.
+func SplitVolumes(f Feed, items []Item, sel VolumeSelection) []Volume {
+	volumes := make([]Volume, 0)
+	var cur *Volume
+	arc := ""
+	words := 0
+	for _, it := range items {
+		newArc := arc
+		if sel.ByArc {
+			if a := arcName(it.Title); a != "" {
+				newArc = a
+			}
+		}
+		full := sel.PerVolume > 0 && cur != nil && len(cur.Items) >= sel.PerVolume
+		full = full || sel.PerWords > 0 && cur != nil && words >= sel.PerWords
+		if cur == nil || newArc != arc || full {
+			volumes = append(volumes, Volume{Feed: f, First: it.FeedIndex, Content: make(map[string]Content)})
+			cur = &volumes[len(volumes)-1]
+			arc = newArc
+			cur.Title = arc
+			words = 0
+		}
+		words += it.Reading.Words
+		cur.Items = append(cur.Items, it)
+		cur.Last = it.FeedIndex
+	}
+	for i := range volumes {
+		volumes[i].Title = volumeTitle(volumes[i])
+	}
+	return volumes
+}
+
+func volumeTitle(v Volume) string {
+	if v.Title != "" {
+		return fmt.Sprintf("%s - %s", v.Feed.Title, v.Title)
+	}
+	if v.First == v.Last {
+		return fmt.Sprintf("%s %d", v.Feed.Title, v.First)
+	}
+	return fmt.Sprintf("%s %d-%d", v.Feed.Title, v.First, v.Last)
+}
+
+// GenerateVolume compiles the items of the volume in an ebook of type typ and saves it to the storage,
+// unless it already exists and overwrite is false.
+func GenerateVolume(ctx context.Context, c *sql.DB, s Storage, v *Volume, typ string, overwrite bool) error {
+	conv, ok := converters[typ]
+	if !ok || !conv.Chapters() {
+		return fmt.Errorf("invalid volume type %s, valid ones are %v", typ, VolumeTypes())
+	}
+	if len(v.Items) == 0 {
+		return errors.New("empty volume")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	opts := DefaultConvertOptions
+	if css, err := LoadFeedStylesheet(c, v.Feed.ID); err != nil {
+		log.Printf("Unable to load stylesheet: %s", err)
+	} else {
+		opts.FeedStylesheet = css
+	}
+	name := blobName(OutputDir, v.Feed.Title, volumesDir, typ, v.Path(conv.Ext()))
+	if !overwrite && blobExists(s, name) {
+		info, err := s.Stat(name)
+		if err != nil {
+			return err
+		}
+		v.Content[typ] = Content{Path: name, Type: typ, Size: info.Size}
+		return saveVolume(c, v, typ)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "feeds-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err = loadFeedImages(ctx, c, s, &v.Feed); err != nil {
+		log.Printf("Unable to load feed images: %s", err)
+	}
+	if err = writeCover(s, v.Feed, volumeCoverText(*v), opts, tmpDir); err != nil {
+		log.Printf("Unable to generate cover: %s", err)
+	}
+
+	meta := volumeMeta(*v)
+	opts.Language = meta.Language
+	chapters := make([]chapter, 0, len(v.Items))
+	total := ReadingStats{}
+	for _, it := range v.Items {
+		buf, err := getItemContentForType(s, it, OutputTypeHTML)
+		if err != nil {
+			return fmt.Errorf("unable to load chapter %d: %w", it.FeedIndex, err)
+		}
+		if buf, err = embedImages(s, buf, tmpDir, opts); err != nil {
+			return err
+		}
+		total = total.add(htmlStats(buf))
+		chapters = append(chapters, chapter{Title: strings.TrimSpace(it.Title), Content: prepareHTML(buf, typ, opts)})
+	}
+
+	author := v.Feed.Author
+	if author == "" {
+		author = v.Items[0].Author
+	}
+	outPath := filepath.Join(tmpDir, path.Base(name))
+	meta.Description = fmt.Sprintf("%d chapters, %s", len(chapters), total)
+	if err = conv.Convert(chapters, v.Title, strings.TrimSpace(author), meta, opts, outPath); err != nil {
+		return err
+	}
+	if err = validateContent(typ, outPath); err != nil {
+		return err
+	}
+	info, err := os.Stat(outPath)
+	if err != nil {
+		return err
+	}
+	if err = saveFileBlob(s, name, outPath); err != nil {
+		return err
+	}
+	v.Content[typ] = Content{Path: name, Type: typ, Size: info.Size()}
+	return saveVolume(c, v, typ)
+}
+
+func saveVolume(c *sql.DB, v *Volume, typ string) error {
+	cont := v.Content[typ]
+	ins := `INSERT INTO volumes (feed_id, title, first_index, last_index, type, path, size, created) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (feed_id, first_index, last_index, type) DO UPDATE SET title = excluded.title, path = excluded.path, size = excluded.size
+RETURNING id;`
+	return c.QueryRow(ins, v.Feed.ID, v.Title, v.First, v.Last, typ, cont.Path, cont.Size, time.Now().UTC().Format(time.RFC3339)).Scan(&v.ID)
+}
+
+// volumeSubscription is a subscription of a destination to volumes of Size chapters of a feed.
+type volumeSubscription struct {
+	Feed        Feed
+	Size        int
+	Created     time.Time
+	Languages   []string
+	Destination Destination
+}
+
+func loadVolumeSubscriptions(c *sql.DB) ([]volumeSubscription, error) {
+	sel := `SELECT f.id, f.title, f.author, f.url, f.language, s.volume_size, s.created, s.languages, d.id, d.type, d.credentials, d.flags FROM subscriptions s
+INNER JOIN feeds f ON f.id = s.feed_id
+INNER JOIN destinations d ON d.id = s.destination_id
+WHERE s.volume_size > 0 AND f.flags != ? AND d.flags != ?;`
+	s, err := c.Query(sel, FlagsDisabled, FlagsDisabled)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	all := make([]volumeSubscription, 0)
+	for s.Next() {
+		var (
+			sub                      volumeSubscription
+			author, feedURL, created sql.NullString
+			lang, languages          sql.NullString
+		)
+		err = s.Scan(&sub.Feed.ID, &sub.Feed.Title, &author, &feedURL, &lang, &sub.Size, &created, &languages,
+			&sub.Destination.ID, &sub.Destination.Type, &sub.Destination.Credentials, &sub.Destination.Flags)
+		if err != nil {
+			return nil, err
+		}
+		sub.Feed.Author, sub.Feed.Language = author.String, lang.String
+		sub.Languages = ParseLanguages(languages.String)
+		if feedURL.Valid {
+			sub.Feed.URL, _ = url.Parse(feedURL.String)
+		}
+		sub.Created, _ = time.Parse(time.RFC3339Nano, created.String)
+		all = append(all, sub)
+	}
+	return all, nil
+}
+
+// VolumeTypes returns the content types which support multiple chapters.
+func VolumeTypes() []string {
+	types := make([]string, 0)
+	for _, typ := range converterTypes {
+		if converters[typ].Chapters() {
+			types = append(types, typ)
+		}
+	}
+	return types
+}
+
+// volumeType returns the content type chosen for the destination if it supports multiple chapters,
+// or the first of the content types accepted by the destination which does.
+func volumeType(d Destination) string {
+	t, ok := ValidTargets[d.Type]
+	if !ok {
+		return ""
+	}
+	if conv, ok := converters[destinationType(d)]; ok && conv.Chapters() {
+		return conv.Type()
+	}
+	for _, typ := range t.ValidContentTypes() {
+		if conv, ok := converters[typ]; ok && conv.Chapters() {
+			return typ
+		}
+	}
+	return ""
+}
+
+// loadSubscriptionItems loads the items of the feed of the volume subscription which were loaded after its creation
+// and haven't been dispatched to its destination yet.
+func loadSubscriptionItems(c *sql.DB, sub volumeSubscription) ([]Item, error) {
+	wheres := []string{"i.feed_id = ?", "NOT EXISTS (SELECT 1 FROM dispatched t WHERE t.item_id = i.id AND t.destination_id = ? AND t.last_status = ?)"}
+	params := []interface{}{FlagsDisabled, sub.Feed.ID, sub.Destination.ID, true}
+	// NOTE(marius): the subscriptions saved before their creation date was recorded get all the items of the feed
+	if !sub.Created.IsZero() {
+		wheres = append(wheres, "c.created > ?")
+		params = append(params, sub.Created.UTC().Format(time.RFC3339))
+	}
+	q := fmt.Sprintf(`SELECT i.id, i.feed_index, i.title, i.author, i.url, i.published_date, i.words, i.language, c.id, c.path, c.type FROM items i
+INNER JOIN contents c ON c.item_id = i.id AND c.type = 'html' AND c.flags != ?
+WHERE %s ORDER BY i.feed_index ASC;`, strings.Join(wheres, " AND "))
+	return loadVolumeItems(c, sub.Feed, q, params...)
+}
+
+// DispatchVolumes compiles the items loaded after the creation of the volume subscriptions, and which haven't been
+// dispatched to their destinations yet, into volumes of the subscribed size and dispatches them.
+// The items of a volume are recorded as dispatched together with it.
+func DispatchVolumes(ctx context.Context, c *sql.DB, s Storage) error {
+	subs, err := loadVolumeSubscriptions(c)
+	if err != nil {
+		return err
+	}
+	errs := make([]error, 0)
+	for _, sub := range subs {
+		typ := volumeType(sub.Destination)
+		if typ == "" {
+			log.Printf("Destination %s[%d] doesn't support volumes, skipping", sub.Destination.Type, sub.Destination.ID)
+			continue
+		}
+		items, err := loadSubscriptionItems(c, sub)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		items = slices.DeleteFunc(items, func(it Item) bool {
+			return !languageMatches(it, sub.Languages)
+		})
+		for _, v := range SplitVolumes(sub.Feed, items, VolumeSelection{PerVolume: sub.Size}) {
+			if len(v.Items) < sub.Size {
+				// NOTE(marius): the last volume waits until it gathers enough chapters
+				continue
+			}
+			if err = GenerateVolume(ctx, c, s, &v, typ, false); err != nil {
+				errs = append(errs, fmt.Errorf("unable to generate volume %s: %w", v.Title, err))
+				continue
+			}
+			if err = dispatchVolume(ctx, c, s, v, typ, sub.Destination); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func dispatchVolume(ctx context.Context, c *sql.DB, s Storage, v Volume, typ string, dest Destination) error {
+	disp := DispatchItem{
+		Item: Item{
+			Title:   fmt.Sprintf("chapters %d-%d", v.First, v.Last),
+			Feed:    v.Feed,
+			Content: map[string]Content{typ: v.Content[typ]},
+		},
+		Destination: dest,
+	}
+	log.Printf("Dispatching volume %s to %s[%d]", v.Title, dest.Type, dest.ID)
+
+	var err error
+	if disp.LastStatus, err = dispatchToTarget(ctx, s, disp); errors.Is(err, errUnknownTarget) {
+		return err
+	}
+	if err != nil {
+		disp.LastMessage = err.Error()
+	}
+	for _, it := range v.Items {
+		disp.Item = it
+		if serr := SaveTarget(c, disp); serr != nil {
+			log.Printf("Unable to save dispatch status for %s: %s", it.Title, serr)
+		}
+	}
+	return err
+}
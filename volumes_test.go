@@ -0,0 +1,65 @@
+package feeds
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLoadSubscriptionItems(t *testing.T) {
+	for name, c := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			exec := func(q string, params ...interface{}) {
+				t.Helper()
+				if _, err := c.Exec(q, params...); err != nil {
+					t.Fatal(err)
+				}
+			}
+			exec(`INSERT INTO feeds (title, author, url, flags) VALUES ('Feed', 'Author', 'https://example.com/feed', 0);`)
+			for i := 1; i <= 4; i++ {
+				exec(`INSERT INTO items (url, feed_id, title, author, feed_index) VALUES (?, 1, ?, 'Author', ?);`,
+					fmt.Sprintf("https://example.com/%d", i), fmt.Sprintf("Chapter %d", i), i)
+				exec(`INSERT INTO contents (item_id, path, type, created, flags) VALUES (?, ?, 'html', ?, 0);`,
+					i, fmt.Sprintf("blobs/%d.html", i), fmt.Sprintf("2024-01-%02dT00:00:00Z", i*7))
+			}
+			exec(`INSERT INTO destinations (type, credentials, flags, created) VALUES ('myk', '{}', 0, '2024-01-01T00:00:00Z');`)
+			exec(`INSERT INTO destinations (type, credentials, flags, created) VALUES ('myk', '{}', 0, '2024-01-01T00:00:00Z');`)
+			// NOTE(marius): the first subscription is older than the recording of the creation dates
+			exec(`INSERT INTO subscriptions (feed_id, destination_id, volume_size, created) VALUES (1, 1, 2, NULL);`)
+			exec(`INSERT INTO subscriptions (feed_id, destination_id, volume_size, created) VALUES (1, 2, 2, '2024-01-15T00:00:00Z');`)
+			exec(`INSERT INTO dispatched (item_id, destination_id, last_status, last_try) VALUES (1, 1, ?, '2024-01-08T00:00:00Z');`, true)
+
+			subs, err := loadVolumeSubscriptions(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tests := map[int]struct {
+				created time.Time
+				items   []int
+			}{
+				1: {time.Time{}, []int{2, 3, 4}},
+				2: {time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC), []int{3, 4}},
+			}
+			if len(subs) != len(tests) {
+				t.Fatalf("loadVolumeSubscriptions() = %d subscriptions, want %d", len(subs), len(tests))
+			}
+			for _, sub := range subs {
+				tt := tests[sub.Destination.ID]
+				if !sub.Created.Equal(tt.created) {
+					t.Errorf("destination %d created = %s, want %s", sub.Destination.ID, sub.Created, tt.created)
+				}
+				items, err := loadSubscriptionItems(c, sub)
+				if err != nil {
+					t.Fatalf("loadSubscriptionItems() error = %v", err)
+				}
+				got := make([]int, 0, len(items))
+				for _, it := range items {
+					got = append(got, it.FeedIndex)
+				}
+				if fmt.Sprint(got) != fmt.Sprint(tt.items) {
+					t.Errorf("destination %d items = %v, want %v", sub.Destination.ID, got, tt.items)
+				}
+			}
+		})
+	}
+}